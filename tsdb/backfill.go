@@ -0,0 +1,505 @@
+package tsdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// What a SerieWriter does with a point older than the last point appended.
+//
+// SerieReader.Find, and all the functions based on it, assume that times
+// never decrease within a serie. Points with the same time as the last one
+// are always appended.
+type OutOfOrderPolicy uint8
+
+const (
+	// The point is appended as any other, so Find may return wrong results.
+	// The default, and the policy of the overlay itself.
+	OutOfOrderAllow OutOfOrderPolicy = 0
+	// The point is appended to an overlay of the serie, a separate serie in
+	// the hidden directory returned by BackfillPath. SerieReader.GetData
+	// merges the overlay with the serie, until CompactBackfill moves the
+	// points in place.
+	OutOfOrderBackfill OutOfOrderPolicy = 1
+	// The point is refused with an *OutOfOrderError.
+	OutOfOrderReject OutOfOrderPolicy = 2
+)
+
+var outOfOrderNames = map[OutOfOrderPolicy]string{
+	OutOfOrderAllow:    "allow",
+	OutOfOrderBackfill: "backfill",
+	OutOfOrderReject:   "reject",
+}
+
+func (p OutOfOrderPolicy) String() string {
+	name, ok := outOfOrderNames[p]
+	if !ok {
+		return fmt.Sprintf("unknown(%d)", uint8(p))
+	}
+	return name
+}
+
+func ParseOutOfOrderPolicy(name string) (OutOfOrderPolicy, error) {
+	for p, pname := range outOfOrderNames {
+		if pname == name {
+			return p, nil
+		}
+	}
+	return OutOfOrderAllow, fmt.Errorf("unknown out of order policy '%s' - must be allow, backfill or reject", name)
+}
+
+// Returned when appending a point older than the last one with OutOfOrderReject.
+type OutOfOrderError struct {
+	Time uint64
+	Last uint64
+}
+
+func (e *OutOfOrderError) Error() string {
+	return fmt.Sprintf("time %d is before the time %d of the last point - out of order", e.Time, e.Last)
+}
+
+// Returns the path of the overlay storing the points backfilled in the
+// serie dbbasepath. It is in a hidden directory, not listed by FindSeries.
+func BackfillPath(dbbasepath string) string {
+	dir, name := filepath.Split(dbbasepath)
+	return filepath.Join(dir, ".backfill", name)
+}
+
+func sortPoints(points []Point) {
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Time < points[j].Time
+	})
+}
+
+// Merges two lists of points sorted by time. Points with the same time
+// are returned in the order of the lists.
+func mergePoints(first, second []Point) []Point {
+	merged := make([]Point, 0, len(first)+len(second))
+	for len(first) > 0 && len(second) > 0 {
+		if second[0].Time < first[0].Time {
+			merged = append(merged, second[0])
+			second = second[1:]
+		} else {
+			merged = append(merged, first[0])
+			first = first[1:]
+		}
+	}
+	return append(append(merged, first...), second...)
+}
+
+// Appends points older than the last point of the serie to its overlay.
+func (s *SerieWriter) appendBackfill(points []Point) error {
+	if s.backfill == nil {
+		path := BackfillPath(s.Path)
+		err := os.MkdirAll(filepath.Dir(path), 0777)
+		if err != nil {
+			return err
+		}
+
+		backfill := NewSerieWriter(path)
+		backfill.DataStoreOptions = s.DataStoreOptions
+		backfill.LabelOptions = s.LabelOptions
+		backfill.CompactOnSeal = false
+		backfill.LockTimeout = s.LockTimeout
+		backfill.OutOfOrder = OutOfOrderAllow
+		backfill.InitialMeta = nil
+		err = backfill.Open()
+		if err != nil {
+			return err
+		}
+		s.backfill = backfill
+	}
+	return s.backfill.AppendBatch(points)
+}
+
+// Reads all the points of a serie, sorted by time.
+func readSortedPoints(dbbasepath string) ([]Point, error) {
+	reader := NewSerieReader(dbbasepath)
+	reader.Backfill = false
+	defer reader.Close()
+	if len(GetDataFiles(dbbasepath)) <= 0 {
+		return nil, nil
+	}
+	err := reader.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	points, err := reader.GetData(reader.FirstLocation(), reader.LastLocation(), nil)
+	sortPoints(points)
+	return points, err
+}
+
+// Moves the points backfilled in the overlay of the serie in place, by
+// rewriting all the shards from the first one a backfilled point belongs
+// to, and removes the overlay.
+//
+// The shards are rewritten one at a time in a temporary serie, and synced
+// to disk. Only once they are all written, a commit file is created, and
+// the new shards are renamed over the old ones. If the process crashes
+// before the commit file is written, the new shards are discarded, and
+// after, the next Open or CompactBackfill completes the compaction, so
+// points are never lost nor duplicated. Readers pick up the new files as
+// they reload the shards, but may briefly return inconsistent labels while
+// the files are replaced.
+func (s *SerieWriter) CompactBackfill() error {
+	if s.backfill != nil {
+		s.backfill.Close()
+		s.backfill = nil
+	}
+	err := recoverCompaction(s.Path)
+	if err != nil {
+		return err
+	}
+	backfilled, err := readSortedPoints(BackfillPath(s.Path))
+	if err != nil || len(backfilled) <= 0 {
+		return err
+	}
+
+	reader := NewSerieReader(s.Path)
+	reader.Backfill = false
+	defer reader.Close()
+	err = reader.Open()
+	if err != nil {
+		return err
+	}
+	start := reader.Find(func(time uint64) bool {
+		return time > backfilled[0].Time
+	})
+	if !start.Valid() {
+		return fmt.Errorf("could not read serie %s", s.Path)
+	}
+
+	// Write the new shards under a temporary serie, with the ids they replace.
+	firstid, lastid := start.shard.fileid, s.Id
+	tmppath := compactPath(s.Path)
+	err = os.MkdirAll(filepath.Dir(tmppath), 0777)
+	if err != nil {
+		return err
+	}
+	compacted := NewSerieWriter(tmppath)
+	compacted.DataStoreOptions = s.DataStoreOptions
+	compacted.LabelOptions = s.LabelOptions
+	compacted.SetDurability(DurabilitySeal, 0)
+	compacted.OutOfOrder = OutOfOrderAllow
+	compacted.InitialMeta = nil
+	compacted.Id = firstid
+	err = compacted.Open()
+	if err != nil {
+		return err
+	}
+	// Each shard with the points backfilled before the first of the next.
+	for shard := start.shard; shard != nil && err == nil; shard = shard.Next(reader) {
+		var points []Point
+		points, err = reader.GetData(Location{shard, 0, nil}, Location{shard, shard.GetElements(reader), nil}, nil)
+		if err != nil {
+			break
+		}
+		count := len(backfilled)
+		if next := shard.Next(reader); next != nil && next.entries > 0 {
+			count = sort.Search(len(backfilled), func(i int) bool {
+				return backfilled[i].Time >= next.mintime
+			})
+		}
+		err = compacted.AppendBatch(mergePoints(points, backfilled[:count]))
+		backfilled = backfilled[count:]
+	}
+	if err == nil {
+		compacted.Sync()
+	}
+	newid := compacted.Id
+	compacted.Close()
+	if err == nil {
+		err = writeCompactCommit(s.Path, firstid, newid, lastid)
+	}
+	if err != nil {
+		removeShards(tmppath)
+		return err
+	}
+
+	if s.dw != nil {
+		s.dw.Close()
+		s.ls.Close()
+	}
+	err = commitCompaction(s.Path, firstid, newid, lastid)
+	s.Id = newid
+	if operr := s.openShard(); err == nil {
+		err = operr
+	}
+	return err
+}
+
+// Returns the path of the temporary serie CompactBackfill writes to.
+func compactPath(dbbasepath string) string {
+	return filepath.Join(filepath.Dir(dbbasepath), ".compact", filepath.Base(dbbasepath))
+}
+
+// Returns the name of the file recording that the shards written by
+// CompactBackfill are complete, and must replace the ones of the serie.
+func makeCompactCommitFileName(dbbasepath string) string {
+	return compactPath(dbbasepath) + ".commit"
+}
+
+// Removes all the shards of a serie.
+func removeShards(dbbasepath string) error {
+	for _, filename := range GetDataFiles(dbbasepath) {
+		err := RemoveShard(dbbasepath, ParseFileName(dbbasepath, filename))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Syncs the entries of a directory to disk, so files renamed in it are.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Records that the shards from firstid to newid of the temporary serie
+// replace the shards from firstid to lastid of the serie.
+func writeCompactCommit(dbbasepath string, firstid, newid, lastid uint32) error {
+	filename := makeCompactCommitFileName(dbbasepath)
+	file, err := os.OpenFile(filename+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(file, "%08x %08x %08x\n", firstid, newid, lastid)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(filename+".tmp", filename)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(filename))
+	}
+	if err != nil {
+		os.Remove(filename + ".tmp")
+	}
+	return err
+}
+
+// Completes a compaction interrupted after its commit file was written,
+// or discards the shards written by one interrupted before. Must be called
+// by the owner of the lock of the serie.
+func recoverCompaction(dbbasepath string) error {
+	raw, err := ioutil.ReadFile(makeCompactCommitFileName(dbbasepath))
+	if os.IsNotExist(err) {
+		return removeShards(compactPath(dbbasepath))
+	}
+	if err != nil {
+		return err
+	}
+	var firstid, newid, lastid uint32
+	_, err = fmt.Sscanf(string(raw), "%x %x %x", &firstid, &newid, &lastid)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", makeCompactCommitFileName(dbbasepath), err)
+	}
+	return commitCompaction(dbbasepath, firstid, newid, lastid)
+}
+
+// Moves the shards written by CompactBackfill in place, removes the
+// overlay, and then the commit file. Shards already moved by a previous
+// attempt are skipped, so this can be repeated after a crash.
+func commitCompaction(dbbasepath string, firstid, newid, lastid uint32) error {
+	tmppath := compactPath(dbbasepath)
+	for id := firstid; id <= newid; id++ {
+		if _, err := os.Stat(MakeDataStoreFileName(tmppath, id)); os.IsNotExist(err) {
+			continue
+		}
+		// The labels first, the data file is what makes the shard visible.
+		err := os.Rename(MakeLabelStoreFileName(tmppath, id), MakeLabelStoreFileName(dbbasepath, id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = os.Remove(MakeIndexFileName(dbbasepath, id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = os.Rename(MakeDataStoreFileName(tmppath, id), MakeDataStoreFileName(dbbasepath, id))
+		if err != nil {
+			return err
+		}
+	}
+	for id := newid + 1; id <= lastid; id++ {
+		err := RemoveShard(dbbasepath, id)
+		if err != nil {
+			return err
+		}
+	}
+	err := syncDir(filepath.Dir(dbbasepath))
+	if err == nil {
+		err = removeShards(BackfillPath(dbbasepath))
+	}
+	if err == nil {
+		err = os.Remove(makeCompactCommitFileName(dbbasepath))
+	}
+	return err
+}
+
+// Loads the points in the overlay of the serie, if it changed since they
+// were last loaded.
+func (s *SerieReader) loadBackfill() error {
+	if !s.hasoverlay {
+		s.backfilled, s.overlaykey = nil, ""
+		return nil
+	}
+	if s.overlay == nil {
+		s.overlay = NewSerieReader(BackfillPath(s.Path))
+		s.overlay.Backfill = false
+		s.overlay.Budget = s.Budget
+	}
+	if len(GetDataFiles(s.overlay.Path)) <= 0 {
+		s.overlay.Close()
+		s.backfilled, s.overlaykey = nil, ""
+		return nil
+	}
+
+	first, last := s.overlay.FirstLocation(), s.overlay.LastLocation()
+	if !first.Valid() || !last.Valid() {
+		s.backfilled, s.overlaykey = nil, ""
+		return nil
+	}
+	key := first.Cursor() + "-" + last.Cursor()
+	if key == s.overlaykey {
+		return nil
+	}
+	if s.MaxBackfilled > 0 {
+		entries := 0
+		for _, shard := range s.overlay.shard {
+			entries += shard.entries
+		}
+		if entries > s.MaxBackfilled {
+			return fmt.Errorf("serie %s has %d points backfilled, more than the %d that can be loaded - run CompactBackfill", s.Path, entries, s.MaxBackfilled)
+		}
+	}
+
+	points, err := s.overlay.GetData(first, last, nil)
+	if err != nil {
+		return err
+	}
+	sortPoints(points)
+	s.backfilled, s.overlaykey = points, key
+	return nil
+}
+
+// Returns the backfilled points GetData merges between start and end: the
+// points with a time equal or later than the first element at start, and
+// earlier than the first element at end. Ranges are bounded by the times
+// of elements: with elements 10 and 20, a point backfilled at 12 is read
+// from 10, but not from 20, as found by Find for any time from 11 to 20.
+// Points older than the first element are read from the first element.
+// A location of a backfilled point, as from ParseCursor, starts or ends the
+// range at that point.
+func (s *SerieReader) backfillRange(start, end Location) []Point {
+	first, last := 0, s.backfillIndex(end)
+	if start.point != nil || s.hasElementBefore(start) {
+		first = s.backfillIndex(start)
+	}
+	if last < first {
+		last = first
+	}
+	return s.backfilled[first:last]
+}
+
+// Returns the index of the first backfilled point with a time equal or
+// later than the first element at or after location, or the number of
+// points backfilled if there is no such element. For the location of a
+// backfilled point, returns the index of the point.
+func (s *SerieReader) backfillIndex(location Location) int {
+	if location.point != nil && location.point != &afterBackfilled {
+		return s.backfilledIndex(location.point)
+	}
+	shard, element := location.shard, location.element
+	for shard != nil && shard.Load(s) == nil {
+		if element >= shard.dw.GetEntries() {
+			shard, element = shard.Next(s), 0
+			continue
+		}
+		time := shard.dw.GetTime(shard.dw.GetOffset(element))
+		if time != SealMarker {
+			return sort.Search(len(s.backfilled), func(i int) bool {
+				return s.backfilled[i].Time >= time
+			})
+		}
+		element += 1
+	}
+	return len(s.backfilled)
+}
+
+// Returns true if there is an element of the serie before location.
+func (s *SerieReader) hasElementBefore(location Location) bool {
+	shard, element := location.shard, location.element
+	for shard != nil && shard.Load(s) == nil {
+		if element <= 0 {
+			shard = shard.Prev(s)
+			if shard != nil && shard.Load(s) == nil {
+				element = shard.dw.GetEntries()
+			}
+			continue
+		}
+		element -= 1
+		if shard.dw.GetTime(shard.dw.GetOffset(element)) != SealMarker {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the index of a point of the overlay, as referenced by a Location.
+// If the overlay was reloaded since, the index of the first point with the
+// same time.
+func (s *SerieReader) backfilledIndex(point *Point) int {
+	index := sort.Search(len(s.backfilled), func(i int) bool {
+		return s.backfilled[i].Time >= point.Time
+	})
+	for i := index; i < len(s.backfilled) && s.backfilled[i].Time == point.Time; i++ {
+		if &s.backfilled[i] == point {
+			return i
+		}
+	}
+	return index
+}
+
+// Used as the point of a Location before an element, but after the points
+// backfilled before it. Only needed for the first element of the serie, as
+// reading from it otherwise includes the points older than it.
+var afterBackfilled Point
+
+// Returns a cursor to resume reading after the point at location, as
+// passed to a Summarizer by GetData. Unlike the cursor of the following
+// element, it does not skip the points backfilled before that element.
+// Backfilled points are identified by their time, and by how many points
+// with the same time come before them.
+func (s *SerieReader) CursorAfter(location Location) string {
+	next, index := Location{location.shard, location.element, nil}, 0
+	if location.point == nil {
+		next, index = location.Plus(s, 1), s.backfillIndex(location)
+	} else {
+		index = s.backfilledIndex(location.point) + 1
+	}
+	if index >= s.backfillIndex(next) {
+		// The points older than the first element are read from it.
+		if !s.hasElementBefore(next) {
+			return next.Cursor() + ".-"
+		}
+		return next.Cursor()
+	}
+	time, skip := s.backfilled[index].Time, 0
+	for skip < index && s.backfilled[index-skip-1].Time == time {
+		skip += 1
+	}
+	return fmt.Sprintf("%s.%x.%x", next.Cursor(), time, skip)
+}
@@ -0,0 +1,316 @@
+package tsdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSerieWriterOutOfOrder(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.OutOfOrder = OutOfOrderReject
+	err = s.Open()
+	assert.Nil(t, err)
+	assert.Nil(t, s.Append(10, 1, nil))
+	assert.Nil(t, s.Append(10, 2, nil))
+
+	err = s.Append(9, 3, nil)
+	assert.Equal(t, &OutOfOrderError{9, 10}, err)
+	err = s.AppendBatch([]Point{{11, 4, nil, TypeUint64}, {10, 5, nil, TypeUint64}})
+	assert.Equal(t, &OutOfOrderError{10, 11}, err)
+	s.Close()
+
+	// The time of the last point is recovered when the serie is reopened.
+	err = s.Open()
+	assert.Nil(t, err)
+	assert.NotNil(t, s.Append(9, 3, nil))
+	s.Close()
+
+	r := NewSerieReader(s.Path)
+	defer r.Close()
+	points, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(points))
+	// Without overlay, none is looked for.
+	assert.False(t, r.hasoverlay)
+	assert.Nil(t, r.overlay)
+}
+
+func TestSerieWriterBackfill(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.OutOfOrder = OutOfOrderBackfill
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := uint64(0); i < 1000; i += 2 {
+		assert.Nil(t, s.Append(i, i, nil))
+	}
+	// Backfill the odd times in the first shards, in reverse order.
+	for i := uint64(199); i < 200; i -= 2 {
+		assert.Nil(t, s.Append(i, i, []string{"late"}))
+	}
+	s.Sync()
+	assert.Equal(t, 4, len(GetDataFiles(s.Path)))
+	assert.Equal(t, 1, len(GetDataFiles(BackfillPath(s.Path))))
+
+	verify := func(r *SerieReader) {
+		first, last := r.FirstLocation(), r.LastLocation()
+		points, err := r.GetData(first, last, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 600, len(points))
+		for i, point := range points {
+			expected := uint64(i)
+			if i >= 200 {
+				expected = uint64(i-100) * 2
+			}
+			assert.Equal(t, expected, point.Time)
+			assert.Equal(t, expected, point.Value)
+			if expected < 200 && expected%2 == 1 {
+				assert.Equal(t, []string{"late"}, point.Label)
+			} else {
+				assert.Equal(t, 0, len(point.Label))
+			}
+		}
+
+		// Reading adjacent ranges returns each point once.
+		for _, split := range []int{1, 50, 127, 300} {
+			middle := first.Plus(r, split)
+			before, err := r.GetData(first, middle, nil)
+			assert.Nil(t, err)
+			after, err := r.GetData(middle, last, nil)
+			assert.Nil(t, err)
+			assert.Equal(t, points, append(before, after...))
+		}
+	}
+
+	r := NewSerieReader(s.Path)
+	defer r.Close()
+	verify(r)
+
+	// Without Backfill, only the points in order are returned.
+	plain := NewSerieReader(s.Path)
+	plain.Backfill = false
+	points, err := plain.GetData(plain.FirstLocation(), plain.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(points))
+	plain.Close()
+
+	// Past MaxBackfilled, reads fail instead of loading the overlay.
+	limited := NewSerieReader(s.Path)
+	limited.MaxBackfilled = 99
+	_, err = limited.GetData(limited.FirstLocation(), limited.LastLocation(), nil)
+	assert.Contains(t, err.Error(), "CompactBackfill")
+	limited.MaxBackfilled = 100
+	points, err = limited.GetData(limited.FirstLocation(), limited.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 600, len(points))
+	limited.Close()
+
+	// Compaction moves the points in place, and removes the overlay.
+	err = s.CompactBackfill()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(GetDataFiles(BackfillPath(s.Path))))
+	assert.Equal(t, 5, len(GetDataFiles(s.Path)))
+
+	plain = NewSerieReader(s.Path)
+	plain.Backfill = false
+	verify(plain)
+	plain.Close()
+	// Readers opened before the compaction see the new files.
+	verify(r)
+
+	// The writer keeps appending after the compaction.
+	assert.Nil(t, s.Append(1000, 1000, nil))
+	s.Close()
+	points, err = r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 601, len(points))
+	assert.Equal(t, uint64(1000), points[600].Time)
+}
+
+func TestCompactBackfillRecovery(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	// Copies the files matching pattern in src to dst, with the same names.
+	copyFiles := func(src, dst, pattern string) {
+		assert.Nil(t, os.MkdirAll(dst, 0777))
+		files, err := filepath.Glob(filepath.Join(src, pattern))
+		assert.Nil(t, err)
+		for _, file := range files {
+			_, err := copyFile(file, filepath.Join(dst, filepath.Base(file)))
+			assert.Nil(t, err)
+		}
+	}
+	count := func(path string) int {
+		r := NewSerieReader(path)
+		defer r.Close()
+		points, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+		assert.Nil(t, err)
+		return len(points)
+	}
+
+	compacted := filepath.Join(tempdir, "compacted", "test")
+	crashed := filepath.Join(tempdir, "crashed", "test")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(compacted), 0777))
+	s := NewSerieWriter(compacted)
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.OutOfOrder = OutOfOrderBackfill
+	assert.Nil(t, s.Open())
+	for i := uint64(0); i < 1000; i += 2 {
+		assert.Nil(t, s.Append(i, i, nil))
+	}
+	for i := uint64(199); i < 200; i -= 2 {
+		assert.Nil(t, s.Append(i, i, []string{"late"}))
+	}
+	s.Close()
+	copyFiles(filepath.Dir(compacted), filepath.Dir(crashed), "test-*")
+	copyFiles(filepath.Dir(BackfillPath(compacted)), filepath.Dir(BackfillPath(crashed)), "test*")
+
+	assert.Nil(t, s.Open())
+	assert.Nil(t, s.CompactBackfill())
+	s.Close()
+	assert.Equal(t, 5, len(GetDataFiles(compacted)))
+
+	// Crash before the commit: the new shards are discarded on Open.
+	copyFiles(filepath.Dir(compacted), filepath.Dir(compactPath(crashed)), "test-*")
+	w := NewSerieWriter(crashed)
+	assert.Nil(t, w.Open())
+	w.Close()
+	assert.Equal(t, 0, len(GetDataFiles(compactPath(crashed))))
+	assert.Equal(t, 4, len(GetDataFiles(crashed)))
+	assert.Equal(t, 1, len(GetDataFiles(BackfillPath(crashed))))
+	assert.Equal(t, 600, count(crashed))
+
+	// Crash after the commit, with one shard moved: Open completes it.
+	copyFiles(filepath.Dir(compacted), filepath.Dir(compactPath(crashed)), "test-*")
+	assert.Nil(t, writeCompactCommit(crashed, 1, 5, 4))
+	assert.Nil(t, os.Rename(MakeLabelStoreFileName(compactPath(crashed), 1), MakeLabelStoreFileName(crashed, 1)))
+	assert.Nil(t, os.Rename(MakeDataStoreFileName(compactPath(crashed), 1), MakeDataStoreFileName(crashed, 1)))
+	assert.Nil(t, w.Open())
+	w.Close()
+	_, err = os.Stat(makeCompactCommitFileName(crashed))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 0, len(GetDataFiles(compactPath(crashed))))
+	assert.Equal(t, 0, len(GetDataFiles(BackfillPath(crashed))))
+	assert.Equal(t, 5, len(GetDataFiles(crashed)))
+	assert.Equal(t, 600, count(crashed))
+	for id := uint32(1); id <= 5; id++ {
+		expected, err := ioutil.ReadFile(MakeDataStoreFileName(compacted, id))
+		assert.Nil(t, err)
+		got, err := ioutil.ReadFile(MakeDataStoreFileName(crashed, id))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, got)
+	}
+}
+
+func TestBackfillRange(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.OutOfOrder = OutOfOrderBackfill
+	err = s.Open()
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Nil(t, s.Append(10, 10, nil))
+	assert.Nil(t, s.Append(20, 20, nil))
+	assert.Nil(t, s.Append(12, 12, []string{"late"}))
+
+	r := NewSerieReader(s.Path)
+	defer r.Close()
+	filter, err := ParseLabelFilter([]string{"late"})
+	assert.Nil(t, err)
+	read := func(from, to uint64) []uint64 {
+		start := r.Find(func(time uint64) bool { return time >= from })
+		end := r.Find(func(time uint64) bool { return time > to })
+		points, err := r.GetData(start, end, nil)
+		assert.Nil(t, err)
+		filtered, err := r.GetFilteredData(start, end, filter, nil)
+		assert.Nil(t, err)
+		labels, err := r.ListLabels(start, end)
+		assert.Nil(t, err)
+
+		times := []uint64{}
+		late := false
+		for _, point := range points {
+			times = append(times, point.Time)
+			late = late || point.Time == 12
+		}
+		assert.Equal(t, late, len(filtered) == 1, "%d-%d", from, to)
+		assert.Equal(t, late, len(labels) == 1, "%d-%d", from, to)
+		return times
+	}
+
+	// The point backfilled is read with the element before it.
+	assert.Equal(t, []uint64{20}, read(15, 100))
+	assert.Equal(t, []uint64{10, 12, 20}, read(10, 100))
+	assert.Equal(t, []uint64{10, 12}, read(10, 15))
+	assert.Equal(t, []uint64{10, 12}, read(0, 19))
+	assert.Equal(t, []uint64{20}, read(20, 20))
+}
+
+func TestBackfillCursor(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.OutOfOrder = OutOfOrderBackfill
+	err = s.Open()
+	assert.Nil(t, err)
+	defer s.Close()
+	for i := uint64(10); i <= 2000; i += 10 {
+		assert.Nil(t, s.Append(i, i, nil))
+	}
+	for _, i := range []uint64{12, 15, 15, 5, 1005, 1995} {
+		assert.Nil(t, s.Append(i, i, []string{"late"}))
+	}
+
+	r := NewSerieReader(s.Path)
+	defer r.Close()
+	all, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 206, len(all))
+
+	// Resuming from the cursor after each point returns exactly the rest.
+	cursors := []string{}
+	_, err = r.GetData(r.FirstLocation(), r.LastLocation(), func(points []Point, location Location, time, value uint64) []Point {
+		cursors = append(cursors, r.CursorAfter(location))
+		return points
+	})
+	assert.Nil(t, err)
+	other := NewSerieReader(s.Path)
+	defer other.Close()
+	for i, cursor := range cursors {
+		location, err := other.ParseCursor(cursor)
+		assert.Nil(t, err)
+		rest, err := other.GetData(location, other.LastLocation(), nil)
+		assert.Nil(t, err)
+		assert.Equal(t, all[i+1:], rest, "%d %s", i, cursor)
+	}
+	// Only cursors followed by a backfilled point, or by the first element,
+	// differ from the cursors of elements.
+	assert.Equal(t, 3, len(strings.Split(cursors[0], ".")))
+	assert.Equal(t, 4, len(strings.Split(cursors[1], ".")))
+	assert.Equal(t, 2, len(strings.Split(cursors[5], ".")))
+}
@@ -0,0 +1,159 @@
+package tsdb
+
+import (
+	"sync"
+	"time"
+)
+
+// A BufferedSerieWriter accumulates points in memory, and appends them
+// to a SerieWriter in batches, trading latency for throughput.
+//
+// Points are flushed when FlushPoints are buffered, every FlushInterval,
+// and on Flush or Close. Points that were not flushed yet are not visible
+// to readers, and are lost if the process crashes.
+//
+// A BufferedSerieWriter is safe for concurrent use.
+type BufferedSerieWriter struct {
+	// Number of points to buffer before appending them to the serie.
+	FlushPoints int
+	// Maximum time a point stays in the buffer. 0 to only flush when
+	// FlushPoints are buffered, or Flush is called.
+	FlushInterval time.Duration
+	// How often to msync the serie to disk after a flush. 0 to leave it
+	// to the kernel.
+	SyncInterval time.Duration
+
+	lock     sync.Mutex
+	writer   *SerieWriter
+	buffer   []Point
+	lastsync time.Time
+	// Error of the last flush in background, returned by the next call.
+	err    error
+	done   chan struct{}
+	closed bool
+}
+
+// Returns a BufferedSerieWriter appending to writer, which must be open.
+// If flushinterval is > 0, a goroutine flushes the buffer periodically
+// until Close is called.
+func NewBufferedSerieWriter(writer *SerieWriter, flushpoints int, flushinterval, syncinterval time.Duration) *BufferedSerieWriter {
+	bw := &BufferedSerieWriter{flushpoints, flushinterval, syncinterval, sync.Mutex{}, writer, make([]Point, 0, flushpoints), time.Now(), nil, make(chan struct{}), false}
+	if flushinterval > 0 {
+		go bw.flushPeriodically()
+	}
+	return bw
+}
+
+func (bw *BufferedSerieWriter) flushPeriodically() {
+	ticker := time.NewTicker(bw.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bw.done:
+			return
+		case <-ticker.C:
+			bw.lock.Lock()
+			if bw.closed {
+				bw.lock.Unlock()
+				return
+			}
+			if err := bw.flush(); err != nil {
+				bw.err = err
+			}
+			bw.lock.Unlock()
+		}
+	}
+}
+
+// Must be called with the lock held. On error, the points that were not
+// appended stay in the buffer, and are retried by the next flush.
+func (bw *BufferedSerieWriter) flush() error {
+	if len(bw.buffer) > 0 {
+		remaining, err := bw.writer.appendBatch(bw.buffer)
+		bw.buffer = append(bw.buffer[:0], remaining...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if bw.SyncInterval > 0 && time.Since(bw.lastsync) >= bw.SyncInterval {
+		bw.writer.Sync()
+		bw.lastsync = time.Now()
+	}
+	return nil
+}
+
+// Returns, and clears, the error of a flush in background.
+// Must be called with the lock held.
+func (bw *BufferedSerieWriter) lastError() error {
+	err := bw.err
+	bw.err = nil
+	return err
+}
+
+// Adds a point to the buffer, converting its value to the ValueType of
+// the serie when flushed. May return the error of a previous flush.
+//
+// Points that could never be appended, as their value cannot be converted
+// or they are out of order with OutOfOrderReject, are refused right away.
+func (bw *BufferedSerieWriter) AppendPoint(point Point) error {
+	if len(point.Label) > 0 {
+		point.Label = append([]string(nil), point.Label...)
+	}
+	if _, err := ConvertValue(point.Value, point.Type, bw.writer.ValueType); err != nil {
+		return err
+	}
+
+	bw.lock.Lock()
+	defer bw.lock.Unlock()
+	if bw.writer.OutOfOrder == OutOfOrderReject {
+		last := bw.writer.last
+		if len(bw.buffer) > 0 && bw.buffer[len(bw.buffer)-1].Time > last {
+			last = bw.buffer[len(bw.buffer)-1].Time
+		}
+		if point.Time < last {
+			return &OutOfOrderError{point.Time, last}
+		}
+	}
+	bw.buffer = append(bw.buffer, point)
+	if len(bw.buffer) >= bw.FlushPoints {
+		if err := bw.flush(); err != nil {
+			return err
+		}
+	}
+	return bw.lastError()
+}
+
+// Adds a point to the buffer, with a value of the ValueType of the serie.
+func (bw *BufferedSerieWriter) Append(time, value uint64, labels []string) error {
+	return bw.AppendPoint(Point{time, value, labels, bw.writer.ValueType})
+}
+
+// Appends all the buffered points to the serie.
+func (bw *BufferedSerieWriter) Flush() error {
+	bw.lock.Lock()
+	defer bw.lock.Unlock()
+	if err := bw.flush(); err != nil {
+		return err
+	}
+	return bw.lastError()
+}
+
+// Flushes the buffer, stops the periodic flushes, and closes the writer.
+// Calling Close again does nothing.
+func (bw *BufferedSerieWriter) Close() error {
+	bw.lock.Lock()
+	defer bw.lock.Unlock()
+	if bw.closed {
+		return nil
+	}
+	bw.closed = true
+	close(bw.done)
+
+	err := bw.flush()
+	if err == nil {
+		err = bw.lastError()
+	}
+	bw.writer.Close()
+	return err
+}
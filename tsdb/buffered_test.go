@@ -0,0 +1,103 @@
+package tsdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func countPoints(t *testing.T, path string) int {
+	r := NewSerieReader(path)
+	err := r.Open()
+	assert.Nil(t, err)
+	data, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	return len(data)
+}
+
+func TestBufferedSerieWriter(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	path := filepath.Join(tempdir, "test")
+
+	s := NewSerieWriter(path)
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	err = s.Open()
+	assert.Nil(t, err)
+
+	bw := NewBufferedSerieWriter(s, 10, 0, time.Millisecond)
+	labels := []string{"foo"}
+	for i := uint64(1); i <= 25; i++ {
+		assert.Nil(t, bw.Append(i, i, labels))
+	}
+	// The labels are copied, the caller can reuse them.
+	labels[0] = "bar"
+
+	// Points are only visible once flushed.
+	assert.Equal(t, 20, countPoints(t, path))
+	assert.Nil(t, bw.Flush())
+	assert.Equal(t, 25, countPoints(t, path))
+	assert.Nil(t, bw.Close())
+
+	r := NewSerieReader(path)
+	assert.Nil(t, r.Open())
+	data, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo"}, data[24].Label)
+
+	// Points are flushed periodically.
+	s = NewSerieWriter(path)
+	err = s.Open()
+	assert.Nil(t, err)
+	bw = NewBufferedSerieWriter(s, 1000, 10*time.Millisecond, 0)
+	assert.Nil(t, bw.Append(26, 26, nil))
+	for start := time.Now(); countPoints(t, path) < 26 && time.Since(start) < 5*time.Second; {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, 26, countPoints(t, path))
+	assert.Nil(t, bw.Close())
+}
+
+func TestBufferedSerieWriterErrors(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+	path := filepath.Join(tempdir, "test")
+
+	s := NewSerieWriter(path)
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.OutOfOrder = OutOfOrderReject
+	err = s.Open()
+	assert.Nil(t, err)
+
+	// Points that can never be appended are refused without buffering them.
+	bw := NewBufferedSerieWriter(s, 1000, 0, 0)
+	assert.Nil(t, bw.Append(10, 10, nil))
+	assert.NotNil(t, bw.AppendPoint(Point{11, math.Float64bits(1.5), nil, TypeFloat64}))
+	_, ok := bw.AppendPoint(Point{5, 5, nil, TypeUint64}).(*OutOfOrderError)
+	assert.True(t, ok)
+
+	// The points not appended stay buffered when a flush fails, here as the
+	// next shard cannot be created.
+	for i := uint64(11); i <= 500; i++ {
+		assert.Nil(t, bw.Append(i, i, nil))
+	}
+	next := MakeDataStoreFileName(path, s.Id+1)
+	assert.Nil(t, os.Mkdir(next, 0755))
+	assert.NotNil(t, bw.Flush())
+	assert.Nil(t, os.Remove(next))
+	written := countPoints(t, path)
+	assert.True(t, written > 1 && written < 491, "%d", written)
+	assert.Nil(t, bw.Flush())
+	assert.Equal(t, 491, countPoints(t, path))
+
+	// Close can be called more than once.
+	assert.Nil(t, bw.Close())
+	assert.Nil(t, bw.Close())
+}
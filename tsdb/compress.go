@@ -0,0 +1,408 @@
+package tsdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+// Format of a compressed .data file:
+//   [ 0 -  7] - 8 bytes - common header, with magic "TSDB", see header.go.
+//   [ 8 - 15] - 8 bytes - uint64 - number of entries in the file.
+//   [  16   ] - 1 byte  - uint8 - lpe - number of labels per entry in this datafile.
+//   [  17   ] - 1 byte  - uint8 - format - FormatCompressed.
+//   [  18   ] - 1 byte  - uint8 - type - ValueType of the values stored.
+//   [  19   ] - 1 byte  - uint8 - flags - compressedSealed if the last entry is the seal marker.
+//   [20 - 23] - 4 bytes - uint32 - MaxEntries of the file before compression.
+//   [24 - 31] - 8 bytes - unused
+//   [32 - 39] - 8 bytes - uint64 - time of the first entry.
+//   [40 - 47] - 8 bytes - uint64 - value of the first entry.
+//   [48 - 55] - 8 bytes - uint64 - size in bytes of the bit stream.
+//   [56 - ..] - x bytes - bit stream with times and values of the following entries.
+//   [.. - ..] - x bytes - labels of all entries, run length encoded.
+//
+// Header and first entry match the layout of a raw file, so PeekDataStore
+// works on both.
+//
+// Times are stored as the difference between consecutive deltas, in:
+//   '0' - delta of delta is 0.
+//   '10' followed by 7 bits, '110' followed by 9 bits, or '1110' followed
+//       by 12 bits - two's complement delta of delta fitting in those bits.
+//   '1111' followed by 64 bits - any other delta of delta.
+//
+// Values are stored as xor with the previous value, in:
+//   '0' - same value as previous entry.
+//   '10' followed by the meaningful bits of the xor - when the leading and
+//       trailing zeros of the xor are at least as many as in the last
+//       value stored with '11'.
+//   '11' followed by 6 bits of leading zeros, 6 bits of meaningful bits - 1,
+//       and the meaningful bits of the xor.
+//
+// Labels are stored as a sequence of runs, each one with the number of
+// consecutive entries sharing the same labels followed by lpe label ids,
+// all as unsigned varints.
+
+const compressedHeaderSize = 56
+
+// Flags in the header of a compressed file.
+const compressedSealed = uint8(1)
+
+type bitWriter struct {
+	buffer []byte
+	// Number of bits still free in the last byte of buffer.
+	free uint
+}
+
+func (bw *bitWriter) WriteBits(value uint64, count uint) {
+	for count > 0 {
+		if bw.free == 0 {
+			bw.buffer = append(bw.buffer, 0)
+			bw.free = 8
+		}
+		towrite := count
+		if towrite > bw.free {
+			towrite = bw.free
+		}
+		chunk := byte(value>>(count-towrite)) & byte(1<<towrite-1)
+		bw.buffer[len(bw.buffer)-1] |= chunk << (bw.free - towrite)
+		bw.free -= towrite
+		count -= towrite
+	}
+}
+
+type bitReader struct {
+	buffer []byte
+	// Position of the next bit to read.
+	position uint
+}
+
+func (br *bitReader) ReadBits(count uint) (uint64, error) {
+	if br.position+count > uint(len(br.buffer))*8 {
+		return 0, fmt.Errorf("bit stream is truncated")
+	}
+	value := uint64(0)
+	for count > 0 {
+		available := 8 - br.position%8
+		toread := count
+		if toread > available {
+			toread = available
+		}
+		chunk := br.buffer[br.position/8] >> (available - toread) & byte(1<<toread-1)
+		value = value<<toread | uint64(chunk)
+		br.position += toread
+		count -= toread
+	}
+	return value, nil
+}
+
+// Reads up to max bits set to 1, stopping at the first 0. Returns how many 1s were read.
+func (br *bitReader) ReadOnes(max int) (int, error) {
+	for i := 0; i < max; i++ {
+		bit, err := br.ReadBits(1)
+		if err != nil {
+			return 0, err
+		}
+		if bit == 0 {
+			return i, nil
+		}
+	}
+	return max, nil
+}
+
+// Number of bits for each class of delta of delta, after the '1' prefix.
+var deltaBits = []uint{7, 9, 12, 64}
+
+func fitsBits(value int64, count uint) bool {
+	if count >= 64 {
+		return true
+	}
+	return value >= -(1<<(count-1)) && value < 1<<(count-1)
+}
+
+type compressor struct {
+	bw bitWriter
+
+	time, delta uint64
+	value       uint64
+	// Leading and trailing zeros of the last xor stored with '11'. 64 if none yet.
+	leading, trailing uint
+}
+
+func (c *compressor) Add(time, value uint64) {
+	delta := time - c.time
+	dod := int64(delta - c.delta)
+	if dod == 0 {
+		c.bw.WriteBits(0, 1)
+	} else {
+		for i, count := range deltaBits {
+			if fitsBits(dod, count) {
+				prefix := uint64(1)<<uint(i+1) - 1
+				if i < len(deltaBits)-1 {
+					c.bw.WriteBits(prefix<<1, uint(i+2))
+				} else {
+					c.bw.WriteBits(prefix, uint(i+1))
+				}
+				c.bw.WriteBits(uint64(dod), count)
+				break
+			}
+		}
+	}
+	c.time, c.delta = time, delta
+
+	xor := value ^ c.value
+	c.value = value
+	if xor == 0 {
+		c.bw.WriteBits(0, 1)
+		return
+	}
+
+	leading := uint(bits.LeadingZeros64(xor))
+	trailing := uint(bits.TrailingZeros64(xor))
+	if c.leading < 64 && leading >= c.leading && trailing >= c.trailing {
+		c.bw.WriteBits(2, 2)
+		c.bw.WriteBits(xor>>c.trailing, 64-c.leading-c.trailing)
+		return
+	}
+	c.leading, c.trailing = leading, trailing
+	meaningful := 64 - leading - trailing
+	c.bw.WriteBits(3, 2)
+	c.bw.WriteBits(uint64(leading), 6)
+	c.bw.WriteBits(uint64(meaningful-1), 6)
+	c.bw.WriteBits(xor>>trailing, meaningful)
+}
+
+type decompressor struct {
+	br bitReader
+
+	time, delta       uint64
+	value             uint64
+	leading, trailing uint
+}
+
+func (d *decompressor) Next() (uint64, uint64, error) {
+	class, err := d.br.ReadOnes(len(deltaBits))
+	if err != nil {
+		return 0, 0, err
+	}
+	if class > 0 {
+		count := deltaBits[class-1]
+		raw, err := d.br.ReadBits(count)
+		if err != nil {
+			return 0, 0, err
+		}
+		// Sign extend the delta of delta.
+		dod := int64(raw<<(64-count)) >> (64 - count)
+		d.delta += uint64(dod)
+	}
+	d.time += d.delta
+
+	control, err := d.br.ReadOnes(2)
+	if err != nil {
+		return 0, 0, err
+	}
+	if control == 2 {
+		leading, err := d.br.ReadBits(6)
+		if err != nil {
+			return 0, 0, err
+		}
+		meaningful, err := d.br.ReadBits(6)
+		if err != nil {
+			return 0, 0, err
+		}
+		d.leading = uint(leading)
+		d.trailing = 64 - d.leading - uint(meaningful+1)
+		if d.leading+d.trailing >= 64 {
+			return 0, 0, fmt.Errorf("invalid value encoding")
+		}
+	}
+	if control > 0 {
+		xor, err := d.br.ReadBits(64 - d.leading - d.trailing)
+		if err != nil {
+			return 0, 0, err
+		}
+		d.value ^= xor << d.trailing
+	}
+	return d.time, d.value, nil
+}
+
+// Returns the content of a compressed file with the same entries as ds.
+func compressDataStore(ds *DataStore) []byte {
+	entries := ds.GetEntries()
+	header := make([]byte, compressedHeaderSize)
+	writeHeader(header, dataMagic)
+	*(*uint64)(unsafe.Pointer(&header[8])) = uint64(entries)
+	*(*uint8)(unsafe.Pointer(&header[16])) = uint8(ds.lpe)
+	*(*uint8)(unsafe.Pointer(&header[17])) = uint8(FormatCompressed)
+	*(*uint8)(unsafe.Pointer(&header[18])) = uint8(ds.valuetype)
+	*(*uint32)(unsafe.Pointer(&header[20])) = *(*uint32)(unsafe.Pointer(&ds.raw[20]))
+
+	c := compressor{leading: 64}
+	labels := []byte{}
+	var run uint64
+	var current, previous []LabelID
+	varint := make([]byte, binary.MaxVarintLen64)
+	flush := func() {
+		if run <= 0 {
+			return
+		}
+		labels = append(labels, varint[:binary.PutUvarint(varint, run)]...)
+		for i := 0; i < ds.lpe; i++ {
+			id := uint64(0)
+			if i < len(previous) {
+				id = uint64(previous[i])
+			}
+			labels = append(labels, varint[:binary.PutUvarint(varint, id)]...)
+		}
+	}
+
+	for i := 0; i < entries; i++ {
+		offset := ds.GetOffset(i)
+		time, value := ds.GetTime(offset), ds.GetValue(offset)
+		if i == entries-1 && time == SealMarker {
+			*(*uint8)(unsafe.Pointer(&header[19])) |= compressedSealed
+		}
+		if i == 0 {
+			*(*uint64)(unsafe.Pointer(&header[32])) = time
+			*(*uint64)(unsafe.Pointer(&header[40])) = value
+			c.time, c.value = time, value
+		} else {
+			c.Add(time, value)
+		}
+
+		current = ds.GetLabels(offset, current[:0])
+		if run > 0 && equalLabels(current, previous) {
+			run++
+			continue
+		}
+		flush()
+		previous = append(previous[:0], current...)
+		run = 1
+	}
+	flush()
+
+	*(*uint64)(unsafe.Pointer(&header[48])) = uint64(len(c.bw.buffer))
+	return append(append(header, c.bw.buffer...), labels...)
+}
+
+func equalLabels(a, b []LabelID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the content of a raw file with the same entries as the compressed data.
+func decompressDataStore(data []byte) ([]byte, error) {
+	if len(data) < compressedHeaderSize {
+		return nil, fmt.Errorf("compressed header is truncated")
+	}
+	entries := *(*uint64)(unsafe.Pointer(&data[8]))
+	lpe := int(*(*uint8)(unsafe.Pointer(&data[16])))
+	streamsize := *(*uint64)(unsafe.Pointer(&data[48]))
+	if streamsize > uint64(len(data)-compressedHeaderSize) {
+		return nil, fmt.Errorf("bit stream size %d is larger than the file", streamsize)
+	}
+	// Each entry needs at least 2 bits in the stream.
+	if entries > 0 && (entries-1)/4 > streamsize {
+		return nil, fmt.Errorf("number of entries %d is larger than the bit stream", entries)
+	}
+
+	entrysize := GetEntrySize(lpe)
+	result := make([]byte, GetHeaderSize()+int(entries)*entrysize)
+	copy(result, data[:GetHeaderSize()])
+	*(*uint64)(unsafe.Pointer(&result[8])) = entries * uint64(entrysize)
+	*(*uint8)(unsafe.Pointer(&result[17])) = uint8(FormatRaw)
+	*(*uint8)(unsafe.Pointer(&result[19])) = 0
+	ring := result[GetHeaderSize():]
+
+	d := decompressor{br: bitReader{data[compressedHeaderSize : compressedHeaderSize+streamsize], 0}}
+	d.time = *(*uint64)(unsafe.Pointer(&data[32]))
+	d.value = *(*uint64)(unsafe.Pointer(&data[40]))
+	time, value := d.time, d.value
+	for i := 0; i < int(entries); i++ {
+		if i > 0 {
+			var err error
+			time, value, err = d.Next()
+			if err != nil {
+				return nil, err
+			}
+		}
+		*(*uint64)(unsafe.Pointer(&ring[i*entrysize])) = time
+		*(*uint64)(unsafe.Pointer(&ring[i*entrysize+8])) = value
+	}
+
+	labels := data[compressedHeaderSize+streamsize:]
+	for i := 0; i < int(entries); {
+		run, n := binary.Uvarint(labels)
+		if n <= 0 || run <= 0 || run > entries-uint64(i) {
+			return nil, fmt.Errorf("invalid labels run at entry %d", i)
+		}
+		labels = labels[n:]
+
+		for l := 0; l < lpe; l++ {
+			id, n := binary.Uvarint(labels)
+			if n <= 0 || id > uint64(^uint32(0)) {
+				return nil, fmt.Errorf("invalid label at entry %d", i)
+			}
+			labels = labels[n:]
+			for j := i; j < i+int(run); j++ {
+				*(*uint32)(unsafe.Pointer(&ring[j*entrysize+16+l*4])) = uint32(id)
+			}
+		}
+		i += int(run)
+	}
+	return result, nil
+}
+
+// Converts a complete data file in FormatCompressed. The file is replaced
+// atomically, so readers either see the old or the new one.
+//
+// Files already compressed are left untouched. Files that could still be
+// appended to are rejected.
+func CompactDataStore(dbasefile string) error {
+	ds, err := OpenDataStoreForReading(dbasefile)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+	if !ds.mapped {
+		return nil
+	}
+	if more, _ := ds.PeekAppend(); more && !ds.IsSealed() {
+		return fmt.Errorf("%s is not sealed - cannot be compacted", dbasefile)
+	}
+	compressed := compressDataStore(ds)
+
+	st, err := os.Stat(dbasefile)
+	if err != nil {
+		return err
+	}
+	dir, name := filepath.Split(dbasefile)
+	file, err := ioutil.TempFile(dir, name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	_, err = file.Write(compressed)
+	if err == nil {
+		err = file.Chmod(st.Mode())
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), dbasefile)
+}
@@ -0,0 +1,121 @@
+package tsdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBitStream(t *testing.T) {
+	bw := bitWriter{}
+	for i := uint(1); i <= 64; i++ {
+		bw.WriteBits(uint64(i), i)
+		bw.WriteBits(math.MaxUint64, i)
+	}
+
+	br := bitReader{bw.buffer, 0}
+	for i := uint(1); i <= 64; i++ {
+		value, err := br.ReadBits(i)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(i)&(uint64(math.MaxUint64)>>(64-i)), value)
+		value, err = br.ReadBits(i)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(math.MaxUint64)>>(64-i), value)
+	}
+	_, err := br.ReadBits(8)
+	assert.NotNil(t, err)
+}
+
+func TestCompactDataStore(t *testing.T) {
+	options := DefaultDataStoreOptions()
+	options.MaxEntries = 1000
+	options.CompactOnSeal = false
+
+	tempdir, err := ioutil.TempDir("", "datastore-")
+	assert.Nil(t, err)
+	filename := filepath.Join(tempdir, "test")
+
+	db, err := OpenDataStoreForWriting(filename, options)
+	assert.Nil(t, err)
+
+	// Regular intervals, with some jitter, and a few large jumps back and forth.
+	times := []uint64{}
+	values := []uint64{}
+	labels := [][]LabelID{}
+	time := uint64(1600000000)
+	for i := 0; i < 900; i++ {
+		time += 10 + uint64(rand.Intn(3))
+		switch i {
+		case 100:
+			time += 5000
+		case 200:
+			time += 1 << 40
+		case 300:
+			time -= 1 << 40
+		}
+		value := uint64(i / 10)
+		switch i % 7 {
+		case 3:
+			value = math.Float64bits(float64(i) * 1.5)
+		case 5:
+			value = rand.Uint64()
+		}
+		entrylabels := []LabelID{LabelID(i/50 + 1), 9}
+		if i%3 == 0 {
+			entrylabels = nil
+		}
+
+		times = append(times, time)
+		values = append(values, value)
+		labels = append(labels, entrylabels)
+		ok, _ := db.Append(time, value, entrylabels)
+		assert.True(t, ok)
+	}
+
+	// Not sealed, cannot be compacted yet.
+	assert.NotNil(t, CompactDataStore(filename))
+	db.Seal()
+	rawsize := getFileSize(filename)
+	assert.Nil(t, CompactDataStore(filename))
+	assert.True(t, getFileSize(filename) < rawsize/2)
+	// Compacting twice is harmless.
+	assert.Nil(t, CompactDataStore(filename))
+
+	point, entries, err := PeekDataStore(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, 901, entries)
+	assert.Equal(t, times[0], point.Time)
+	assert.Equal(t, values[0], point.Value)
+
+	_, err = OpenDataStoreForWriting(filename, options)
+	assert.Equal(t, ErrSealed, err)
+
+	db, err = OpenDataStoreForReading(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, 901, db.GetEntries())
+	assert.True(t, db.IsSealed())
+	for i := range times {
+		time, value, entrylabels := db.GetOne(i)
+		assert.Equal(t, times[i], time)
+		assert.Equal(t, values[i], value)
+		if labels[i] == nil {
+			assert.Equal(t, 0, len(entrylabels))
+		} else {
+			assert.Equal(t, labels[i], entrylabels)
+		}
+	}
+	db.Close()
+
+	// Corrupted files are detected, not misread.
+	data, err := ioutil.ReadFile(filename)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filename, data[:len(data)/2], 0666)
+	assert.Nil(t, err)
+	_, err = OpenDataStoreForReading(filename)
+	assert.NotNil(t, err)
+	os.Remove(filename)
+}
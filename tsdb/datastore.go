@@ -1,15 +1,16 @@
 package tsdb
 
 import (
+	"errors"
 	"fmt"
 	"golang.org/x/sys/unix"
 	"io/ioutil"
+	"log"
 	"math"
 	"os"
 	"path/filepath"
 	"sync/atomic"
 	"unsafe"
-	//"log"
 )
 
 type DataStore struct {
@@ -33,8 +34,38 @@ type DataStore struct {
 	ring []byte
 	// Labels per entry, number of labels to store for each entry.
 	lpe int
+	// Type of the values stored.
+	valuetype ValueType
+
+	// True if raw is a mapping of the file, false if it was decoded
+	// in memory from a compressed file.
+	mapped bool
+	// If true, Seal will compress the file once closed.
+	compact bool
+
+	// When to msync the file, and after how many appends.
+	durability Durability
+	syncevery  int
+	// Number of entries appended since the last Sync.
+	unsynced int
 }
 
+// Format of the entries in a .data file, stored in the header.
+type DataFormat uint8
+
+const (
+	// Entries are stored in a ring of fixed size entries, can be appended to.
+	FormatRaw DataFormat = 0
+	// Entries are compressed, the file is read only.
+	FormatCompressed DataFormat = 1
+)
+
+// Time and value of the entry appended by Seal to mark a file as complete.
+const SealMarker = uint64(0xffffffffffffffff)
+
+// Returned when trying to write a sealed or compressed data file.
+var ErrSealed = errors.New("data store is sealed - cannot be written")
+
 type DataStoreOptions struct {
 	// Unix mode to open the file as. 0666 by default.
 	Mode os.FileMode
@@ -45,6 +76,19 @@ type DataStoreOptions struct {
 	// Maximum numbers of entries to store in the time database.
 	// Note that this is rounded to fill a multiple of the page size.
 	MaxEntries int
+	// If true, the file is converted in FormatCompressed once sealed. False
+	// by default. Compressed files take less space on disk, but are not
+	// mmapped: each is decompressed in memory when loaded, so a reader may
+	// hold up to MaxLoadedShards full copies of the shards in the heap.
+	CompactOnSeal bool
+	// Type of the values to store. TypeUint64 by default.
+	ValueType ValueType
+	// When to msync the file to disk. DurabilitySeal by default.
+	Durability Durability
+	// With DurabilityPeriodic, number of appends between syncs.
+	SyncEvery int
+	// If true, the file is locked in memory with mlock while open.
+	Mlock bool
 }
 
 func GetEntrySize(lpe int) int {
@@ -52,7 +96,7 @@ func GetEntrySize(lpe int) int {
 }
 
 func GetHeaderSize() int {
-	return 16
+	return 32
 }
 
 func (do DataStoreOptions) GetMaxEntries() int {
@@ -73,6 +117,15 @@ func (do DataStoreOptions) Valid() error {
 	if do.LabelsPerEntry < 0 || do.LabelsPerEntry > 256 {
 		return fmt.Errorf("LabelsPerEntry too large, must be <= 256")
 	}
+	if err := do.ValueType.Valid(); err != nil {
+		return err
+	}
+	if err := do.Durability.Valid(); err != nil {
+		return err
+	}
+	if do.Durability == DurabilityPeriodic && do.SyncEvery <= 0 {
+		return fmt.Errorf("SyncEvery must be > 0 with periodic durability")
+	}
 
 	filesize := do.GetFileSize()
 	if filesize > math.MaxInt32 || filesize < 0 {
@@ -82,14 +135,19 @@ func (do DataStoreOptions) Valid() error {
 }
 
 func DefaultDataStoreOptions() DataStoreOptions {
-	return DataStoreOptions{0666, 4, 604800}
+	return DataStoreOptions{0666, 4, 604800, false, TypeUint64, DurabilitySeal, 0, false}
 }
 
 // Format of a .data file:
-//   [ 0 -  7] - 8 bytes - uint64 - cursor - where the next value should be written.
-//   [   8   ] - 1 byte  - uint8 - lpe - number of labels per entry in this datafile.
-//   [ 9 - 15] - 7 bytes - unused
-//   [16 - ..] - x bytes - entries in the ring.
+//   [ 0 -  7] - 8 bytes - common header, with magic "TSDB", see header.go.
+//   [ 8 - 15] - 8 bytes - uint64 - cursor - where the next value should be written.
+//   [  16   ] - 1 byte  - uint8 - lpe - number of labels per entry in this datafile.
+//   [  17   ] - 1 byte  - uint8 - format - FormatRaw, as described here, or FormatCompressed.
+//   [  18   ] - 1 byte  - uint8 - type - ValueType of the values stored.
+//   [  19   ] - 1 byte  - uint8 - flags - unused in FormatRaw.
+//   [20 - 23] - 4 bytes - uint32 - MaxEntries requested when the file was created.
+//   [24 - 31] - 8 bytes - unused
+//   [32 - ..] - x bytes - entries in the ring.
 //
 // Format of a ring entry:
 //   [ 0 -  7] - 8 bytes - uint64 - timestamp.
@@ -98,17 +156,34 @@ func DefaultDataStoreOptions() DataStoreOptions {
 //               Unused labels are set to 0
 //
 // Note that the entire file size is rounded to PAGE_SIZE.
+//
+// The last entry of a sealed file has both time and value set to SealMarker,
+// unless the ring was full. See compress.go for the format of compressed files.
 
 func CreateDataStore(filename string, data []byte) *DataStore {
-	cursor := (*uint64)(unsafe.Pointer(&data[0]))
-	lpe := int(*(*uint8)(unsafe.Pointer(&data[8])))
+	cursor := (*uint64)(unsafe.Pointer(&data[8]))
+	lpe := int(*(*uint8)(unsafe.Pointer(&data[16])))
+	valuetype := getValueType(data)
 	ring := data[GetHeaderSize():]
 	entries := len(ring) / GetEntrySize(lpe)
 
-	return &DataStore{filename, data, cursor, entries, ring, lpe}
+	return &DataStore{filename, data, cursor, entries, ring, lpe, valuetype, true, false, DurabilityNone, 0, 0}
+}
+
+func getValueType(data []byte) ValueType {
+	return ValueType(*(*uint8)(unsafe.Pointer(&data[18])))
+}
+
+func getDataFormat(data []byte) DataFormat {
+	return DataFormat(*(*uint8)(unsafe.Pointer(&data[17])))
 }
 
 func OpenDataStoreForReading(dbasefile string) (*DataStore, error) {
+	return openDataStoreForReading(dbasefile, false)
+}
+
+// Like OpenDataStoreForReading, but locks the mapping in memory if mlock is true.
+func openDataStoreForReading(dbasefile string, mlock bool) (*DataStore, error) {
 	data := []byte{}
 	file, err := os.OpenFile(dbasefile, os.O_RDONLY, 0666)
 	defer file.Close()
@@ -117,12 +192,64 @@ func OpenDataStoreForReading(dbasefile string) (*DataStore, error) {
 		return nil, err
 	}
 
-	data, err = mmapFile(file, unix.PROT_READ)
+	data, err = mmapFile(file, unix.PROT_READ, mlock)
 	if len(data) <= 0 {
 		return nil, err
 	}
+	// Files without header, or with a different byte order, are converted
+	// in memory.
+	mapped := true
+	if !hasMagic(data, dataMagic) {
+		converted, err := upgradeDataStore(dbasefile, data)
+		unix.Munmap(data)
+		if err != nil {
+			return nil, err
+		}
+		data, mapped = converted, false
+	}
+	swap, err := checkHeader(dbasefile, data, dataMagic)
+	if err != nil {
+		if mapped {
+			unix.Munmap(data)
+		}
+		return nil, err
+	}
+	if swap {
+		converted := swapDataStore(data)
+		if mapped {
+			unix.Munmap(data)
+		}
+		data, mapped = converted, false
+	}
+	unmap := func() {
+		if mapped {
+			unix.Munmap(data)
+		}
+	}
 
-	return CreateDataStore(dbasefile, data), nil
+	if err := getValueType(data).Valid(); err != nil {
+		unmap()
+		return nil, fmt.Errorf("%s: %s", dbasefile, err)
+	}
+
+	switch format := getDataFormat(data); format {
+	case FormatRaw:
+		ds := CreateDataStore(dbasefile, data)
+		ds.mapped = mapped
+		return ds, nil
+	case FormatCompressed:
+		decoded, err := decompressDataStore(data)
+		unmap()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", dbasefile, err)
+		}
+		ds := CreateDataStore(dbasefile, decoded)
+		ds.mapped = false
+		return ds, nil
+	default:
+		unmap()
+		return nil, fmt.Errorf("%s has unknown format %d", dbasefile, format)
+	}
 }
 
 func OpenDataStoreForWriting(dbasefile string, options DataStoreOptions) (*DataStore, error) {
@@ -138,10 +265,22 @@ func OpenDataStoreForWriting(dbasefile string, options DataStoreOptions) (*DataS
 		defer file.Close()
 
 		if err == nil {
-			data, err = mmapFile(file, unix.PROT_WRITE)
+			data, err = mmapFile(file, unix.PROT_WRITE, options.Mlock)
 			if len(data) <= 0 {
 				return nil, err
 			}
+			swap, err := checkHeader(dbasefile, data, dataMagic)
+			if err != nil || swap {
+				unix.Munmap(data)
+				if swap {
+					return nil, ErrByteOrder
+				}
+				return nil, err
+			}
+			if getDataFormat(data) != FormatRaw || CreateDataStore(dbasefile, data).IsSealed() {
+				unix.Munmap(data)
+				return nil, ErrSealed
+			}
 			break
 		}
 
@@ -161,13 +300,16 @@ func OpenDataStoreForWriting(dbasefile string, options DataStoreOptions) (*DataS
 			return nil, err
 		}
 
-		data, err = mmapFile(file, unix.PROT_WRITE)
+		data, err = mmapFile(file, unix.PROT_WRITE, options.Mlock)
 		if len(data) <= 0 {
 			os.Remove(file.Name())
 			return nil, err
 		}
-		*(*uint64)(unsafe.Pointer(&data[0])) = uint64(0)
-		*(*uint8)(unsafe.Pointer(&data[8])) = uint8(options.LabelsPerEntry)
+		writeHeader(data, dataMagic)
+		*(*uint64)(unsafe.Pointer(&data[8])) = uint64(0)
+		*(*uint8)(unsafe.Pointer(&data[16])) = uint8(options.LabelsPerEntry)
+		*(*uint8)(unsafe.Pointer(&data[18])) = uint8(options.ValueType)
+		*(*uint32)(unsafe.Pointer(&data[20])) = uint32(options.MaxEntries)
 
 		// err = unix.RenameAt2(unix.AT_FDCWD, file.Name(), unix.AT_FDCWD, fullpath, unix.RENAME_NOREPLACE)
 		err = unix.Rename(file.Name(), dbasefile)
@@ -182,50 +324,130 @@ func OpenDataStoreForWriting(dbasefile string, options DataStoreOptions) (*DataS
 			return nil, err
 		}
 	}
-	return CreateDataStore(dbasefile, data), nil
+	ds := CreateDataStore(dbasefile, data)
+	ds.compact = options.CompactOnSeal
+	ds.durability = options.Durability
+	ds.syncevery = options.SyncEvery
+	return ds, nil
 }
 
+// Returns the first point and the number of entries of a data file,
+// reading only its header.
 func PeekDataStore(dbasefile string) (Point, int, error) {
+	point, entries, _, err := peekDataStore(dbasefile)
+	return point, entries, err
+}
+
+// Like PeekDataStore, but also returns true if the file is sealed.
+func peekDataStore(dbasefile string) (Point, int, bool, error) {
 	file, err := os.OpenFile(dbasefile, os.O_RDONLY, 0666)
 	defer file.Close()
 
 	if err != nil {
-		return Point{}, 0, err
+		return Point{}, 0, false, err
 	}
 	st, err := file.Stat()
 	if err != nil {
-		return Point{}, 0, err
+		return Point{}, 0, false, err
 	}
 	size := st.Size()
 	if int64(int(size)) != size {
-		return Point{}, 0, fmt.Errorf("size of %d overflows int", size)
+		return Point{}, 0, false, fmt.Errorf("size of %d overflows int", size)
 	}
 
 	buffer := make([]byte, GetEntrySize(0)+GetHeaderSize())
 	n, err := file.Read(buffer)
 	if err != nil {
-		return Point{}, 0, err
+		return Point{}, 0, false, err
 	}
 	if n != len(buffer) {
-		return Point{}, 0, fmt.Errorf("file did not have enough bytes to read - %d", n)
+		return Point{}, 0, false, fmt.Errorf("file did not have enough bytes to read - %d", n)
+	}
+	// Offsets in a file without header are shift bytes lower.
+	shift := 0
+	if !hasMagic(buffer, dataMagic) {
+		buffer, err = upgradeDataStore(dbasefile, buffer[:unversionedHeaderSize+GetEntrySize(0)])
+		if err != nil {
+			return Point{}, 0, false, err
+		}
+		shift = GetHeaderSize() - unversionedHeaderSize
+		size += int64(shift)
+	}
+	swap, err := checkHeader(dbasefile, buffer, dataMagic)
+	if err != nil {
+		return Point{}, 0, false, err
+	}
+	if swap {
+		swapBytes(buffer[8:16])
+		swapBytes(buffer[GetHeaderSize() : GetHeaderSize()+8])
+		swapBytes(buffer[GetHeaderSize()+8 : GetHeaderSize()+16])
 	}
 
-	cursor := (*uint64)(unsafe.Pointer(&buffer[0]))
-	lpe := int(*(*uint8)(unsafe.Pointer(&buffer[8])))
+	cursor := (*uint64)(unsafe.Pointer(&buffer[8]))
+	lpe := int(*(*uint8)(unsafe.Pointer(&buffer[16])))
 
 	time := *(*uint64)(unsafe.Pointer(&buffer[GetHeaderSize()]))
 	value := *(*uint64)(unsafe.Pointer(&buffer[GetHeaderSize()+8]))
 
 	last := atomic.LoadUint64(cursor)
-	return Point{time, value, nil}, GetEntries(last, int(size)-GetHeaderSize(), lpe), nil
+	point := Point{time, value, nil, getValueType(buffer)}
+	if getDataFormat(buffer) == FormatCompressed {
+		// The cursor of a compressed file is the number of entries.
+		sealed := *(*uint8)(unsafe.Pointer(&buffer[19]))&compressedSealed != 0
+		return point, int(last), sealed, nil
+	}
+
+	entries := GetEntries(last, int(size)-GetHeaderSize(), lpe)
+	if entries <= 0 {
+		return point, entries, false, nil
+	}
+	lasttime := buffer[:8]
+	_, err = file.ReadAt(lasttime, int64(GetHeaderSize()+(entries-1)*GetEntrySize(lpe)-shift))
+	if err != nil {
+		return Point{}, 0, false, err
+	}
+	// SealMarker is the same in any byte order.
+	return point, entries, *(*uint64)(unsafe.Pointer(&lasttime[0])) == SealMarker, nil
 }
 
+// Waits for the file to be written to disk.
 func (ds *DataStore) Sync() {
+	if !ds.mapped {
+		return
+	}
 	unix.Msync(ds.raw, unix.MS_SYNC|unix.MS_INVALIDATE)
+	ds.unsynced = 0
+}
+
+// Syncs the file after appending entries, as required by the durability.
+func (ds *DataStore) appended(entries int) {
+	switch ds.durability {
+	case DurabilityAsync:
+		unix.Msync(ds.raw, unix.MS_ASYNC)
+	case DurabilityPeriodic:
+		ds.unsynced += entries
+		if ds.unsynced >= ds.syncevery {
+			ds.Sync()
+		}
+	}
+}
+
+// Syncs the file before sealing or closing it, as required by the durability.
+func (ds *DataStore) syncOnClose() {
+	switch ds.durability {
+	case DurabilityAsync:
+		unix.Msync(ds.raw, unix.MS_ASYNC)
+	case DurabilityPeriodic, DurabilitySeal:
+		ds.Sync()
+	}
 }
 
 func (ds *DataStore) Close() {
-	ds.Sync()
+	if !ds.mapped {
+		ds.raw = nil
+		return
+	}
+	ds.syncOnClose()
 	unix.Munmap(ds.raw)
 }
 
@@ -289,8 +511,18 @@ func (ds *DataStore) GetOne(element int) (time, value uint64, labels []LabelID)
 	return time, value, labels
 }
 
+// Returns true if the last entry is the marker appended by Seal.
+func (ds *DataStore) IsSealed() bool {
+	if ds.GetEntries() <= 0 {
+		return false
+	}
+	return ds.GetTime(ds.GetOffset(-1)) == SealMarker
+}
+
+// Marks the file as complete, and closes it. If the store was opened
+// with CompactOnSeal, the file is then converted to FormatCompressed.
 func (ds *DataStore) Seal() {
-	appended, last := ds.Append(0xffffffffffffffff, 0xffffffffffffffff, nil)
+	appended, last := ds.Append(SealMarker, SealMarker, nil)
 	if appended {
 		newsize := MultipleOfPageSize(GetHeaderSize() + int(last))
 		// Mode when opening an existing file is ignored.
@@ -300,24 +532,41 @@ func (ds *DataStore) Seal() {
 			file.Truncate(int64(newsize))
 		}
 	}
-	ds.Sync()
 	ds.Close()
+
+	if ds.compact {
+		err := CompactDataStore(ds.name)
+		if err != nil {
+			log.Printf("Could not compact %s, leaving it uncompressed: %s", ds.name, err)
+		}
+	}
 }
 
+// Every slot of the ring can be used, so GetMaxEntries entries fit. With
+// the 32 bytes header, rings are often an exact multiple of the entry size,
+// and keeping the last slot empty would lose an entry. A full ring has no
+// room for the marker appended by Seal, see IsSealed.
 func (ds *DataStore) PeekAppend() (bool, uint64) {
 	last := atomic.LoadUint64(ds.cursor)
-	if last+uint64(GetEntrySize(ds.lpe)) >= uint64(len(ds.ring)) {
+	if last+uint64(GetEntrySize(ds.lpe)) > uint64(len(ds.ring)) {
 		return false, last
 	}
 	return true, last
 }
 
-func (ds *DataStore) Append(time, value uint64, labels []LabelID) (bool, uint64) {
+// Returns the number of entries that can still be appended.
+func (ds *DataStore) Free() int {
 	last := atomic.LoadUint64(ds.cursor)
-	if last+uint64(GetEntrySize(ds.lpe)) >= uint64(len(ds.ring)) {
-		return false, last
+	entry := uint64(GetEntrySize(ds.lpe))
+	if last+entry > uint64(len(ds.ring)) {
+		return 0
 	}
+	return int((uint64(len(ds.ring)) - last) / entry)
+}
 
+// Writes an entry at the offset last of the ring, without publishing it
+// to readers. Returns the offset of the next entry.
+func (ds *DataStore) writeEntry(last uint64, time, value uint64, labels []LabelID) uint64 {
 	*(*uint64)(unsafe.Pointer(&ds.ring[last])) = time
 	last += 8
 	*(*uint64)(unsafe.Pointer(&ds.ring[last])) = value
@@ -327,6 +576,43 @@ func (ds *DataStore) Append(time, value uint64, labels []LabelID) (bool, uint64)
 		*(*uint32)(unsafe.Pointer(&ds.ring[int(last)+i*4])) = uint32(labels[i])
 	}
 	last += uint64(ds.lpe * 4)
+	return last
+}
+
+func (ds *DataStore) Append(time, value uint64, labels []LabelID) (bool, uint64) {
+	last := atomic.LoadUint64(ds.cursor)
+	if last+uint64(GetEntrySize(ds.lpe)) > uint64(len(ds.ring)) {
+		return false, last
+	}
+
+	last = ds.writeEntry(last, time, value, labels)
 	atomic.StoreUint64(ds.cursor, last)
+	ds.appended(1)
 	return true, last
 }
+
+// An entry to append with AppendBatch.
+type Entry struct {
+	Time   uint64
+	Value  uint64
+	Labels []LabelID
+}
+
+// Appends as many of the entries as fit in the ring, and publishes them
+// to readers at once, by updating the cursor only after all are written.
+// Returns the number of entries appended, and the new cursor.
+func (ds *DataStore) AppendBatch(entries []Entry) (int, uint64) {
+	if free := ds.Free(); len(entries) > free {
+		entries = entries[:free]
+	}
+
+	last := atomic.LoadUint64(ds.cursor)
+	for _, entry := range entries {
+		last = ds.writeEntry(last, entry.Time, entry.Value, entry.Labels)
+	}
+	atomic.StoreUint64(ds.cursor, last)
+	if len(entries) > 0 {
+		ds.appended(len(entries))
+	}
+	return len(entries), last
+}
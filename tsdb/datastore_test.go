@@ -3,6 +3,7 @@ package tsdb
 import (
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -66,3 +67,135 @@ func TestStore(t *testing.T) {
 	}
 
 }
+
+func TestStoreAppendBatch(t *testing.T) {
+	options := DefaultDataStoreOptions()
+	options.MaxEntries = 32
+
+	tempdir, err := ioutil.TempDir("", "datastore-")
+	assert.Nil(t, err)
+
+	db, err := OpenDataStoreForWriting(filepath.Join(tempdir, "test"), options)
+	assert.Nil(t, err)
+	assert.Equal(t, 127, db.Free())
+
+	entries := []Entry{}
+	for i := uint64(0); i < 200; i++ {
+		entries = append(entries, Entry{i, i + 1024, []LabelID{LabelID(i + 1)}})
+	}
+	appended, last := db.AppendBatch(entries[:100])
+	assert.Equal(t, 100, appended)
+	assert.Equal(t, uint64(100*32), last)
+	assert.Equal(t, 27, db.Free())
+
+	// Only the entries that fit are appended.
+	appended, _ = db.AppendBatch(entries[100:])
+	assert.Equal(t, 27, appended)
+	assert.Equal(t, 0, db.Free())
+	assert.Equal(t, 127, db.GetEntries())
+	ok, _ := db.Append(0, 0, nil)
+	assert.False(t, ok)
+
+	for i := 0; i < 127; i++ {
+		time, value, labels := db.GetOne(i)
+		assert.Equal(t, uint64(i), time)
+		assert.Equal(t, uint64(i+1024), value)
+		assert.Equal(t, []LabelID{LabelID(i + 1)}, labels)
+	}
+	db.Close()
+}
+
+func TestStoreDurability(t *testing.T) {
+	options := DefaultDataStoreOptions()
+	options.MaxEntries = 32
+	options.Durability = DurabilityPeriodic
+	assert.NotNil(t, options.Valid())
+	options.SyncEvery = 10
+	assert.Nil(t, options.Valid())
+	options.Durability = Durability(42)
+	assert.NotNil(t, options.Valid())
+
+	durability, err := ParseDurability("periodic")
+	assert.Nil(t, err)
+	assert.Equal(t, DurabilityPeriodic, durability)
+	assert.Equal(t, "periodic", durability.String())
+	_, err = ParseDurability("sometimes")
+	assert.NotNil(t, err)
+
+	tempdir, err := ioutil.TempDir("", "datastore-")
+	assert.Nil(t, err)
+	options.Durability = durability
+	db, err := OpenDataStoreForWriting(filepath.Join(tempdir, "test"), options)
+	assert.Nil(t, err)
+
+	for i := uint64(1); i <= 9; i++ {
+		db.Append(i, i, nil)
+	}
+	assert.Equal(t, 9, db.unsynced)
+	db.Append(10, 10, nil)
+	assert.Equal(t, 0, db.unsynced)
+	db.AppendBatch([]Entry{{11, 11, nil}, {12, 12, nil}})
+	assert.Equal(t, 2, db.unsynced)
+	db.Close()
+
+	labeloptions := DefaultLabelOptions()
+	labeloptions.LabelBlock = 128
+	ls, err := OpenLabelsForWriting(filepath.Join(tempdir, "labels"), labeloptions)
+	assert.Nil(t, err)
+	_, err = ls.CreateLabel("host=web1")
+	assert.Nil(t, err)
+	assert.True(t, ls.dirty)
+	ls.SyncCreated()
+	assert.False(t, ls.dirty)
+	_, err = ls.CreateLabel("host=web1")
+	assert.Nil(t, err)
+	assert.False(t, ls.dirty)
+	ls.Close()
+}
+
+func TestStoreFullRing(t *testing.T) {
+	options := DefaultDataStoreOptions()
+	options.MaxEntries = 32
+	options.CompactOnSeal = false
+
+	tempdir, err := ioutil.TempDir("", "datastore-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+	path := filepath.Join(tempdir, "test")
+
+	// The ring is an exact multiple of the entry size, all slots are used.
+	assert.Equal(t, 0, options.GetRingSize()%GetEntrySize(options.LabelsPerEntry))
+	db, err := OpenDataStoreForWriting(path, options)
+	assert.Nil(t, err)
+	for i := 0; i < options.GetMaxEntries(); i++ {
+		ok, _ := db.PeekAppend()
+		assert.True(t, ok)
+		ok, _ = db.Append(uint64(i+1), uint64(i), nil)
+		assert.True(t, ok)
+	}
+	ok, last := db.PeekAppend()
+	assert.False(t, ok)
+	assert.Equal(t, uint64(options.GetRingSize()), last)
+	assert.Equal(t, 0, db.Free())
+
+	// A full ring has no room for the seal marker, but is read entirely.
+	db.Seal()
+	point, entries, sealed, err := peekDataStore(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), point.Time)
+	assert.Equal(t, options.GetMaxEntries(), entries)
+	assert.False(t, sealed)
+
+	db, err = OpenDataStoreForReading(path)
+	assert.Nil(t, err)
+	assert.Equal(t, options.GetMaxEntries(), db.GetEntries())
+	time, _, _ := db.GetOne(-1)
+	assert.Equal(t, uint64(options.GetMaxEntries()), time)
+	db.Close()
+
+	// Writers find it full, and move to the next shard.
+	db, err = OpenDataStoreForWriting(path, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, db.Free())
+	db.Close()
+}
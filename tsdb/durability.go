@@ -0,0 +1,58 @@
+package tsdb
+
+import (
+	"fmt"
+)
+
+// How hard a DataStore or LabelStore tries to get the data written to disk
+// before returning. Files are memory mapped: without a sync, the kernel
+// writes them back whenever it sees fit, and a crash of the machine (not
+// of the process) can lose data or leave files partially written.
+//
+// Sync can always be called explicitly, regardless of the policy.
+type Durability uint8
+
+const (
+	// Never msync the files, leave writeback to the kernel.
+	DurabilityNone Durability = 0
+	// Schedule a writeback with MS_ASYNC after each append, without
+	// waiting for it to complete.
+	DurabilityAsync Durability = 1
+	// Wait for the data to be on disk with MS_SYNC every SyncEvery appends,
+	// and when the file is sealed or closed.
+	DurabilityPeriodic Durability = 2
+	// Wait for the data to be on disk only when the file is sealed or
+	// closed. The default.
+	DurabilitySeal Durability = 3
+)
+
+var durabilityNames = map[Durability]string{
+	DurabilityNone:     "none",
+	DurabilityAsync:    "async",
+	DurabilityPeriodic: "periodic",
+	DurabilitySeal:     "seal",
+}
+
+func (d Durability) String() string {
+	name, ok := durabilityNames[d]
+	if !ok {
+		return fmt.Sprintf("unknown(%d)", uint8(d))
+	}
+	return name
+}
+
+func (d Durability) Valid() error {
+	if _, ok := durabilityNames[d]; !ok {
+		return fmt.Errorf("invalid durability %d", uint8(d))
+	}
+	return nil
+}
+
+func ParseDurability(name string) (Durability, error) {
+	for d, dname := range durabilityNames {
+		if dname == name {
+			return d, nil
+		}
+	}
+	return DurabilitySeal, fmt.Errorf("unknown durability '%s' - must be none, async, periodic or seal", name)
+}
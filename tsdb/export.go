@@ -0,0 +1,607 @@
+package tsdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// Format of the stream of points written by ExportSerie and read by
+// ImportSerie. All formats start with an ExportHeader:
+//
+//   - ExportCSV - a "#tsdb " line with the header as json, followed by
+//     one record per point, with time, type, value, and the labels.
+//   - ExportJSONL - a {"header": ...} line, followed by one point per
+//     line, in the json format of Point.
+//   - ExportBinary - the magic "TSEX", a version byte, the length of the
+//     header as uvarint, and the header as json. Followed by one record
+//     per point, see binaryEncoder.
+//
+// The header is optional for ExportCSV and ExportJSONL, so points
+// written by hand, or by other tools, can be imported as well.
+type ExportFormat uint8
+
+const (
+	ExportCSV    ExportFormat = 0
+	ExportJSONL  ExportFormat = 1
+	ExportBinary ExportFormat = 2
+)
+
+var exportFormatNames = map[ExportFormat]string{
+	ExportCSV:    "csv",
+	ExportJSONL:  "jsonl",
+	ExportBinary: "binary",
+}
+
+func (f ExportFormat) String() string {
+	name, ok := exportFormatNames[f]
+	if !ok {
+		return fmt.Sprintf("unknown(%d)", uint8(f))
+	}
+	return name
+}
+
+func ParseExportFormat(name string) (ExportFormat, error) {
+	for f, fname := range exportFormatNames {
+		if fname == name {
+			return f, nil
+		}
+	}
+	return ExportBinary, fmt.Errorf("unknown export format '%s' - must be csv, jsonl or binary", name)
+}
+
+const (
+	csvHeaderPrefix = "#tsdb "
+	binaryMagic     = "TSEX"
+	binaryVersion   = 1
+	// Labels larger than this in a binary export are considered corrupted.
+	maxImportLabelSize = 1 << 24
+)
+
+// Describes the serie the exported points come from, so it can be
+// recreated with the same options.
+type ExportHeader struct {
+	Data   DataStoreOptions `json:"data"`
+	Labels LabelOptions     `json:"labels"`
+	Meta   SerieMeta        `json:"meta"`
+}
+
+// Returns an ExportHeader with the default options.
+func DefaultExportHeader() ExportHeader {
+	return ExportHeader{DefaultDataStoreOptions(), DefaultLabelOptions(), SerieMeta{}}
+}
+
+// Returns the options the last shard of a serie was created with.
+//
+// Options that only affect how files are written, like Durability, or
+// Mlock, are not stored in the files, and have their default value.
+// CompactOnSeal is true if any sealed shard was compressed, or if no shard
+// is sealed yet.
+func ReadSerieOptions(dbbasepath string) (DataStoreOptions, LabelOptions, error) {
+	do, lo := DefaultDataStoreOptions(), DefaultLabelOptions()
+	files := GetDataFiles(dbbasepath)
+	if len(files) <= 0 {
+		return do, lo, fmt.Errorf("serie %s has no data files", dbbasepath)
+	}
+	last := files[len(files)-1]
+	id := ParseFileName(dbbasepath, last)
+
+	header, mode, err := readHeader(last, dataMagic)
+	if err != nil {
+		return do, lo, err
+	}
+	do.Mode = mode
+	do.LabelsPerEntry = int(*(*uint8)(unsafe.Pointer(&header[16])))
+	do.ValueType = getValueType(header)
+	do.MaxEntries = int(*(*uint32)(unsafe.Pointer(&header[20])))
+	// All shards but the last one are sealed.
+	if len(files) > 1 {
+		do.CompactOnSeal = false
+	}
+	for _, file := range files[:len(files)-1] {
+		if header, _, err := readHeader(file, dataMagic); err == nil && getDataFormat(header) == FormatCompressed {
+			do.CompactOnSeal = true
+			break
+		}
+	}
+
+	header, mode, err = readHeader(MakeLabelStoreFileName(dbbasepath, id), labelsMagic)
+	if err != nil {
+		return do, lo, err
+	}
+	lo.Mode = mode
+	lo.LabelBlock = int(*(*uint32)(unsafe.Pointer(&header[8])))
+	return do, lo, nil
+}
+
+// Reads the header of a file, converted to the byte order of the host,
+// and the permissions of the file.
+func readHeader(filename, magic string) ([]byte, os.FileMode, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	header := make([]byte, GetHeaderSize())
+	_, err = io.ReadFull(file, header)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: could not read header: %s", filename, err)
+	}
+	// Headers of files written without, as UpgradeSerie would write them.
+	if !hasMagic(header, magic) && magic == dataMagic {
+		header, err = upgradeDataStore(filename, header[:unversionedHeaderSize])
+		if err != nil {
+			return nil, 0, err
+		}
+		lpe := int(*(*uint8)(unsafe.Pointer(&header[16])))
+		*(*uint32)(unsafe.Pointer(&header[20])) = uint32((st.Size() - unversionedHeaderSize) / int64(GetEntrySize(lpe)))
+	} else if !hasMagic(header, magic) && magic == labelsMagic {
+		header, _ = upgradeLabelStore(filename, nil)
+	}
+	swap, err := checkHeader(filename, header, magic)
+	if err != nil {
+		return nil, 0, err
+	}
+	if swap {
+		if magic == dataMagic {
+			swapBytes(header[8:16])
+			swapBytes(header[20:24])
+		} else {
+			swapBytes(header[8:12])
+		}
+	}
+	return header, st.Mode().Perm(), nil
+}
+
+// Writes points in one of the ExportFormat.
+type PointEncoder interface {
+	Encode(point Point) error
+	// Flushes the points encoded, must be called once done.
+	Flush() error
+}
+
+// Reads points written by a PointEncoder.
+type PointDecoder interface {
+	// Returns io.EOF once all the points have been read.
+	Decode() (Point, error)
+}
+
+// Returns a PointEncoder writing the header, and then the points, to w.
+func NewPointEncoder(w io.Writer, format ExportFormat, header ExportHeader) (PointEncoder, error) {
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case ExportCSV:
+		_, err := fmt.Fprintf(w, "%s%s\n", csvHeaderPrefix, encoded)
+		return &csvEncoder{csv.NewWriter(w)}, err
+	case ExportJSONL:
+		encoder := json.NewEncoder(w)
+		err := encoder.Encode(map[string]ExportHeader{"header": header})
+		return &jsonlEncoder{encoder}, err
+	case ExportBinary:
+		bw := bufio.NewWriter(w)
+		bw.WriteString(binaryMagic)
+		bw.WriteByte(binaryVersion)
+		be := &binaryEncoder{bw, 0, 0, make(map[string]uint64), make([]byte, binary.MaxVarintLen64)}
+		be.putUvarint(uint64(len(encoded)))
+		_, err := bw.Write(encoded)
+		return be, err
+	}
+	return nil, fmt.Errorf("unknown export format %s", format)
+}
+
+// Returns a PointDecoder reading points from r, and the header of the
+// stream. If the stream has no header, DefaultExportHeader is returned.
+func NewPointDecoder(r io.Reader, format ExportFormat) (PointDecoder, ExportHeader, error) {
+	header := DefaultExportHeader()
+	br := bufio.NewReader(r)
+
+	switch format {
+	case ExportCSV:
+		prefix, _ := br.Peek(len(csvHeaderPrefix))
+		if string(prefix) == csvHeaderPrefix {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return nil, header, err
+			}
+			err = json.Unmarshal([]byte(strings.TrimPrefix(line, csvHeaderPrefix)), &header)
+			if err != nil {
+				return nil, header, fmt.Errorf("invalid csv header: %s", err)
+			}
+		}
+		reader := csv.NewReader(br)
+		reader.FieldsPerRecord = -1
+		return &csvDecoder{reader}, header, nil
+
+	case ExportJSONL:
+		decoder := json.NewDecoder(br)
+		var first json.RawMessage
+		err := decoder.Decode(&first)
+		if err == io.EOF {
+			return &jsonlDecoder{decoder, nil}, header, nil
+		}
+		if err != nil {
+			return nil, header, err
+		}
+		// Points have no header field.
+		line := struct {
+			Header *json.RawMessage `json:"header"`
+		}{}
+		if json.Unmarshal(first, &line) == nil && line.Header != nil {
+			err = json.Unmarshal(*line.Header, &header)
+			return &jsonlDecoder{decoder, nil}, header, err
+		}
+		return &jsonlDecoder{decoder, first}, header, nil
+
+	case ExportBinary:
+		magic := make([]byte, len(binaryMagic)+1)
+		_, err := io.ReadFull(br, magic)
+		if err != nil || string(magic[:len(binaryMagic)]) != binaryMagic {
+			return nil, header, fmt.Errorf("not a binary export - does not start with %s", binaryMagic)
+		}
+		if magic[len(binaryMagic)] != binaryVersion {
+			return nil, header, fmt.Errorf("binary export has version %d, only version %d is supported", magic[len(binaryMagic)], binaryVersion)
+		}
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, header, err
+		}
+		encoded := make([]byte, size)
+		_, err = io.ReadFull(br, encoded)
+		if err == nil {
+			err = json.Unmarshal(encoded, &header)
+		}
+		return &binaryDecoder{br, 0, 0, nil}, header, err
+	}
+	return nil, header, fmt.Errorf("unknown export format %s", format)
+}
+
+type csvEncoder struct {
+	writer *csv.Writer
+}
+
+func (ce *csvEncoder) Encode(point Point) error {
+	record := append([]string{strconv.FormatUint(point.Time, 10), point.Type.String(), FormatValue(point.Value, point.Type)}, point.Label...)
+	return ce.writer.Write(record)
+}
+
+func (ce *csvEncoder) Flush() error {
+	ce.writer.Flush()
+	return ce.writer.Error()
+}
+
+type csvDecoder struct {
+	reader *csv.Reader
+}
+
+func (cd *csvDecoder) Decode() (Point, error) {
+	record, err := cd.reader.Read()
+	if err != nil {
+		return Point{}, err
+	}
+	if len(record) < 3 {
+		return Point{}, fmt.Errorf("invalid csv record %v - must have time, type and value", record)
+	}
+	time, err := strconv.ParseUint(record[0], 10, 64)
+	if err != nil {
+		return Point{}, fmt.Errorf("invalid time %s: %s", record[0], err)
+	}
+	vt, err := ParseValueType(record[1])
+	if err != nil {
+		return Point{}, err
+	}
+	value, err := ParseValue(record[2], vt)
+	if err != nil {
+		return Point{}, fmt.Errorf("invalid value %s: %s", record[2], err)
+	}
+	return Point{time, value, record[3:], vt}, nil
+}
+
+type jsonlEncoder struct {
+	encoder *json.Encoder
+}
+
+func (je *jsonlEncoder) Encode(point Point) error {
+	return je.encoder.Encode(point)
+}
+
+func (je *jsonlEncoder) Flush() error {
+	return nil
+}
+
+type jsonlDecoder struct {
+	decoder *json.Decoder
+	// First line of the stream, if it was not a header.
+	first json.RawMessage
+}
+
+func (jd *jsonlDecoder) Decode() (Point, error) {
+	point := Point{}
+	if jd.first != nil {
+		err := json.Unmarshal(jd.first, &point)
+		jd.first = nil
+		return point, err
+	}
+	err := jd.decoder.Decode(&point)
+	return point, err
+}
+
+// Each point is encoded as:
+//   - 1 byte - ValueType of the value.
+//   - varint - difference between the time and the time of the previous point.
+//   - uvarint - value, xor the value of the previous point.
+//   - uvarint - number of labels, followed by each label as a uvarint
+//     index in the table of labels seen so far. If the index is the size
+//     of the table, it is followed by the uvarint length and the bytes of
+//     a new label, added to the table.
+type binaryEncoder struct {
+	writer *bufio.Writer
+	time   uint64
+	value  uint64
+	labels map[string]uint64
+	buffer []byte
+}
+
+func (be *binaryEncoder) putUvarint(value uint64) {
+	be.writer.Write(be.buffer[:binary.PutUvarint(be.buffer, value)])
+}
+
+func (be *binaryEncoder) Encode(point Point) error {
+	be.writer.WriteByte(byte(point.Type))
+	be.writer.Write(be.buffer[:binary.PutVarint(be.buffer, int64(point.Time-be.time))])
+	be.putUvarint(point.Value ^ be.value)
+	be.time, be.value = point.Time, point.Value
+
+	be.putUvarint(uint64(len(point.Label)))
+	for _, label := range point.Label {
+		index, ok := be.labels[label]
+		if ok {
+			be.putUvarint(index)
+			continue
+		}
+		index = uint64(len(be.labels))
+		be.labels[label] = index
+		be.putUvarint(index)
+		be.putUvarint(uint64(len(label)))
+		be.writer.WriteString(label)
+	}
+	return nil
+}
+
+func (be *binaryEncoder) Flush() error {
+	return be.writer.Flush()
+}
+
+type binaryDecoder struct {
+	reader *bufio.Reader
+	time   uint64
+	value  uint64
+	labels []string
+}
+
+func (bd *binaryDecoder) Decode() (Point, error) {
+	vt, err := bd.reader.ReadByte()
+	if err != nil {
+		return Point{}, err
+	}
+	point, err := bd.decode(ValueType(vt))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return point, err
+}
+
+func (bd *binaryDecoder) decode(vt ValueType) (Point, error) {
+	if err := vt.Valid(); err != nil {
+		return Point{}, err
+	}
+	delta, err := binary.ReadVarint(bd.reader)
+	if err != nil {
+		return Point{}, err
+	}
+	value, err := binary.ReadUvarint(bd.reader)
+	if err != nil {
+		return Point{}, err
+	}
+	bd.time += uint64(delta)
+	bd.value ^= value
+
+	count, err := binary.ReadUvarint(bd.reader)
+	if err != nil {
+		return Point{}, err
+	}
+	if count > 256 {
+		return Point{}, fmt.Errorf("invalid number of labels %d", count)
+	}
+	var labels []string
+	for i := uint64(0); i < count; i++ {
+		index, err := binary.ReadUvarint(bd.reader)
+		if err != nil {
+			return Point{}, err
+		}
+		if index > uint64(len(bd.labels)) {
+			return Point{}, fmt.Errorf("invalid label index %d, only %d labels seen", index, len(bd.labels))
+		}
+		if index == uint64(len(bd.labels)) {
+			size, err := binary.ReadUvarint(bd.reader)
+			if err != nil {
+				return Point{}, err
+			}
+			if size > maxImportLabelSize {
+				return Point{}, fmt.Errorf("invalid label size %d", size)
+			}
+			label := make([]byte, size)
+			_, err = io.ReadFull(bd.reader, label)
+			if err != nil {
+				return Point{}, err
+			}
+			bd.labels = append(bd.labels, string(label))
+		}
+		labels = append(labels, bd.labels[index])
+	}
+	return Point{bd.time, bd.value, labels, vt}, nil
+}
+
+// Number of points read at once by ExportSerie.
+var exportPageSize = 4096
+
+// Writes all the points of a serie to w, preceded by a header with the
+// options and metadata of the serie. Points in the overlay of the serie
+// are exported in order with the others, see OutOfOrderBackfill.
+// Returns the number of points written.
+func ExportSerie(dbbasepath string, w io.Writer, format ExportFormat) (int, error) {
+	header := ExportHeader{}
+	var err error
+	header.Data, header.Labels, err = ReadSerieOptions(dbbasepath)
+	if err != nil {
+		return 0, err
+	}
+	header.Meta, err = ReadSerieMeta(dbbasepath)
+	if err != nil {
+		return 0, err
+	}
+
+	reader := NewSerieReader(dbbasepath)
+	defer reader.Close()
+	err = reader.Open()
+	if err != nil {
+		return 0, err
+	}
+	encoder, err := NewPointEncoder(w, format, header)
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	start, end := reader.FirstLocation(), reader.LastLocation()
+	if !start.Valid() || !end.Valid() {
+		return 0, fmt.Errorf("could not read serie %s", dbbasepath)
+	}
+	for start.Before(end) {
+		next := start.Plus(reader, exportPageSize)
+		if end.Before(next) {
+			next = end
+		}
+		points, err := reader.GetData(start, next, nil)
+		if err != nil {
+			return written, err
+		}
+		for _, point := range points {
+			err := encoder.Encode(point)
+			if err != nil {
+				return written, err
+			}
+			written += 1
+		}
+		start = next
+	}
+	return written, encoder.Flush()
+}
+
+// Appends the points read from r, in batches of batchsize points, to the
+// serie dbbasepath, created with the options and metadata in the header
+// of the stream if it does not exist. Points are appended as they are,
+// with OutOfOrderAllow. Returns the number of points appended.
+//
+// When the type of the values changes, a new shard is started, so the
+// values are stored with the type they were exported with.
+func ImportSerie(dbbasepath string, r io.Reader, format ExportFormat, batchsize int, locktimeout time.Duration) (int, error) {
+	decoder, header, err := NewPointDecoder(r, format)
+	if err != nil {
+		return 0, err
+	}
+	if batchsize <= 0 {
+		batchsize = 1
+	}
+
+	writer := NewSerieWriter(dbbasepath)
+	writer.DataStoreOptions = header.Data
+	writer.LabelOptions = header.Labels
+	writer.LockTimeout = locktimeout
+	// The writer is opened with the type of the first point, or of the
+	// header if there are no points, so no empty shard is created.
+	opened := false
+	defer func() {
+		if opened {
+			writer.Close()
+		}
+	}()
+	open := func(vt ValueType) error {
+		if opened {
+			writer.Close()
+			opened = false
+		}
+		writer.ValueType = vt
+		err := writer.Open()
+		if err != nil {
+			return err
+		}
+		opened = true
+		if header.Meta != (SerieMeta{}) {
+			return writer.SetMeta(header.Meta)
+		}
+		return nil
+	}
+
+	written := 0
+	batch := make([]Point, 0, batchsize)
+	flush := func() error {
+		err := writer.AppendBatch(batch)
+		if err == nil {
+			written += len(batch)
+		}
+		batch = batch[:0]
+		return err
+	}
+	for {
+		point, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, fmt.Errorf("point %d: %s", written+len(batch), err)
+		}
+		if point.Time == 0 || point.Time == SealMarker {
+			return written, fmt.Errorf("point %d: time cannot be 0 or 0xfff... (-1)", written+len(batch))
+		}
+
+		// Reopening the writer with a different type starts a new shard.
+		if !opened || point.Type != writer.ValueType {
+			err := flush()
+			if err == nil {
+				err = open(point.Type)
+			}
+			if err != nil {
+				return written, err
+			}
+		}
+
+		batch = append(batch, point)
+		if len(batch) >= batchsize {
+			err := flush()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	if !opened {
+		return written, open(header.Data.ValueType)
+	}
+	return written, flush()
+}
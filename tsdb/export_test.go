@@ -0,0 +1,149 @@
+package tsdb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAllPoints(t *testing.T, dbbasepath string) []Point {
+	r := NewSerieReader(dbbasepath)
+	defer r.Close()
+	points, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	return points
+}
+
+func TestExportImport(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.LabelsPerEntry = 2
+	s.CompactOnSeal = false
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := uint64(1); i <= 300; i++ {
+		assert.Nil(t, s.Append(i, i*1000, []string{fmt.Sprintf("host=web%d", i%3), "dc=ams"}))
+	}
+	// Values of a different type start a new shard.
+	s.Close()
+	s.ValueType = TypeFloat64
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := uint64(301); i <= 400; i++ {
+		assert.Nil(t, s.Append(i, math.Float64bits(float64(i)/3), nil))
+	}
+	assert.Nil(t, s.SetMeta(SerieMeta{"ms", "Latency", KindGauge, time.Millisecond}))
+	s.Close()
+
+	expected := readAllPoints(t, s.Path)
+	assert.Equal(t, 400, len(expected))
+	do, lo, err := ReadSerieOptions(s.Path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, do.LabelsPerEntry)
+	assert.Equal(t, 32, do.MaxEntries)
+	assert.Equal(t, TypeFloat64, do.ValueType)
+	assert.Equal(t, false, do.CompactOnSeal)
+	assert.Equal(t, 128, lo.LabelBlock)
+
+	for _, format := range []ExportFormat{ExportCSV, ExportJSONL, ExportBinary} {
+		buffer := &bytes.Buffer{}
+		written, err := ExportSerie(s.Path, buffer, format)
+		assert.Nil(t, err, format.String())
+		assert.Equal(t, 400, written)
+
+		imported := filepath.Join(tempdir, "imported-"+format.String())
+		written, err = ImportSerie(imported, buffer, format, 64, 0)
+		assert.Nil(t, err, format.String())
+		assert.Equal(t, 400, written)
+
+		assert.Equal(t, expected, readAllPoints(t, imported), format.String())
+		ido, ilo, err := ReadSerieOptions(imported)
+		assert.Nil(t, err)
+		assert.Equal(t, do, ido)
+		assert.Equal(t, lo, ilo)
+		assert.Equal(t, len(GetDataFiles(s.Path)), len(GetDataFiles(imported)))
+		meta, err := ReadSerieMeta(imported)
+		assert.Nil(t, err)
+		assert.Equal(t, SerieMeta{"ms", "Latency", KindGauge, time.Millisecond}, meta)
+	}
+
+	// The binary format is the most compact.
+	sizes := map[ExportFormat]int{}
+	for _, format := range []ExportFormat{ExportCSV, ExportJSONL, ExportBinary} {
+		buffer := &bytes.Buffer{}
+		_, err := ExportSerie(s.Path, buffer, format)
+		assert.Nil(t, err)
+		sizes[format] = buffer.Len()
+	}
+	assert.True(t, sizes[ExportBinary] < sizes[ExportCSV])
+	assert.True(t, sizes[ExportCSV] < sizes[ExportJSONL])
+}
+
+func TestImportWithoutHeader(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	path := filepath.Join(tempdir, "csv")
+	written, err := ImportSerie(path, strings.NewReader("1,int64,-5,a,b\n2,int64,7\n"), ExportCSV, 1, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, written)
+	assert.Equal(t, []Point{{1, uint64(0xfffffffffffffffb), []string{"a", "b"}, TypeInt64}, {2, 7, nil, TypeInt64}}, readAllPoints(t, path))
+	// No empty shard of the default type is created.
+	assert.Equal(t, 1, len(GetDataFiles(path)))
+
+	path = filepath.Join(tempdir, "jsonl")
+	written, err = ImportSerie(path, strings.NewReader(`{"time": 1, "value": 1.5}`+"\n"+`{"time": 2, "value": 2.5, "label": ["x"]}`), ExportJSONL, 10, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, written)
+	assert.Equal(t, []Point{{1, math.Float64bits(1.5), nil, TypeFloat64}, {2, math.Float64bits(2.5), []string{"x"}, TypeFloat64}}, readAllPoints(t, path))
+
+	// Invalid points are reported with their position.
+	_, err = ImportSerie(filepath.Join(tempdir, "invalid"), strings.NewReader("1,uint64,1\n2,uint64,-1\n"), ExportCSV, 10, 0)
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "point 1:"), err.Error())
+}
+
+func TestBinaryDecoderTruncated(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	encoder, err := NewPointEncoder(buffer, ExportBinary, DefaultExportHeader())
+	assert.Nil(t, err)
+	assert.Nil(t, encoder.Encode(Point{10, 1, []string{"foo", "bar"}, TypeUint64}))
+	assert.Nil(t, encoder.Encode(Point{5, 2, []string{"bar"}, TypeUint64}))
+	assert.Nil(t, encoder.Flush())
+
+	decoder, header, err := NewPointDecoder(bytes.NewReader(buffer.Bytes()), ExportBinary)
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultExportHeader(), header)
+	point, err := decoder.Decode()
+	assert.Nil(t, err)
+	assert.Equal(t, Point{10, 1, []string{"foo", "bar"}, TypeUint64}, point)
+	point, err = decoder.Decode()
+	assert.Nil(t, err)
+	assert.Equal(t, Point{5, 2, []string{"bar"}, TypeUint64}, point)
+	_, err = decoder.Decode()
+	assert.Equal(t, io.EOF, err)
+
+	decoder, _, err = NewPointDecoder(bytes.NewReader(buffer.Bytes()[:buffer.Len()-2]), ExportBinary)
+	assert.Nil(t, err)
+	_, err = decoder.Decode()
+	assert.Nil(t, err)
+	_, err = decoder.Decode()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	_, _, err = NewPointDecoder(strings.NewReader("1,uint64,1\n"), ExportBinary)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,305 @@
+package tsdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+	"unsafe"
+)
+
+// .data, .labels and .index files start with a header of GetHeaderSize() bytes:
+//   [ 0 -  3] - 4 bytes - magic - "TSDB" for .data files, "TSLB" for .labels files, "TSIX" for .index files.
+//   [   4   ] - 1 byte  - uint8 - version - FileVersion when the file was written.
+//   [   5   ] - 1 byte  - uint8 - byte order - ByteOrder of all the integers in the file.
+//   [ 6 -  7] - 2 bytes - unused
+//   [ 8 - 31] - 24 bytes - specific to the type of file, see datastore.go, labelstore.go and labelindex.go.
+//
+// Integers are written in the byte order of the host creating the file.
+// Readers convert files written with a different byte order in memory,
+// writers refuse to modify them.
+
+// Version of the format of the files written.
+const FileVersion = 1
+
+const (
+	dataMagic   = "TSDB"
+	labelsMagic = "TSLB"
+	indexMagic  = "TSIX"
+)
+
+// Byte order of the integers stored in a file.
+type ByteOrder uint8
+
+const (
+	ByteOrderLittle ByteOrder = 1
+	ByteOrderBig    ByteOrder = 2
+)
+
+func (bo ByteOrder) String() string {
+	switch bo {
+	case ByteOrderLittle:
+		return "little endian"
+	case ByteOrderBig:
+		return "big endian"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(bo))
+}
+
+// Returns the byte order of the host.
+func HostByteOrder() ByteOrder {
+	probe := uint16(1)
+	if *(*uint8)(unsafe.Pointer(&probe)) == 1 {
+		return ByteOrderLittle
+	}
+	return ByteOrderBig
+}
+
+// Returned when trying to write a file created with a different byte order.
+var ErrByteOrder = errors.New("file was written with a different byte order - cannot be written")
+
+// Initializes the common header of a new file.
+func writeHeader(data []byte, magic string) {
+	copy(data[0:4], magic)
+	*(*uint8)(unsafe.Pointer(&data[4])) = uint8(FileVersion)
+	*(*uint8)(unsafe.Pointer(&data[5])) = uint8(HostByteOrder())
+}
+
+// Verifies the common header of a file. Returns true if the file was
+// written with a different byte order, and must be converted to be read.
+func checkHeader(filename string, data []byte, magic string) (bool, error) {
+	if len(data) < GetHeaderSize() {
+		return false, fmt.Errorf("%s is too short to have a header, %d bytes", filename, len(data))
+	}
+	if string(data[0:4]) != magic {
+		return false, fmt.Errorf("%s does not start with %s - not a tsdb file of this type", filename, magic)
+	}
+	if version := *(*uint8)(unsafe.Pointer(&data[4])); version != FileVersion {
+		return false, fmt.Errorf("%s has format version %d, only version %d is supported", filename, version, FileVersion)
+	}
+	switch order := getByteOrder(data); order {
+	case HostByteOrder():
+		return false, nil
+	case ByteOrderLittle, ByteOrderBig:
+		return true, nil
+	default:
+		return false, fmt.Errorf("%s has invalid byte order %d", filename, uint8(order))
+	}
+}
+
+// Returns the byte order of the header of a file, which must be valid.
+func getByteOrder(data []byte) ByteOrder {
+	return ByteOrder(*(*uint8)(unsafe.Pointer(&data[5])))
+}
+
+// Marks the header of a file as written with the other byte order.
+func flipByteOrder(data []byte) {
+	order := ByteOrderLittle
+	if getByteOrder(data) == ByteOrderLittle {
+		order = ByteOrderBig
+	}
+	*(*uint8)(unsafe.Pointer(&data[5])) = uint8(order)
+}
+
+// Reverses the order of the bytes of an integer.
+func swapBytes(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
+
+// Returns a copy of the content of a .data file, converted to the other
+// byte order. Used to read files written with a different byte order.
+func swapDataStore(data []byte) []byte {
+	result := append([]byte(nil), data...)
+	flipByteOrder(result)
+	swapBytes(result[8:16])
+	swapBytes(result[20:24])
+
+	if getDataFormat(result) == FormatCompressed {
+		// Time and value of the first entry, and size of the bit stream.
+		// The rest of the file is a sequence of bytes.
+		for offset := GetHeaderSize(); offset < compressedHeaderSize && offset+8 <= len(result); offset += 8 {
+			swapBytes(result[offset : offset+8])
+		}
+		return result
+	}
+
+	lpe := int(*(*uint8)(unsafe.Pointer(&result[16])))
+	entry := GetEntrySize(lpe)
+	for offset := GetHeaderSize(); offset+entry <= len(result); offset += entry {
+		swapBytes(result[offset : offset+8])
+		swapBytes(result[offset+8 : offset+16])
+		for i := 0; i < lpe; i++ {
+			swapBytes(result[offset+16+i*4 : offset+20+i*4])
+		}
+	}
+	return result
+}
+
+// Returns a copy of the content of a .labels file, converted to the other
+// byte order.
+func swapLabelStore(data []byte) []byte {
+	result := append([]byte(nil), data...)
+	flipByteOrder(result)
+	swapBytes(result[8:12])
+
+	// The size of each label is readable either before or after the swap.
+	tohost := getByteOrder(result) == HostByteOrder()
+	for offset := GetHeaderSize(); offset+4 <= len(result); {
+		if tohost {
+			swapBytes(result[offset : offset+4])
+		}
+		size := int(*(*uint32)(unsafe.Pointer(&result[offset])))
+		if !tohost {
+			swapBytes(result[offset : offset+4])
+		}
+		if size == 0 || size > len(result) {
+			break
+		}
+		offset += (4 + size + 7) / 8 * 8
+	}
+	return result
+}
+
+// Size of the header of the .data files written before headers existed:
+// cursor, lpe, format and type, at the offsets they now have minus 8.
+// .labels files had no header at all.
+const unversionedHeaderSize = 16
+
+// Returns true if data starts with magic. Files that do not were written
+// by a version without headers: readers convert them in memory, writers
+// rewrite them when opening the serie, see UpgradeSerie.
+func hasMagic(data []byte, magic string) bool {
+	return len(data) >= len(magic) && string(data[:len(magic)]) == magic
+}
+
+// Rewrites the shards of a serie written by a version without headers, so
+// they can be mapped and written again. Files that have a header already
+// are left alone, so the serie can be upgraded more than once.
+//
+// SerieWriter.Open upgrades the serie automatically, and SerieReader reads
+// files without headers converting them in memory, so calling this is
+// only needed to avoid the cost of the conversion on read-only series.
+//
+// The entries are not changed: the old header of the .data files is moved
+// after the common header, and the labels of the .labels files are moved
+// after a new header, which keeps their LabelIDs valid. Only FormatRaw
+// files are supported, as no version without headers compressed them.
+//
+// The serie is locked while upgrading, timeout is how long to wait for a
+// writer to release it, as in LockSerie. Readers with the serie open
+// reload the shards upgraded, as with any file replaced.
+//
+// Returns the number of files rewritten.
+func UpgradeSerie(dbbasepath string, timeout time.Duration) (int, error) {
+	lock, err := LockSerie(dbbasepath, DefaultDataStoreOptions().Mode, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+	return upgradeSerie(dbbasepath)
+}
+
+// Like UpgradeSerie, for the owner of the lock of the serie.
+func upgradeSerie(dbbasepath string) (int, error) {
+	upgraded := 0
+	for _, filename := range GetDataFiles(dbbasepath) {
+		id := ParseFileName(dbbasepath, filename)
+		if id == 0 {
+			continue
+		}
+		done, err := upgradeFile(filename, dataMagic, upgradeDataStore)
+		// The shard may have been removed after the directory was listed.
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return upgraded, err
+		}
+		if done {
+			upgraded += 1
+		}
+
+		done, err = upgradeFile(MakeLabelStoreFileName(dbbasepath, id), labelsMagic, upgradeLabelStore)
+		if err != nil && !os.IsNotExist(err) {
+			return upgraded, err
+		}
+		if done {
+			upgraded += 1
+		}
+	}
+	return upgraded, nil
+}
+
+// Replaces filename with the result of convert, keeping its permissions,
+// unless it starts with magic already. Only the magic is read otherwise.
+func upgradeFile(filename, magic string, convert func(string, []byte) ([]byte, error)) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	prefix := make([]byte, len(magic))
+	n, _ := io.ReadFull(file, prefix)
+	if hasMagic(prefix[:n], magic) {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+	converted, err := convert(filename, data)
+	if err != nil {
+		return false, err
+	}
+	err = replaceFile(filename, converted, int64(len(converted)))
+	if err == nil {
+		err = os.Chmod(filename, st.Mode())
+	}
+	return err == nil, err
+}
+
+// Returns the content of a .data file without header, with a header.
+// The ring keeps its size, so the file grows by the size of the header
+// added.
+func upgradeDataStore(filename string, data []byte) ([]byte, error) {
+	if len(data) < unversionedHeaderSize {
+		return nil, fmt.Errorf("%s is too short to be a data file, %d bytes", filename, len(data))
+	}
+	// The first 16 bytes had the same layout, 8 bytes earlier.
+	if format := DataFormat(data[9]); format != FormatRaw {
+		return nil, fmt.Errorf("%s has no header, and format %d - only raw files can be upgraded", filename, format)
+	}
+	if err := ValueType(data[10]).Valid(); err != nil {
+		return nil, fmt.Errorf("%s has no header, and %s", filename, err)
+	}
+
+	ring := data[unversionedHeaderSize:]
+	result := make([]byte, GetHeaderSize()+len(ring))
+	writeHeader(result, dataMagic)
+	copy(result[8:8+unversionedHeaderSize], data[:unversionedHeaderSize])
+	copy(result[GetHeaderSize():], ring)
+
+	// MaxEntries was not stored, the ring was sized for it.
+	lpe := int(*(*uint8)(unsafe.Pointer(&result[16])))
+	*(*uint32)(unsafe.Pointer(&result[20])) = uint32(len(ring) / GetEntrySize(lpe))
+	return result, nil
+}
+
+// Returns the content of a .labels file without header, with a header.
+func upgradeLabelStore(filename string, data []byte) ([]byte, error) {
+	result := make([]byte, GetHeaderSize()+len(data))
+	writeHeader(result, labelsMagic)
+	// LabelBlock was not stored, the file grows by blocks of this size.
+	*(*uint32)(unsafe.Pointer(&result[8])) = uint32(DefaultLabelOptions().LabelBlock)
+	copy(result[GetHeaderSize():], data)
+	return result, nil
+}
@@ -0,0 +1,195 @@
+package tsdb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Rewrites a file as if it was written by a host with the other byte order.
+func writeForeign(t *testing.T, filename string, swap func([]byte) []byte) {
+	data, err := ioutil.ReadFile(filename)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(filename, swap(data), 0666)
+	assert.Nil(t, err)
+}
+
+func TestHeaders(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	path := filepath.Join(tempdir, "test")
+
+	s := NewSerieWriter(path)
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.ValueType = TypeInt64
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := int64(1); i <= 300; i++ {
+		err := s.AppendInt64(uint64(i), -i, []string{"foo", "bar"})
+		assert.Nil(t, err)
+	}
+	s.Close()
+
+	// The first shard is compressed, the last is still raw.
+	for _, id := range []uint32{1, 3} {
+		writeForeign(t, MakeDataStoreFileName(path, id), swapDataStore)
+		writeForeign(t, MakeLabelStoreFileName(path, id), swapLabelStore)
+	}
+
+	r := NewSerieReader(path)
+	err = r.Open()
+	assert.Nil(t, err)
+	data, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 300, len(data))
+	assert.Equal(t, int64(-1), data[0].Int64())
+	assert.Equal(t, []string{"foo", "bar"}, data[0].Label)
+	assert.Equal(t, int64(-300), data[299].Int64())
+	assert.Equal(t, []string{"foo", "bar"}, data[299].Label)
+	r.Close()
+
+	check, err := CheckSerie(path)
+	assert.Nil(t, err)
+	assert.True(t, check.Ok(), "%v", check.Problems())
+
+	// Writers do not append to foreign shards, but start a new one.
+	s = NewSerieWriter(path)
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.ValueType = TypeInt64
+	err = s.Open()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(4), s.Id)
+	assert.Nil(t, s.AppendInt64(1000, 1000, nil))
+	s.Close()
+
+	// Files from a newer version, or without a header, are rejected.
+	datafile := MakeDataStoreFileName(path, 2)
+	raw, err := ioutil.ReadFile(datafile)
+	assert.Nil(t, err)
+	raw[4] = FileVersion + 1
+	assert.Nil(t, ioutil.WriteFile(datafile, raw, 0666))
+	_, err = OpenDataStoreForReading(datafile)
+	assert.Contains(t, err.Error(), "format version 2")
+	_, _, err = PeekDataStore(datafile)
+	assert.NotNil(t, err)
+
+	// Without magic, the file is read as written without headers.
+	copy(raw[:4], "\x00\x00\x00\x00")
+	raw[9] = 0xff
+	assert.Nil(t, ioutil.WriteFile(datafile, raw, 0666))
+	_, err = OpenDataStoreForReading(datafile)
+	assert.Contains(t, err.Error(), "only raw files")
+	_, _, err = PeekDataStore(datafile)
+	assert.Contains(t, err.Error(), "only raw files")
+}
+
+// Rewrites the files of a shard as written by a version without headers.
+func writeUnversioned(t *testing.T, path string, id uint32) {
+	datafile := MakeDataStoreFileName(path, id)
+	data, err := ioutil.ReadFile(datafile)
+	assert.Nil(t, err)
+	assert.Equal(t, FormatRaw, getDataFormat(data))
+	old := append(append([]byte{}, data[8:8+unversionedHeaderSize]...), data[GetHeaderSize():]...)
+	assert.Nil(t, ioutil.WriteFile(datafile, old, 0640))
+	assert.Nil(t, os.Chmod(datafile, 0640))
+
+	labelfile := MakeLabelStoreFileName(path, id)
+	data, err = ioutil.ReadFile(labelfile)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(labelfile, data[GetHeaderSize():], 0640))
+}
+
+func TestUpgradeSerie(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+	path := filepath.Join(tempdir, "test")
+
+	s := NewSerieWriter(path)
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.CompactOnSeal = false
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := uint64(1); i <= 300; i++ {
+		assert.Nil(t, s.Append(i, i, []string{fmt.Sprintf("host=web%d", i%3)}))
+	}
+	lastid := s.Id
+	s.Close()
+	files := GetDataFiles(path)
+	assert.Equal(t, 3, len(files))
+	for _, file := range files {
+		writeUnversioned(t, path, ParseFileName(path, file))
+	}
+
+	// Readers convert the files in memory, without changing them.
+	r := NewSerieReader(path)
+	assert.Nil(t, r.Open())
+	data, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 300, len(data))
+	assert.Equal(t, Point{1, 1, []string{"host=web1"}, TypeUint64}, data[0])
+	assert.Equal(t, Point{300, 300, []string{"host=web0"}, TypeUint64}, data[299])
+	_, entries, err := PeekDataStore(MakeDataStoreFileName(path, lastid))
+	assert.Nil(t, err)
+	assert.Equal(t, 300-2*127, entries)
+	do, lo, err := ReadSerieOptions(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 127, do.MaxEntries)
+	assert.Equal(t, DefaultLabelOptions().LabelBlock, lo.LabelBlock)
+	check, err := CheckSerie(path)
+	assert.Nil(t, err)
+	assert.True(t, check.Ok(), "%v", check.Problems())
+	_, err = SnapshotSerie(path, filepath.Join(tempdir, "snapshot"))
+	assert.Nil(t, err)
+	assert.Equal(t, data, readAllPoints(t, filepath.Join(tempdir, "snapshot")))
+	raw, err := ioutil.ReadFile(MakeDataStoreFileName(path, lastid))
+	assert.Nil(t, err)
+	assert.False(t, hasMagic(raw, dataMagic))
+
+	// Writers upgrade the files when opening the serie, and continue the
+	// last shard, with the labels it has.
+	s = NewSerieWriter(path)
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	err = s.Open()
+	assert.Nil(t, err)
+	assert.Equal(t, lastid, s.Id)
+	assert.Nil(t, s.Append(301, 301, []string{"host=web1"}))
+	s.Close()
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		assert.Nil(t, err)
+		assert.True(t, hasMagic(raw, dataMagic), file)
+		raw, err = ioutil.ReadFile(MakeLabelStoreFileName(path, ParseFileName(path, file)))
+		assert.Nil(t, err)
+		assert.True(t, hasMagic(raw, labelsMagic), file)
+	}
+	st, err := os.Stat(MakeDataStoreFileName(path, lastid))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0640), st.Mode())
+	data, err = r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 301, len(data))
+	assert.Equal(t, Point{301, 301, []string{"host=web1"}, TypeUint64}, data[300])
+	r.Close()
+
+	// Or explicitly, once.
+	for _, file := range files {
+		writeUnversioned(t, path, ParseFileName(path, file))
+	}
+	upgraded, err := UpgradeSerie(path, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, upgraded)
+	upgraded, err = UpgradeSerie(path, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, upgraded)
+	check, err = CheckSerie(path)
+	assert.Nil(t, err)
+	assert.True(t, check.Ok(), "%v", check.Problems())
+}
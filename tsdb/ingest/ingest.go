@@ -0,0 +1,244 @@
+package ingest
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ccontavalli/goutils/tsdb"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Returns the name of the serie to store a metric in. Dots separate the
+// components of the name, as in graphite, and become directories, so
+// servers.web1.cpu is stored in servers/web1/cpu. Empty components are
+// dropped, and characters other than letters, digits, '-' and '_' are
+// replaced by '_', so metric names cannot create files outside of the
+// directory of the series.
+func SerieName(metric string) string {
+	parts := []string{}
+	for _, part := range strings.Split(metric, ".") {
+		if part == "" {
+			continue
+		}
+		parts = append(parts, strings.Map(func(r rune) rune {
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+				return r
+			}
+			return '_'
+		}, part))
+	}
+	return strings.Join(parts, "/")
+}
+
+// Maximum length of a line received over TCP.
+const MaxLineLength = 1048576
+
+// A Server reads lines from TCP connections or UDP packets, parses them
+// with a Parser, and appends the samples to the series of a WriterPool.
+type Server struct {
+	Pool  *tsdb.WriterPool
+	Parse Parser
+
+	// Unit of the times written in the series, time.Second by default.
+	// Samples are truncated to the unit.
+	TimeUnit time.Duration
+	// Returns the name of the serie to write a metric to, SerieName by default.
+	// Samples whose name is not a valid serie name are rejected.
+	Rename func(metric string) string
+	// Invoked with the lines that could not be parsed or written, logs
+	// them by default.
+	OnError func(line string, err error)
+}
+
+func NewServer(pool *tsdb.WriterPool, parse Parser) *Server {
+	return &Server{pool, parse, time.Second, SerieName, func(line string, err error) {
+		log.Printf("Could not ingest line '%s': %s", line, err)
+	}}
+}
+
+// Points parsed from one or more lines, to append to their series with
+// one AppendBatch per serie.
+type batch struct {
+	// Names of the series, in the order they were first seen.
+	names  []string
+	points map[string][]tsdb.Point
+	// Lines each serie has points from.
+	lines map[string][]string
+}
+
+func newBatch() *batch {
+	return &batch{nil, make(map[string][]tsdb.Point), make(map[string][]string)}
+}
+
+// Parses a line, and adds its samples to the batch. On error, none of the
+// samples of the line are added.
+func (s *Server) parseLine(b *batch, line string) error {
+	samples, err := s.Parse(line, time.Now())
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(samples))
+	points := make([]tsdb.Point, 0, len(samples))
+	for _, sample := range samples {
+		if sample.Time.Before(time.Unix(0, 0)) {
+			return fmt.Errorf("time of metric %s is before the epoch", sample.Name)
+		}
+		when := uint64(sample.Time.UnixNano() / int64(s.TimeUnit))
+		if when == 0 {
+			return fmt.Errorf("time of metric %s is 0 - a reserved value", sample.Name)
+		}
+		// The writers would silently drop the labels that do not fit.
+		if len(sample.Label) > s.Pool.LabelsPerEntry {
+			return fmt.Errorf("metric %s has %d labels, more than the %d allowed", sample.Name, len(sample.Label), s.Pool.LabelsPerEntry)
+		}
+		name := s.Rename(sample.Name)
+		if err := tsdb.ValidSerieName(name); err != nil {
+			return fmt.Errorf("metric %s: %s", sample.Name, err)
+		}
+
+		names = append(names, name)
+		points = append(points, tsdb.Point{Time: when, Value: sample.Value, Label: sample.Label, Type: sample.Type})
+	}
+
+	for i, name := range names {
+		if _, ok := b.points[name]; !ok {
+			b.names = append(b.names, name)
+		}
+		b.points[name] = append(b.points[name], points[i])
+		if lines := b.lines[name]; len(lines) <= 0 || lines[len(lines)-1] != line {
+			b.lines[name] = append(lines, line)
+		}
+	}
+	return nil
+}
+
+// Appends the points of the batch to their series. Returns the first error,
+// after trying all the series, and invoking onError, if not nil, with each
+// line of the series that could not be written.
+func (s *Server) write(b *batch, onError func(line string, err error)) error {
+	var result error
+	for _, name := range b.names {
+		err := s.Pool.Append(name, b.points[name])
+		if err == nil {
+			continue
+		}
+		if result == nil {
+			result = err
+		}
+		if onError != nil {
+			for _, line := range b.lines[name] {
+				onError(line, err)
+			}
+		}
+	}
+	return result
+}
+
+// Parses a line and appends its samples to their series.
+func (s *Server) HandleLine(line string) error {
+	b := newBatch()
+	err := s.parseLine(b, line)
+	if err != nil {
+		return err
+	}
+	return s.write(b, nil)
+}
+
+// Parses the lines in data, separated by newlines, and appends their
+// samples to their series, in a single batch per serie. Errors are
+// reported to OnError, with the line that caused them. A batch rejected
+// by the writer, like one with a sample out of order and
+// OutOfOrderReject, fails all the lines with samples of its serie.
+func (s *Server) handleLines(data []byte) {
+	b := newBatch()
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) <= 0 {
+			continue
+		}
+		if err := s.parseLine(b, string(line)); err != nil {
+			s.OnError(string(line), err)
+		}
+	}
+	s.write(b, s.OnError)
+}
+
+// Reads lines from conn until it is closed. The complete lines received
+// by each read are handled together.
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	buffer := make([]byte, 65536)
+	pending := []byte{}
+	for {
+		n, err := conn.Read(buffer)
+		pending = append(pending, buffer[:n]...)
+		if end := bytes.LastIndexByte(pending, '\n'); end >= 0 {
+			s.handleLines(pending[:end])
+			pending = append([]byte{}, pending[end+1:]...)
+		}
+		if len(pending) > MaxLineLength {
+			s.OnError("", fmt.Errorf("error reading from %s: line longer than %d bytes", conn.RemoteAddr(), MaxLineLength))
+			return
+		}
+		if err == io.EOF {
+			// The last line may not be terminated by a newline.
+			s.handleLines(pending)
+			return
+		}
+		if err != nil {
+			s.OnError("", fmt.Errorf("error reading from %s: %s", conn.RemoteAddr(), err))
+			return
+		}
+	}
+}
+
+// Accepts connections from listener, reading one sample per line from
+// each. Returns when the listener is closed, with the error from Accept.
+func (s *Server) ServeTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Reads packets from conn, each containing one or more lines, handled
+// together. Returns
+// when conn is closed, with the error from ReadFrom.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	buffer := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		s.handleLines(buffer[:n])
+	}
+}
+
+// Listens on address, and serves it. network is one of "tcp", "tcp4",
+// "tcp6", "udp", "udp4", or "udp6".
+func (s *Server) ListenAndServe(network, address string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			return err
+		}
+		return s.ServeTCP(listener)
+	case "udp", "udp4", "udp6":
+		conn, err := net.ListenPacket(network, address)
+		if err != nil {
+			return err
+		}
+		return s.ServeUDP(conn)
+	}
+	return fmt.Errorf("unsupported network '%s'", network)
+}
@@ -0,0 +1,189 @@
+package ingest
+
+import (
+	"fmt"
+	"github.com/ccontavalli/goutils/tsdb"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseGraphite(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	samples, err := ParseGraphite("servers.web1.cpu 12.5 1500000000", now)
+	assert.Nil(t, err)
+	assert.Equal(t, []Sample{{"servers.web1.cpu", time.Unix(1500000000, 0), math.Float64bits(12.5), tsdb.TypeFloat64, nil}}, samples)
+
+	samples, err = ParseGraphite("cpu;host=web1;dc=us 3", now)
+	assert.Nil(t, err)
+	assert.Equal(t, []Sample{{"cpu", now, math.Float64bits(3), tsdb.TypeFloat64, []string{"host=web1", "dc=us"}}}, samples)
+
+	samples, err = ParseGraphite("cpu 3 -1", now)
+	assert.Nil(t, err)
+	assert.Equal(t, now, samples[0].Time)
+
+	samples, err = ParseGraphite("  ", now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(samples))
+
+	for _, invalid := range []string{"cpu", "cpu foo 1", "cpu 1 foo", "cpu 1 2 3", ";host=a 1", "cpu;host 1"} {
+		_, err := ParseGraphite(invalid, now)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestParseInflux(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	samples, err := ParseInflux(`cpu,host=web1,dc=us\ east usage=0.5,count=3i,total=7u,up=true,msg="a, b=c" 1500000000000000000`, now)
+	assert.Nil(t, err)
+	when := time.Unix(1500000000, 0)
+	labels := []string{"host=web1", "dc=us east"}
+	assert.Equal(t, []Sample{
+		{"cpu.usage", when, math.Float64bits(0.5), tsdb.TypeFloat64, labels},
+		{"cpu.count", when, 3, tsdb.TypeInt64, labels},
+		{"cpu.total", when, 7, tsdb.TypeUint64, labels},
+		{"cpu.up", when, 1, tsdb.TypeUint64, labels},
+	}, samples)
+
+	samples, err = InfluxParser(time.Second)(`my\,measure value=-2i 1500000000`, now)
+	assert.Nil(t, err)
+	assert.Equal(t, []Sample{{"my,measure.value", when, uint64(0xfffffffffffffffe), tsdb.TypeInt64, nil}}, samples)
+
+	samples, err = ParseInflux("mem free=1", now)
+	assert.Nil(t, err)
+	assert.Equal(t, now, samples[0].Time)
+
+	for _, invalid := range []string{"cpu", "cpu value=", "cpu value=foo", "cpu,host value=1", "cpu value=1 foo", ",host=a value=1"} {
+		_, err := ParseInflux(invalid, now)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestSerieName(t *testing.T) {
+	assert.Equal(t, "servers/web1/cpu", SerieName("servers.web1.cpu"))
+	assert.Equal(t, "_/_etc_passwd", SerieName("/../etc/passwd"))
+	assert.Equal(t, "my_measure/value", SerieName("my,measure.value"))
+	assert.Equal(t, "hidden", SerieName("..hidden"))
+	assert.Equal(t, "a/b", SerieName("a..b."))
+	assert.Equal(t, "", SerieName("..."))
+}
+
+// Waits for a serie to have the expected number of points, and returns them.
+func waitForPoints(t *testing.T, path string, expected int) []tsdb.Point {
+	var data []tsdb.Point
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		r := tsdb.NewSerieReader(path)
+		if r.Open() != nil {
+			continue
+		}
+		var err error
+		data, err = r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+		assert.Nil(t, err)
+		if len(data) >= expected {
+			break
+		}
+	}
+	assert.Equal(t, expected, len(data))
+	return data
+}
+
+func TestServer(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "ingest-")
+	assert.Nil(t, err)
+	pool := tsdb.NewWriterPool(tempdir)
+	defer pool.Close()
+
+	errors := make(chan string, 10)
+	graphite := NewServer(pool, ParseGraphite)
+	graphite.OnError = func(line string, err error) { errors <- line }
+	influx := NewServer(pool, ParseInflux)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	go graphite.ServeTCP(listener)
+
+	packetconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer packetconn.Close()
+	go influx.ServeUDP(packetconn)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintf(conn, "servers.web1.cpu;host=web1 %d.5 %d\r\n", i, 1000+i)
+	}
+	fmt.Fprintf(conn, "not a valid line\n")
+	fmt.Fprintf(conn, "... 1 1000\n")
+	// The last line needs no newline.
+	fmt.Fprintf(conn, "servers.web1.mem 1 1000")
+	conn.Close()
+
+	data := waitForPoints(t, filepath.Join(tempdir, "servers", "web1", "cpu"), 10)
+	assert.Equal(t, uint64(1001), data[0].Time)
+	assert.Equal(t, 1.5, data[0].Float64())
+	assert.Equal(t, []string{"host=web1"}, data[0].Label)
+	assert.Equal(t, "not a valid line", <-errors)
+	assert.Equal(t, "... 1 1000", <-errors)
+	waitForPoints(t, filepath.Join(tempdir, "servers", "web1", "mem"), 1)
+
+	conn, err = net.Dial("udp", packetconn.LocalAddr().String())
+	assert.Nil(t, err)
+	fmt.Fprintf(conn, "disk,dev=sda used=10i,free=20i 2000000000000\ndisk,dev=sda used=11i,free=19i 2001000000000\n")
+	conn.Close()
+
+	data = waitForPoints(t, filepath.Join(tempdir, "disk", "free"), 2)
+	assert.Equal(t, uint64(2000), data[0].Time)
+	assert.Equal(t, int64(19), data[1].Int64())
+	assert.Equal(t, []string{"dev=sda"}, data[1].Label)
+}
+
+func TestHandleLines(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "ingest-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+	pool := tsdb.NewWriterPool(tempdir)
+	pool.OutOfOrder = tsdb.OutOfOrderReject
+	defer pool.Close()
+
+	errors := []string{}
+	server := NewServer(pool, ParseGraphite)
+	server.OnError = func(line string, err error) { errors = append(errors, line) }
+
+	// The samples of each serie are appended in a single batch, in order.
+	server.handleLines([]byte("a 1 1000\nb 2 1000\na 3 1001\ninvalid\n\na 4 1002"))
+	assert.Equal(t, []string{"invalid"}, errors)
+	data := waitForPoints(t, filepath.Join(tempdir, "a"), 3)
+	assert.Equal(t, uint64(1002), data[2].Time)
+	waitForPoints(t, filepath.Join(tempdir, "b"), 1)
+
+	// A rejected batch fails all the lines of its serie, not the others.
+	errors = []string{}
+	server.handleLines([]byte("a 5 1003\nb 6 1001\na 7 900"))
+	assert.Equal(t, []string{"a 5 1003", "a 7 900"}, errors)
+	waitForPoints(t, filepath.Join(tempdir, "a"), 3)
+	waitForPoints(t, filepath.Join(tempdir, "b"), 2)
+}
+
+func TestHandleLineTooManyLabels(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "ingest-")
+	assert.Nil(t, err)
+	pool := tsdb.NewWriterPool(tempdir)
+	pool.LabelsPerEntry = 2
+	defer pool.Close()
+
+	server := NewServer(pool, ParseGraphite)
+	assert.NotNil(t, server.HandleLine("cpu;a=1;b=2;c=3 1 1000"))
+	assert.Equal(t, 0, len(tsdb.GetDataFiles(filepath.Join(tempdir, "cpu"))))
+
+	assert.Nil(t, server.HandleLine("cpu;a=1;b=2 1 1000"))
+	data := waitForPoints(t, filepath.Join(tempdir, "cpu"), 1)
+	assert.Equal(t, []string{"a=1", "b=2"}, data[0].Label)
+}
@@ -0,0 +1,213 @@
+// Package ingest receives points in the formats spoken by common metric
+// collectors, Graphite plaintext and InfluxDB line protocol, and writes
+// them to tsdb series.
+package ingest
+
+import (
+	"fmt"
+	"github.com/ccontavalli/goutils/tsdb"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A point received from a collector, not yet written to a serie.
+type Sample struct {
+	// Name of the metric, as received.
+	Name  string
+	Time  time.Time
+	Value uint64
+	Type  tsdb.ValueType
+	// Tags of the metric, as name=value labels.
+	Label []string
+}
+
+// Parses a line of input, returning the samples it contains. Empty lines
+// and comments return no samples and no error. now is the time to use for
+// samples without a timestamp.
+type Parser func(line string, now time.Time) ([]Sample, error)
+
+// Parses a line in Graphite plaintext format:
+//
+//	metric.path value [timestamp]
+//
+// with timestamp in seconds since the epoch, optionally fractional, and
+// with optional tags in the form metric.path;tag1=value1;tag2=value2.
+// Values are always float64, as in Graphite.
+func ParseGraphite(line string, now time.Time) ([]Sample, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("invalid graphite line '%s' - must be 'path value [timestamp]'", line)
+	}
+
+	tags := strings.Split(fields[0], ";")
+	name, labels := tags[0], []string(nil)
+	if name == "" {
+		return nil, fmt.Errorf("invalid graphite line '%s' - empty metric path", line)
+	}
+	for _, tag := range tags[1:] {
+		if !strings.Contains(tag, "=") || strings.HasPrefix(tag, "=") {
+			return nil, fmt.Errorf("invalid graphite tag '%s' - must be name=value", tag)
+		}
+		labels = append(labels, tag)
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid graphite value '%s' - %s", fields[1], err)
+	}
+
+	when := now
+	// Some collectors send -1 to mean "now".
+	if len(fields) == 3 && fields[2] != "-1" {
+		seconds, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid graphite timestamp '%s'", fields[2])
+		}
+		whole, fraction := math.Modf(seconds)
+		when = time.Unix(int64(whole), int64(fraction*1e9))
+	}
+
+	return []Sample{{name, when, math.Float64bits(value), tsdb.TypeFloat64, labels}}, nil
+}
+
+// Splits s at each sep not escaped by a backslash. If quotes is true, sep
+// is also ignored between double quotes.
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	parts := []string{}
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"' && quotes:
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Removes the backslashes escaping characters in names and tags.
+func unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var result strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		result.WriteByte(s[i])
+	}
+	return result.String()
+}
+
+// Splits a key=value pair at the first unescaped =.
+func splitPair(pair string) (string, string, bool) {
+	parts := splitUnescaped(pair, '=', false)
+	if len(parts) < 2 || parts[0] == "" {
+		return "", "", false
+	}
+	return unescape(parts[0]), strings.Join(parts[1:], "="), true
+}
+
+// Parses the value of a field in line protocol. Returns false for
+// strings, which cannot be stored in a serie.
+func parseInfluxValue(value string) (uint64, tsdb.ValueType, bool, error) {
+	switch {
+	case value == "":
+		return 0, tsdb.TypeUint64, false, fmt.Errorf("empty field value")
+	case strings.HasPrefix(value, "\""):
+		return 0, tsdb.TypeUint64, false, nil
+	case value == "t" || value == "T" || value == "true" || value == "True" || value == "TRUE":
+		return 1, tsdb.TypeUint64, true, nil
+	case value == "f" || value == "F" || value == "false" || value == "False" || value == "FALSE":
+		return 0, tsdb.TypeUint64, true, nil
+	case strings.HasSuffix(value, "i"):
+		parsed, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		return uint64(parsed), tsdb.TypeInt64, true, err
+	case strings.HasSuffix(value, "u"):
+		parsed, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+		return parsed, tsdb.TypeUint64, true, err
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	return math.Float64bits(parsed), tsdb.TypeFloat64, true, err
+}
+
+// Returns a Parser for the InfluxDB line protocol:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// with timestamps expressed in units of precision. Each field is returned
+// as a separate sample named measurement.field, with the tags as labels.
+// Fields with string values are ignored, booleans are stored as 0 or 1.
+func InfluxParser(precision time.Duration) Parser {
+	return func(line string, now time.Time) ([]Sample, error) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			return nil, nil
+		}
+
+		sections := []string{}
+		for _, section := range splitUnescaped(line, ' ', true) {
+			if section != "" {
+				sections = append(sections, section)
+			}
+		}
+		if len(sections) < 2 || len(sections) > 3 {
+			return nil, fmt.Errorf("invalid line protocol '%s' - must be 'measurement[,tags] fields [timestamp]'", line)
+		}
+
+		key := splitUnescaped(sections[0], ',', false)
+		measurement := unescape(key[0])
+		if measurement == "" {
+			return nil, fmt.Errorf("invalid line protocol '%s' - empty measurement", line)
+		}
+		labels := []string(nil)
+		for _, tag := range key[1:] {
+			name, value, ok := splitPair(tag)
+			if !ok || value == "" {
+				return nil, fmt.Errorf("invalid tag '%s' - must be name=value", tag)
+			}
+			labels = append(labels, name+"="+unescape(value))
+		}
+
+		when := now
+		if len(sections) == 3 {
+			timestamp, err := strconv.ParseInt(sections[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp '%s' - %s", sections[2], err)
+			}
+			when = time.Unix(0, timestamp*int64(precision))
+		}
+
+		samples := []Sample{}
+		for _, field := range splitUnescaped(sections[1], ',', true) {
+			name, rawvalue, ok := splitPair(field)
+			if !ok {
+				return nil, fmt.Errorf("invalid field '%s' - must be name=value", field)
+			}
+			value, vt, numeric, err := parseInfluxValue(rawvalue)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for field '%s' - %s", name, err)
+			}
+			if !numeric {
+				continue
+			}
+			samples = append(samples, Sample{measurement + "." + name, when, value, vt, labels})
+		}
+		return samples, nil
+	}
+}
+
+// Parses the InfluxDB line protocol, with timestamps in nanoseconds.
+var ParseInflux = InfluxParser(time.Nanosecond)
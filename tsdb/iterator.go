@@ -0,0 +1,273 @@
+package tsdb
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Reads the points of a serie one at a time, forward or backward, loading
+// the shards only as they are reached. Unlike GetData, no slice of points
+// is built, and iterating can stop at any time.
+//
+// The iterator is positioned between two points: Next moves over the point
+// after the position, Prev over the point before it. Points are returned
+// in the same order as GetData, with the points backfilled merged in by time
+// if Backfill is set in the SerieReader.
+//
+// Typical use:
+//
+//	it := reader.Iterator()
+//	it.Seek(math.MaxUint64)
+//	for it.Prev() {
+//		point := it.Point()
+//		...
+//	}
+//	if it.Err() != nil {
+//		...
+//	}
+type SerieIterator struct {
+	// If false, the labels of the points are not loaded from the labels
+	// files, and the points returned have no labels. True by default.
+	Labels bool
+
+	reader *SerieReader
+	// The position of the iterator: before the element of the shard, and
+	// before the backfilled point at index backfill.
+	shard    *shard
+	element  int
+	backfill int
+	// Points of the overlay, sorted by time, as when Seek was called.
+	backfilled []Point
+
+	// The point moved over last, and its location.
+	point    Point
+	location Location
+	err      error
+}
+
+// Returns an iterator positioned before the first point of the serie.
+func (s *SerieReader) Iterator() *SerieIterator {
+	it := &SerieIterator{true, s, nil, 0, 0, nil, Point{}, Location{nil, 0, nil}, nil}
+	it.Seek(0)
+	return it
+}
+
+// Positions the iterator before the first point with a time equal or
+// later than time, or at the end of the serie if there is none. Seek with
+// math.MaxUint64 to iterate backward from the last point.
+//
+// As with Find, the points of the serie must be sorted by time for the
+// position to be exact. Clears the error of the iterator, if any, and
+// reloads the points backfilled. On a serie with no shard yet, the
+// iterator is at the end, with no error: Next returns the points written
+// later, from the first.
+func (it *SerieIterator) Seek(time uint64) {
+	s := it.reader
+	it.point, it.location, it.err = Point{}, Location{nil, 0, nil}, nil
+	it.shard, it.element, it.backfill, it.backfilled = nil, 0, 0, nil
+
+	err := s.ReloadShards()
+	if err == ErrNoShards {
+		return
+	}
+	if err != nil {
+		it.err = err
+		return
+	}
+	location := s.Find(func(t uint64) bool {
+		return t >= time
+	})
+	if !location.Valid() {
+		it.err = fmt.Errorf("serie %s: could not find time %d", s.Path, time)
+		return
+	}
+	it.shard, it.element = location.shard, location.element
+
+	if s.Backfill {
+		err := s.loadBackfill()
+		if err != nil {
+			it.err = err
+			return
+		}
+		it.backfilled = s.backfilled
+		it.backfill = sort.Search(len(it.backfilled), func(i int) bool {
+			return it.backfilled[i].Time >= time
+		})
+	}
+}
+
+// Moves over the next point. Returns false at the end of the serie, or on
+// error, check Err. At the end of the serie, Next can be called again to
+// read the points appended since.
+func (it *SerieIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	// Seek found no shard, check if the first ones were written since.
+	if it.shard == nil {
+		if it.Seek(0); it.shard == nil {
+			return false
+		}
+	}
+	time, found := it.forward()
+	if it.err != nil {
+		return false
+	}
+
+	// Backfilled points are returned before the first element with a later time.
+	if it.backfill < len(it.backfilled) && (!found || it.backfilled[it.backfill].Time < time) {
+		it.setBackfilled(it.backfill)
+		it.backfill += 1
+		return true
+	}
+	if !found {
+		return false
+	}
+	it.setElement(time)
+	it.element += 1
+	return true
+}
+
+// Moves over the previous point. Returns false at the beginning of the
+// serie, or on error, check Err.
+func (it *SerieIterator) Prev() bool {
+	if it.err != nil || it.shard == nil {
+		return false
+	}
+	time, found := it.backward()
+	if it.err != nil {
+		return false
+	}
+
+	// The element comes first if the backfilled point has the same time.
+	if it.backfill > 0 && (!found || it.backfilled[it.backfill-1].Time >= time) {
+		it.backfill -= 1
+		it.setBackfilled(it.backfill)
+		return true
+	}
+	if !found {
+		return false
+	}
+	it.element -= 1
+	it.setElement(time)
+	return true
+}
+
+// Returns the point moved over by the last call to Next or Prev.
+func (it *SerieIterator) Point() Point {
+	return it.point
+}
+
+// Returns the location of the point moved over by the last call to Next or
+// Prev. For a backfilled point, this is the element it was merged before.
+func (it *SerieIterator) Location() Location {
+	return it.location
+}
+
+// Returns the error that stopped the iterator, nil if none.
+func (it *SerieIterator) Err() error {
+	return it.err
+}
+
+func (it *SerieIterator) setElement(time uint64) {
+	it.location = Location{it.shard, it.element, nil}
+	it.point = Point{time, it.shard.dw.GetValue(it.shard.dw.GetOffset(it.element)), nil, it.shard.valuetype}
+	if it.Labels {
+		it.point.Label = it.reader.GetLabels(it.location, nil)
+	}
+}
+
+func (it *SerieIterator) setBackfilled(index int) {
+	it.location = Location{it.shard, it.element, &it.backfilled[index]}
+	it.point = it.backfilled[index]
+	if !it.Labels {
+		it.point.Label = nil
+	}
+}
+
+// Loads the shard of the position. If the shard was replaced, as by
+// compaction, continues from the same element of the new file.
+func (it *SerieIterator) load() bool {
+	s := it.reader
+	if !s.hasShard(it.shard) {
+		replaced, ok := s.byname[MakeDataStoreFileName(s.Path, it.shard.fileid)]
+		if !ok {
+			it.err = fmt.Errorf("serie %s: shard %08x is gone", s.Path, it.shard.fileid)
+			return false
+		}
+		it.shard = replaced
+	}
+	err := it.shard.Load(s)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	return true
+}
+
+// Moves the position past seal markers and to the following shards, until
+// it is before an element. Returns the time of the element, false if
+// there is none.
+func (it *SerieIterator) forward() (uint64, bool) {
+	s := it.reader
+	for it.load() {
+		if it.element < it.shard.dw.GetEntries() {
+			time := it.shard.dw.GetTime(it.shard.dw.GetOffset(it.element))
+			if time != SealMarker {
+				return time, true
+			}
+			it.element += 1
+			continue
+		}
+
+		next := it.shard.Next(s)
+		if next == nil {
+			// Check for shards added since, and for the last shard to be gone.
+			err := s.ReloadShards()
+			if err != nil {
+				it.err = err
+				return 0, false
+			}
+			if !it.load() {
+				return 0, false
+			}
+			next = it.shard.Next(s)
+			if next == nil {
+				if it.element < it.shard.dw.GetEntries() {
+					continue
+				}
+				return 0, false
+			}
+		}
+		it.shard, it.element = next, 0
+	}
+	return 0, false
+}
+
+// Moves the position before seal markers and to the preceding shards,
+// until it is after an element. Returns the time of the element, false if
+// there is none.
+func (it *SerieIterator) backward() (uint64, bool) {
+	s := it.reader
+	for it.load() {
+		// -1 for the end of a shard just reached.
+		if entries := it.shard.dw.GetEntries(); it.element < 0 || it.element > entries {
+			it.element = entries
+		}
+		if it.element > 0 {
+			time := it.shard.dw.GetTime(it.shard.dw.GetOffset(it.element - 1))
+			if time != SealMarker {
+				return time, true
+			}
+			it.element -= 1
+			continue
+		}
+
+		prev := it.shard.Prev(s)
+		if prev == nil {
+			return 0, false
+		}
+		it.shard, it.element = prev, -1
+	}
+	return 0, false
+}
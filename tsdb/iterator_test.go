@@ -0,0 +1,140 @@
+package tsdb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSerieIterator(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.OutOfOrder = OutOfOrderBackfill
+	err = s.Open()
+	assert.Nil(t, err)
+	defer s.Close()
+	for i := uint64(10); i < 10000; i += 10 {
+		assert.Nil(t, s.Append(i, i, []string{fmt.Sprintf("label-%d", i)}))
+	}
+	// Backfilled points, one with the same time as a point of the serie.
+	for _, i := range []uint64{15, 500, 5, 995} {
+		assert.Nil(t, s.Append(i, i, []string{"late"}))
+	}
+
+	r := NewSerieReader(s.Path)
+	r.MaxLoadedShards = 2
+	defer r.Close()
+	expected, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1003, len(expected))
+
+	it := r.Iterator()
+	points := []Point{}
+	for it.Next() {
+		points = append(points, it.Point())
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, expected, points)
+
+	// Backward, from the end, returns the same points.
+	points = []Point{}
+	for it.Prev() {
+		points = append([]Point{it.Point()}, points...)
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, expected, points)
+
+	// Seek positions before the first point with a later or equal time.
+	it.Seek(500)
+	assert.True(t, it.Next())
+	assert.Equal(t, Point{500, 500, []string{"label-500"}, TypeUint64}, it.Point())
+	assert.False(t, it.Location().Backfilled())
+	assert.True(t, it.Next())
+	assert.Equal(t, Point{500, 500, []string{"late"}, TypeUint64}, it.Point())
+	assert.True(t, it.Location().Backfilled())
+	assert.True(t, it.Prev())
+	assert.True(t, it.Prev())
+	assert.True(t, it.Prev())
+	assert.Equal(t, Point{490, 490, []string{"label-490"}, TypeUint64}, it.Point())
+
+	// Stop as soon as the condition holds, without labels.
+	it.Labels = false
+	it.Seek(math.MaxUint64)
+	read := 0
+	for it.Prev() && it.Point().Time > 9900 {
+		read += 1
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, 9, read)
+	assert.Equal(t, Point{9900, 9900, nil, TypeUint64}, it.Point())
+
+	// Points appended are returned once the end is reached.
+	it.Seek(math.MaxUint64)
+	assert.False(t, it.Next())
+	assert.Nil(t, s.Append(10000, 10000, nil))
+	assert.True(t, it.Next())
+	assert.Equal(t, uint64(10000), it.Point().Time)
+	assert.False(t, it.Next())
+
+	// Without the backfilled points.
+	r.Backfill = false
+	it = r.Iterator()
+	read = 0
+	for it.Next() {
+		read += 1
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, 1000, read)
+
+	// Shards removed while iterating are reported.
+	it = r.Iterator()
+	assert.True(t, it.Next())
+	for _, file := range GetDataFiles(s.Path)[:2] {
+		assert.Nil(t, RemoveShard(s.Path, ParseFileName(s.Path, file)))
+	}
+	assert.Nil(t, r.ReloadShards())
+	assert.False(t, it.Next())
+	assert.NotNil(t, it.Err())
+	it.Seek(0)
+	assert.Nil(t, it.Err())
+	assert.True(t, it.Next())
+}
+
+func TestSerieIteratorNoShards(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	r := NewSerieReader(filepath.Join(tempdir, "test"))
+	defer r.Close()
+	it := r.Iterator()
+	assert.False(t, it.Next())
+	assert.False(t, it.Prev())
+	assert.Nil(t, it.Err())
+	it.Seek(100)
+	assert.False(t, it.Next())
+	assert.Nil(t, it.Err())
+
+	// Points written later are returned from the first.
+	s := NewSerieWriter(r.Path)
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	assert.Nil(t, s.Open())
+	defer s.Close()
+	assert.Nil(t, s.Append(10, 1, nil))
+	assert.Nil(t, s.Append(20, 2, nil))
+	assert.True(t, it.Next())
+	assert.Equal(t, Point{10, 1, nil, TypeUint64}, it.Point())
+	assert.True(t, it.Next())
+	assert.False(t, it.Next())
+	assert.Nil(t, it.Err())
+}
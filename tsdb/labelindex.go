@@ -0,0 +1,528 @@
+package tsdb
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// Format of a .index file, with the postings of the labels of a shard that
+// is not written anymore, the elements of the entries having each label:
+//   [ 0 -  7] - 8 bytes - common header, with magic "TSIX", see header.go.
+//   [ 8 - 15] - 8 bytes - uint64 - inode of the .data file indexed.
+//   [16 - 19] - 4 bytes - uint32 - number of entries of the .data file indexed.
+//   [20 - 23] - 4 bytes - uint32 - number of labels.
+//   [24 - 31] - 8 bytes - unused
+//   [32 - ..] - x bytes - labels, sorted, each one aligned to 4 bytes.
+//   [.. - ..] - x bytes - postings, uint32 elements in increasing order.
+//
+// Format of a label:
+//   [ 0 -  3] - 4 bytes - uint32 - offset in the file of the postings of the label.
+//   [ 4 -  7] - 4 bytes - uint32 - number of postings.
+//   [ 8 - 11] - 4 bytes - uint32 - length of the label.
+//   [12 - ..] - x bytes - the label itself.
+//
+// Index files are created by readers the first time a shard is queried by
+// label, and are ignored and created again if the .data file is replaced.
+
+func MakeIndexFileName(dbbasepath string, number uint32) string {
+	return MakeFileName(dbbasepath, number, "index")
+}
+
+type labelIndex struct {
+	data []byte
+	// True if data is the file mapped in memory.
+	mapped bool
+
+	// Labels of the shard, sorted, and the offset in data of each one.
+	label  []string
+	offset []int
+}
+
+func getUint32(data []byte, offset int) uint32 {
+	return *(*uint32)(unsafe.Pointer(&data[offset]))
+}
+
+func putUint32(data []byte, offset int, value uint32) {
+	*(*uint32)(unsafe.Pointer(&data[offset])) = value
+}
+
+// Creates the content of the .index file of a shard.
+func buildLabelIndex(dw *DataStore, ls *LabelStore, inode uint64) ([]byte, error) {
+	entries := dw.GetEntries()
+	byid := make(map[LabelID][]uint32)
+	labelids := make([]LabelID, 0, dw.lpe)
+	for element := 0; element < entries; element++ {
+		labelids = dw.GetLabels(dw.GetOffset(element), labelids[:0])
+		for _, id := range labelids {
+			postings := byid[id]
+			if len(postings) > 0 && postings[len(postings)-1] == uint32(element) {
+				continue
+			}
+			byid[id] = append(postings, uint32(element))
+		}
+	}
+
+	bylabel := make(map[string][]uint32)
+	for id, postings := range byid {
+		label, err := ls.LoadString(id)
+		if err != nil {
+			return nil, err
+		}
+		// The same label may have been created more than once.
+		bylabel[label] = mergeElements(bylabel[label], postings)
+	}
+	labels := make([]string, 0, len(bylabel))
+	size := GetHeaderSize()
+	for label, postings := range bylabel {
+		labels = append(labels, label)
+		size += (12+len(label)+3)/4*4 + len(postings)*4
+	}
+	sort.Strings(labels)
+
+	data := make([]byte, size)
+	writeHeader(data, indexMagic)
+	*(*uint64)(unsafe.Pointer(&data[8])) = inode
+	putUint32(data, 16, uint32(entries))
+	putUint32(data, 20, uint32(len(labels)))
+	offset := GetHeaderSize()
+	postingsoffset := offset
+	for _, label := range labels {
+		postingsoffset += (12 + len(label) + 3) / 4 * 4
+	}
+	for _, label := range labels {
+		postings := bylabel[label]
+		putUint32(data, offset, uint32(postingsoffset))
+		putUint32(data, offset+4, uint32(len(postings)))
+		putUint32(data, offset+8, uint32(len(label)))
+		copy(data[offset+12:], label)
+		offset += (12 + len(label) + 3) / 4 * 4
+
+		for _, element := range postings {
+			putUint32(data, postingsoffset, element)
+			postingsoffset += 4
+		}
+	}
+	return data, nil
+}
+
+// Parses the content of a .index file. Returns an error if it does not
+// match the .data file with the inode and number of entries specified.
+func newLabelIndex(filename string, data []byte, inode uint64, entries int) (*labelIndex, error) {
+	swap, err := checkHeader(filename, data, indexMagic)
+	if err != nil {
+		return nil, err
+	}
+	if swap {
+		return nil, fmt.Errorf("%s was written with a different byte order", filename)
+	}
+	if *(*uint64)(unsafe.Pointer(&data[8])) != inode || int(getUint32(data, 16)) != entries {
+		return nil, fmt.Errorf("%s does not index the current data file", filename)
+	}
+
+	count := int(getUint32(data, 20))
+	index := &labelIndex{data, false, make([]string, 0, count), make([]int, 0, count)}
+	for i, offset := 0, GetHeaderSize(); i < count; i++ {
+		if offset+12 > len(data) {
+			return nil, fmt.Errorf("%s: label %d is outside the file", filename, i)
+		}
+		postings, number, size := int(getUint32(data, offset)), int(getUint32(data, offset+4)), int(getUint32(data, offset+8))
+		if offset+12+size > len(data) || postings+number*4 > len(data) {
+			return nil, fmt.Errorf("%s: label %d is invalid", filename, i)
+		}
+		index.label = append(index.label, string(data[offset+12:offset+12+size]))
+		index.offset = append(index.offset, offset)
+		offset += (12 + size + 3) / 4 * 4
+	}
+	return index, nil
+}
+
+// Maps the .index file of a shard in memory, and parses it.
+func openLabelIndex(filename string, inode uint64, entries int) (*labelIndex, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := mmapFile(file, unix.PROT_READ, false)
+	if err != nil {
+		return nil, err
+	}
+	index, err := newLabelIndex(filename, data, inode, entries)
+	if err != nil {
+		unix.Munmap(data)
+		return nil, err
+	}
+	index.mapped = true
+	return index, nil
+}
+
+// Writes the content of a .index file, replacing the file if it exists.
+func writeLabelIndex(filename string, data []byte, mode os.FileMode) error {
+	// Other readers may be writing the same index at the same time.
+	file, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpname := file.Name()
+	err = file.Chmod(mode)
+	if err == nil {
+		_, err = file.Write(data)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filename)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+	}
+	return err
+}
+
+func (li *labelIndex) Close() {
+	if li.mapped {
+		unix.Munmap(li.data)
+	}
+	li.data = nil
+}
+
+// Returns the postings of the label at index i, limited to the elements
+// from min to max, excluded.
+func (li *labelIndex) postings(i, min, max int) []uint32 {
+	offset, count := int(getUint32(li.data, li.offset[i])), int(getUint32(li.data, li.offset[i]+4))
+	first := sort.Search(count, func(j int) bool {
+		return int(getUint32(li.data, offset+j*4)) >= min
+	})
+	elements := []uint32{}
+	for j := first; j < count; j++ {
+		element := getUint32(li.data, offset+j*4)
+		if int(element) >= max {
+			break
+		}
+		elements = append(elements, element)
+	}
+	return elements
+}
+
+// Returns the elements from min to max, excluded, with a label
+// matched by the matcher, ignoring the type of the match: for MatchNotEqual,
+// the elements with the label name=value are returned.
+func (li *labelIndex) match(matcher *LabelMatcher, min, max int) []uint32 {
+	elements := []uint32{}
+	// Only the labels starting with the name can match.
+	for i := sort.SearchStrings(li.label, matcher.Name); i < len(li.label) && strings.HasPrefix(li.label[i], matcher.Name); i++ {
+		if matcher.matchesOne(li.label[i]) {
+			elements = mergeElements(elements, li.postings(i, min, max))
+		}
+	}
+	return elements
+}
+
+// Returns the labels of the elements from min to max, excluded.
+func (li *labelIndex) labels(min, max int) []string {
+	labels := []string{}
+	for i, label := range li.label {
+		offset, count := int(getUint32(li.data, li.offset[i])), int(getUint32(li.data, li.offset[i]+4))
+		first := sort.Search(count, func(j int) bool {
+			return int(getUint32(li.data, offset+j*4)) >= min
+		})
+		if first < count && int(getUint32(li.data, offset+first*4)) < max {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// Returns the elements in a or b, sorted.
+func mergeElements(a, b []uint32) []uint32 {
+	merged := make([]uint32, 0, len(a)+len(b))
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) <= 0 || (len(a) > 0 && a[0] < b[0]):
+			merged, a = append(merged, a[0]), a[1:]
+		case len(a) <= 0 || b[0] < a[0]:
+			merged, b = append(merged, b[0]), b[1:]
+		default:
+			merged, a, b = append(merged, a[0]), a[1:], b[1:]
+		}
+	}
+	return merged
+}
+
+// Returns the elements in both a and b, sorted.
+func intersectElements(a, b []uint32) []uint32 {
+	result := []uint32{}
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			a = a[1:]
+		case b[0] < a[0]:
+			b = b[1:]
+		default:
+			result, a, b = append(result, a[0]), a[1:], b[1:]
+		}
+	}
+	return result
+}
+
+// Returns the elements in a and not in b, sorted.
+func subtractElements(a, b []uint32) []uint32 {
+	result := []uint32{}
+	for len(a) > 0 {
+		switch {
+		case len(b) <= 0 || a[0] < b[0]:
+			result, a = append(result, a[0]), a[1:]
+		case b[0] < a[0]:
+			b = b[1:]
+		default:
+			a, b = a[1:], b[1:]
+		}
+	}
+	return result
+}
+
+// Returns the index of the labels of a shard, nil if the shard is still
+// being written. The index is read from the .index file of the shard, or
+// built and saved if the file is missing, or was created for a .data file
+// that has since been replaced.
+func (s *SerieReader) getLabelIndex(shard *shard) (*labelIndex, error) {
+	if shard.labels != nil {
+		return shard.labels, nil
+	}
+	err := shard.Load(s)
+	if err != nil {
+		return nil, err
+	}
+	if shard.IsLast(s) && !shard.dw.IsSealed() {
+		return nil, nil
+	}
+
+	filename := MakeIndexFileName(s.Path, shard.fileid)
+	entries := shard.dw.GetEntries()
+	index, err := openLabelIndex(filename, shard.inode, entries)
+	if err != nil {
+		data, err := buildLabelIndex(shard.dw, shard.ls, shard.inode)
+		if err != nil {
+			return nil, err
+		}
+		// Readers may not be allowed to write the directory, in which
+		// case the index is only kept in memory.
+		if st, err := os.Stat(MakeDataStoreFileName(s.Path, shard.fileid)); err == nil {
+			writeLabelIndex(filename, data, st.Mode().Perm())
+		}
+		index, err = newLabelIndex(filename, data, shard.inode, entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	shard.labels = index
+	return index, nil
+}
+
+// Returns the elements from min to max, excluded, of a shard with labels
+// satisfying the filter, found with the index of the labels of the shard.
+// Returns false if the shard has no index, as it is still being written.
+func (s *SerieReader) matchElements(shard *shard, filter LabelFilter, min, max int) ([]uint32, bool) {
+	index, err := s.getLabelIndex(shard)
+	if err != nil {
+		log.Printf("Could not index the labels of %s, reading all entries: %s", MakeDataStoreFileName(s.Path, shard.fileid), err)
+		return nil, false
+	}
+	if index == nil {
+		return nil, false
+	}
+
+	var matched []uint32
+	positive := false
+	excluded := [][]uint32{}
+	for _, matcher := range filter {
+		elements := index.match(matcher, min, max)
+		switch matcher.Type {
+		case MatchNotEqual, MatchNotRegexp, MatchHasNot:
+			excluded = append(excluded, elements)
+		default:
+			if positive {
+				matched = intersectElements(matched, elements)
+			} else {
+				matched = elements
+			}
+			positive = true
+		}
+	}
+	if !positive {
+		matched = make([]uint32, 0, max-min)
+		for element := min; element < max; element++ {
+			matched = append(matched, uint32(element))
+		}
+	}
+	for _, elements := range excluded {
+		matched = subtractElements(matched, elements)
+	}
+	return matched, true
+}
+
+// Returns the points between start and end with labels satisfying the
+// filter, as GetData would with Filter(filter, summarizer).
+//
+// Shards that are not written anymore are searched with the index of their
+// labels, so only the entries with matching labels are read. The index of
+// a shard is built, and saved in a .index file, the first time it is
+// needed.
+func (s *SerieReader) GetFilteredData(start, end Location, filter LabelFilter, summarizer Summarizer) ([]Point, error) {
+	if len(filter) <= 0 {
+		return s.GetData(start, end, summarizer)
+	}
+	if summarizer == nil {
+		summarizer = func(points []Point, location Location, time, value uint64) []Point {
+			return append(points, Point{time, value, s.GetLabels(location, nil), location.ValueType()})
+		}
+	}
+
+	if !s.hasShard(start.shard) {
+		return []Point{}, fmt.Errorf("Start is now invalid - shard is gone")
+	}
+	if !s.hasShard(end.shard) {
+		return []Point{}, fmt.Errorf("End is now invalid - shard is gone")
+	}
+	if start.shard.index > end.shard.index {
+		return []Point{}, fmt.Errorf("End < Start is invalid")
+	}
+
+	// The points backfilled that GetData would merge between start and end.
+	var backfilled []Point
+	if s.Backfill {
+		err := s.loadBackfill()
+		if err != nil {
+			return []Point{}, err
+		}
+		if len(s.backfilled) > 0 {
+			backfilled = s.backfillRange(start, end)
+		}
+	}
+
+	points := []Point{}
+	merge := func(location Location, time uint64) {
+		for len(backfilled) > 0 && backfilled[0].Time < time {
+			if filter.Matches(backfilled[0].Label) {
+				points = summarizer(points, Location{location.shard, location.element, &backfilled[0]}, backfilled[0].Time, backfilled[0].Value)
+			}
+			backfilled = backfilled[1:]
+		}
+	}
+
+	for cursor := start.shard.index; cursor <= end.shard.index; cursor++ {
+		shard := s.shard[cursor]
+		err := shard.Load(s)
+		if err != nil {
+			continue
+		}
+		min, max := 0, shard.dw.GetEntries()
+		if cursor == start.shard.index {
+			min = start.element
+		}
+		if cursor == end.shard.index {
+			max = end.element
+		}
+
+		elements, indexed := s.matchElements(shard, filter, min, max)
+		if !indexed {
+			elements = make([]uint32, 0, max-min)
+			for element := min; element < max; element++ {
+				elements = append(elements, uint32(element))
+			}
+		}
+		for _, element := range elements {
+			shard.Load(s)
+			offset := shard.dw.GetOffset(int(element))
+			time := shard.dw.GetTime(offset)
+			if time == SealMarker {
+				continue
+			}
+			location := Location{shard, int(element), nil}
+			if !indexed && !filter.Matches(s.GetLabels(location, nil)) {
+				continue
+			}
+			merge(location, time)
+			points = summarizer(points, location, time, shard.dw.GetValue(offset))
+		}
+	}
+	merge(end, SealMarker)
+	return points, nil
+}
+
+// Returns the labels of the points between start and end, sorted, each
+// one once. Shards that are not written anymore are searched with the
+// index of their labels, see GetFilteredData.
+func (s *SerieReader) ListLabels(start, end Location) ([]string, error) {
+	if !s.hasShard(start.shard) {
+		return []string{}, fmt.Errorf("Start is now invalid - shard is gone")
+	}
+	if !s.hasShard(end.shard) {
+		return []string{}, fmt.Errorf("End is now invalid - shard is gone")
+	}
+	if start.shard.index > end.shard.index {
+		return []string{}, fmt.Errorf("End < Start is invalid")
+	}
+
+	found := make(map[string]bool)
+
+	for cursor := start.shard.index; cursor <= end.shard.index; cursor++ {
+		shard := s.shard[cursor]
+		err := shard.Load(s)
+		if err != nil {
+			continue
+		}
+		min, max := 0, shard.dw.GetEntries()
+		if cursor == start.shard.index {
+			min = start.element
+		}
+		if cursor == end.shard.index {
+			max = end.element
+		}
+
+		index, err := s.getLabelIndex(shard)
+		if err != nil {
+			log.Printf("Could not index the labels of %s, reading all entries: %s", MakeDataStoreFileName(s.Path, shard.fileid), err)
+		}
+		if index != nil {
+			for _, label := range index.labels(min, max) {
+				found[label] = true
+			}
+			continue
+		}
+		for element := min; element < max; element++ {
+			for _, label := range s.GetLabels(Location{shard, element, nil}, nil) {
+				found[label] = true
+			}
+		}
+	}
+
+	if s.Backfill {
+		err := s.loadBackfill()
+		if err != nil {
+			return []string{}, err
+		}
+	}
+	if s.Backfill && len(s.backfilled) > 0 {
+		for _, point := range s.backfillRange(start, end) {
+			for _, label := range point.Label {
+				found[label] = true
+			}
+		}
+	}
+
+	labels := make([]string, 0, len(found))
+	for label := range found {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels, nil
+}
@@ -0,0 +1,118 @@
+package tsdb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestLabelIndex(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.LabelsPerEntry = 2
+	s.OutOfOrder = OutOfOrderBackfill
+	err = s.Open()
+	assert.Nil(t, err)
+	defer s.Close()
+	for i := uint64(10); i < 10000; i += 10 {
+		labels := []string{fmt.Sprintf("host=web%d", i%7)}
+		if i%30 == 0 {
+			labels = append(labels, "canary")
+		}
+		if i%1000 == 0 {
+			labels = nil
+		}
+		assert.Nil(t, s.Append(i, i, labels))
+	}
+	assert.Nil(t, s.Append(15, 15, []string{"host=web1", "late"}))
+	assert.Nil(t, s.Append(5005, 5005, []string{"host=db1"}))
+
+	r := NewSerieReader(s.Path)
+	r.MaxLoadedShards = 2
+	defer r.Close()
+	assert.Nil(t, r.Open())
+	files := GetDataFiles(s.Path)
+	assert.True(t, len(files) > 3)
+
+	ranges := [][2]uint64{{0, 100000}, {15, 5005}, {3333, 7777}, {9990, 100000}}
+	for _, expressions := range [][]string{
+		{"host=web1"}, {"host=~web[12]"}, {"canary"}, {"!canary"}, {"host!=web1"},
+		{"host=web1", "!canary"}, {"host=web3", "canary"}, {"host!~web.*"}, {"late"}, {"rack"},
+	} {
+		filter, err := ParseLabelFilter(expressions)
+		assert.Nil(t, err)
+		for _, times := range ranges {
+			start := r.Find(func(time uint64) bool { return time >= times[0] })
+			end := r.Find(func(time uint64) bool { return time > times[1] })
+			expected, err := r.GetData(start, end, r.Filter(filter, nil))
+			assert.Nil(t, err)
+			points, err := r.GetFilteredData(start, end, filter, nil)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, points, "%v in %v", expressions, times)
+		}
+	}
+
+	// Only the shard being written has no index.
+	for _, file := range files {
+		_, err := os.Stat(MakeIndexFileName(s.Path, ParseFileName(s.Path, file)))
+		assert.Equal(t, file != files[len(files)-1], err == nil, file)
+	}
+
+	// Only the entries with the label are read from an indexed shard.
+	filter, err := ParseLabelFilter([]string{"host=web1"})
+	assert.Nil(t, err)
+	shard := r.shard[1]
+	elements, indexed := r.matchElements(shard, filter, 0, shard.GetElements(r))
+	assert.True(t, indexed)
+	assert.True(t, len(elements) > 0 && len(elements) <= shard.GetElements(r)/7+1, "%d", len(elements))
+
+	for _, times := range ranges {
+		start := r.Find(func(time uint64) bool { return time >= times[0] })
+		end := r.Find(func(time uint64) bool { return time > times[1] })
+		found := make(map[string]bool)
+		_, err := r.GetData(start, end, func(points []Point, location Location, time, value uint64) []Point {
+			for _, label := range r.GetLabels(location, nil) {
+				found[label] = true
+			}
+			return points
+		})
+		assert.Nil(t, err)
+		expected := []string{}
+		for label := range found {
+			expected = append(expected, label)
+		}
+		sort.Strings(expected)
+		labels, err := r.ListLabels(start, end)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, labels, "%v", times)
+	}
+
+	// Indexes that are invalid, or for a different file, are built again.
+	first := ParseFileName(s.Path, files[0])
+	assert.Nil(t, ioutil.WriteFile(MakeIndexFileName(s.Path, first), []byte("garbage"), 0644))
+	assert.Nil(t, ioutil.WriteFile(MakeIndexFileName(s.Path, first+1), make([]byte, 64), 0644))
+	other := NewSerieReader(s.Path)
+	defer other.Close()
+	expected, err := r.GetData(r.FirstLocation(), r.LastLocation(), r.Filter(filter, nil))
+	assert.Nil(t, err)
+	points, err := other.GetFilteredData(other.FirstLocation(), other.LastLocation(), filter, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, points)
+	raw, err := ioutil.ReadFile(MakeIndexFileName(s.Path, first))
+	assert.Nil(t, err)
+	assert.Equal(t, indexMagic, string(raw[:4]))
+
+	// Indexes are removed with their shards.
+	assert.Nil(t, RemoveShard(s.Path, first))
+	_, err = os.Stat(MakeIndexFileName(s.Path, first))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,246 @@
+package tsdb
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Labels are free form strings. By convention, a label in the form
+// name=value associates a value to a name, while a label without = is
+// a name with an empty value.
+//
+// Returns the name and the value of a label.
+func SplitLabel(label string) (name, value string) {
+	index := strings.Index(label, "=")
+	if index < 0 {
+		return label, ""
+	}
+	return label[:index], label[index+1:]
+}
+
+type MatchType int
+
+const (
+	// A label name=value must be present.
+	MatchEqual MatchType = iota
+	// A label name=value must not be present.
+	MatchNotEqual
+	// A label name=something must be present, with something matching the regexp.
+	MatchRegexp
+	// No label name=something, with something matching the regexp, must be present.
+	MatchNotRegexp
+	// A label with the name must be present, regardless of its value.
+	MatchHas
+	// No label with the name must be present.
+	MatchHasNot
+)
+
+var matchOperators = map[MatchType]string{
+	MatchEqual:     "=",
+	MatchNotEqual:  "!=",
+	MatchRegexp:    "=~",
+	MatchNotRegexp: "!~",
+}
+
+// A LabelMatcher checks if the labels associated to a point satisfy a condition.
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+func NewLabelMatcher(mt MatchType, name, value string) (*LabelMatcher, error) {
+	if name == "" || strings.ContainsAny(name, "=!~") {
+		return nil, fmt.Errorf("invalid label name '%s'", name)
+	}
+
+	matcher := &LabelMatcher{mt, name, value, nil}
+	switch mt {
+	case MatchEqual, MatchNotEqual:
+	case MatchHas, MatchHasNot:
+		matcher.Value = ""
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		matcher.re = re
+	default:
+		return nil, fmt.Errorf("invalid match type %d", mt)
+	}
+	return matcher, nil
+}
+
+// Parses an expression like name=value, name!=value, name=~regexp,
+// name!~regexp, name (label must be present), or !name (label must be
+// absent) into a LabelMatcher.
+func ParseLabelMatcher(expression string) (*LabelMatcher, error) {
+	index := strings.IndexAny(expression, "=!")
+	if index < 0 {
+		return NewLabelMatcher(MatchHas, expression, "")
+	}
+	if index == 0 && expression[0] == '!' && !strings.ContainsAny(expression[1:], "=!~") {
+		return NewLabelMatcher(MatchHasNot, expression[1:], "")
+	}
+
+	name, operator := expression[:index], expression[index:]
+	for _, mt := range []MatchType{MatchNotEqual, MatchRegexp, MatchNotRegexp, MatchEqual} {
+		if strings.HasPrefix(operator, matchOperators[mt]) {
+			return NewLabelMatcher(mt, name, operator[len(matchOperators[mt]):])
+		}
+	}
+	return nil, fmt.Errorf("invalid label expression '%s'", expression)
+}
+
+func (m *LabelMatcher) String() string {
+	switch m.Type {
+	case MatchHas:
+		return m.Name
+	case MatchHasNot:
+		return "!" + m.Name
+	}
+	return m.Name + matchOperators[m.Type] + m.Value
+}
+
+func (m *LabelMatcher) matchesOne(label string) bool {
+	name, value := SplitLabel(label)
+	if name != m.Name {
+		return false
+	}
+
+	switch m.Type {
+	case MatchEqual, MatchNotEqual:
+		return value == m.Value
+	case MatchRegexp, MatchNotRegexp:
+		return m.re.MatchString(value)
+	}
+	return true
+}
+
+// Returns true if the labels satisfy the matcher.
+func (m *LabelMatcher) Matches(labels []string) bool {
+	found := false
+	for _, label := range labels {
+		if m.matchesOne(label) {
+			found = true
+			break
+		}
+	}
+
+	switch m.Type {
+	case MatchNotEqual, MatchNotRegexp, MatchHasNot:
+		return !found
+	}
+	return found
+}
+
+// A LabelFilter is satisfied when all of its matchers are.
+type LabelFilter []*LabelMatcher
+
+func ParseLabelFilter(expressions []string) (LabelFilter, error) {
+	filter := LabelFilter{}
+	for _, expression := range expressions {
+		matcher, err := ParseLabelMatcher(expression)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, matcher)
+	}
+	return filter, nil
+}
+
+func (lf LabelFilter) Matches(labels []string) bool {
+	for _, matcher := range lf {
+		if !matcher.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the value of the first label with the specified name, and
+// true if one was found.
+func GetLabelValue(labels []string, name string) (string, bool) {
+	for _, label := range labels {
+		lname, value := SplitLabel(label)
+		if lname == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// Returns a Summarizer that only passes the points whose labels satisfy
+// the filter to the specified summarizer. If summarizer is nil, the points
+// are returned as they are, with their labels.
+func (s *SerieReader) Filter(filter LabelFilter, summarizer Summarizer) Summarizer {
+	return func(points []Point, location Location, time, value uint64) []Point {
+		labels := s.GetLabels(location, nil)
+		if !filter.Matches(labels) {
+			return points
+		}
+		if summarizer == nil {
+			return append(points, Point{time, value, labels, location.ValueType()})
+		}
+		return summarizer(points, location, time, value)
+	}
+}
+
+// A set of points sharing the same value for a label.
+type Group struct {
+	// Value of the label, "" for points that do not have the label.
+	Value string  `json:"value"`
+	Point []Point `json:"point"`
+}
+
+// Returns the points between start and end satisfying the filter, split
+// in one Group per distinct value of the label name. If a point has
+// more labels with the same name, only the first one is considered.
+//
+// newSummarizer is invoked to create a Summarizer for each group. If it
+// is nil, or returns nil, the points are returned as they are.
+//
+// Groups are sorted by value.
+func (s *SerieReader) GetGroupedData(start, end Location, name string, filter LabelFilter, newSummarizer func() Summarizer) ([]Group, error) {
+	type group struct {
+		points     []Point
+		summarizer Summarizer
+	}
+	groups := make(map[string]*group)
+
+	_, err := s.GetFilteredData(start, end, filter, func(points []Point, location Location, time, value uint64) []Point {
+		labels := s.GetLabels(location, nil)
+		key, _ := GetLabelValue(labels, name)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{[]Point{}, nil}
+			if newSummarizer != nil {
+				g.summarizer = newSummarizer()
+			}
+			groups[key] = g
+		}
+
+		if g.summarizer == nil {
+			g.points = append(g.points, Point{time, value, labels, location.ValueType()})
+		} else {
+			g.points = g.summarizer(g.points, location, time, value)
+		}
+		return points
+	})
+	if err != nil {
+		return []Group{}, err
+	}
+
+	result := make([]Group, 0, len(groups))
+	for key, g := range groups {
+		result = append(result, Group{key, g.points})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Value < result[j].Value
+	})
+	return result, nil
+}
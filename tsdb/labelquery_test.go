@@ -0,0 +1,111 @@
+package tsdb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLabelMatchers(t *testing.T) {
+	labels := []string{"host=web1", "dc=us-east", "canary"}
+
+	expected := map[string]bool{
+		"host=web1":      true,
+		"host=web2":      false,
+		"host!=web1":     false,
+		"host!=web2":     true,
+		"host=~web.*":    true,
+		"host=~eb1":      false,
+		"host!~db.*":     true,
+		"host!~web[0-9]": false,
+		"canary":         true,
+		"!canary":        false,
+		"dc":             true,
+		"rack":           false,
+		"!rack":          true,
+		"rack!=r1":       true,
+		"canary=":        true,
+	}
+	for expression, result := range expected {
+		matcher, err := ParseLabelMatcher(expression)
+		assert.Nil(t, err, expression)
+		assert.Equal(t, result, matcher.Matches(labels), expression)
+		assert.Equal(t, expression, matcher.String())
+	}
+
+	for _, expression := range []string{"", "=web1", "host!web1", "host=~(", "!"} {
+		_, err := ParseLabelMatcher(expression)
+		assert.NotNil(t, err, expression)
+	}
+
+	filter, err := ParseLabelFilter([]string{"host=~web.*", "!rack"})
+	assert.Nil(t, err)
+	assert.True(t, filter.Matches(labels))
+	filter, err = ParseLabelFilter([]string{"host=~web.*", "rack"})
+	assert.Nil(t, err)
+	assert.False(t, filter.Matches(labels))
+	assert.True(t, LabelFilter{}.Matches(labels))
+}
+
+func TestGroupedData(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := uint64(0); i < 600; i++ {
+		labels := []string{fmt.Sprintf("host=web%d", i%3)}
+		if i%10 == 0 {
+			labels = append(labels, "canary")
+		}
+		if i%100 == 0 {
+			labels = []string{}
+		}
+		err := s.Append(i, i, labels)
+		assert.Nil(t, err)
+	}
+	s.Close()
+
+	r := NewSerieReader(filepath.Join(tempdir, "test"))
+	err = r.Open()
+	assert.Nil(t, err)
+
+	filter, err := ParseLabelFilter([]string{"host=web1", "!canary"})
+	assert.Nil(t, err)
+	data, err := r.GetData(r.FirstLocation(), r.LastLocation(), r.Filter(filter, nil))
+	assert.Nil(t, err)
+	assert.Equal(t, 180, len(data))
+	for _, point := range data {
+		assert.Equal(t, uint64(1), point.Time%3)
+		assert.NotEqual(t, uint64(0), point.Time%10)
+		assert.Equal(t, []string{"host=web1"}, point.Label)
+	}
+
+	groups, err := r.GetGroupedData(r.FirstLocation(), r.LastLocation(), "host", LabelFilter{}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(groups))
+	assert.Equal(t, "", groups[0].Value)
+	assert.Equal(t, 6, len(groups[0].Point))
+	for i, group := range groups[1:] {
+		assert.Equal(t, fmt.Sprintf("web%d", i), group.Value)
+		assert.Equal(t, 198, len(group.Point))
+	}
+
+	filter, err = ParseLabelFilter([]string{"canary"})
+	assert.Nil(t, err)
+	groups, err = r.GetGroupedData(r.FirstLocation(), r.LastLocation(), "host", filter, func() Summarizer {
+		summarizer, _ := NewSummarizer("count", 1000)
+		return summarizer
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(groups))
+	for _, group := range groups {
+		assert.Equal(t, 1, len(group.Point))
+		assert.Equal(t, uint64(18), group.Point[0].Value)
+	}
+}
@@ -13,22 +13,56 @@ import (
 type LabelOptions struct {
 	Mode       os.FileMode
 	LabelBlock int
+	// When to msync the file to disk. DurabilitySeal by default.
+	// With any policy but DurabilityNone, labels created are also synced
+	// before the first entry referencing them is appended, see SyncCreated.
+	Durability Durability
+	// If true, the file is locked in memory with mlock while open.
+	Mlock bool
 }
 
+// Identifies a label in a .labels file. 0 means no label.
 type LabelID uint32
 
+// Format of a .labels file:
+//   [ 0 -  7] - 8 bytes - common header, with magic "TSLB", see header.go.
+//   [ 8 - 11] - 4 bytes - uint32 - LabelBlock requested when the file was created.
+//   [12 - 31] - 20 bytes - unused
+//   [32 - ..] - x bytes - labels, each one aligned to 8 bytes.
+//
+// Format of a label:
+//   [ 0 -  3] - 4 bytes - uint32 - length of the label, 0 if this is the end of the labels.
+//   [ 4 - ..] - x bytes - the label itself.
+//
+// The LabelID of a label is its offset from the end of the header, plus 1.
+
+func labelOffset(label LabelID) int {
+	return int(label) - 1 + GetHeaderSize()
+}
+
+func offsetLabel(offset int) LabelID {
+	return LabelID(offset - GetHeaderSize() + 1)
+}
+
 type LabelStore struct {
 	fullpath string
 	raw      []byte
 
 	cache  map[string]LabelID
-	offset int // Initialized by reloadCache
+	offset int // Updated by reloadCache
 
 	blocksize int
+
+	durability Durability
+	// True if labels were created since the last Sync.
+	dirty bool
+	mlock bool
+	// False if raw was converted in memory from a file with a different byte order.
+	mapped bool
 }
 
 func DefaultLabelOptions() LabelOptions {
-	return LabelOptions{0666, 4 * 1048576}
+	return LabelOptions{0666, 4 * 1048576, DurabilitySeal, false}
 }
 
 func (lo LabelOptions) Valid() error {
@@ -41,21 +75,73 @@ func (lo LabelOptions) Valid() error {
 	if lo.LabelBlock < 128 {
 		return fmt.Errorf("LabelBlock size is too small - needs to be >= 128")
 	}
-	return nil
+	return lo.Durability.Valid()
 }
 
 func OpenLabelsForReading(fullpath string) (*LabelStore, error) {
+	return openLabelsForReading(fullpath, false)
+}
+
+// Like OpenLabelsForReading, but locks the mapping in memory if mlock is true.
+func openLabelsForReading(fullpath string, mlock bool) (*LabelStore, error) {
 	file, err := os.OpenFile(fullpath, os.O_RDONLY, 0666)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
-	data, err := mmapFile(file, syscall.PROT_READ)
+	data, err := mmapFile(file, syscall.PROT_READ, mlock)
 	if len(data) <= 0 {
 		return nil, err
 	}
+	// Files without header are converted in memory.
+	if !hasMagic(data, labelsMagic) {
+		converted, err := upgradeLabelStore(fullpath, data)
+		syscall.Munmap(data)
+		if err != nil {
+			return nil, err
+		}
+		return &LabelStore{fullpath, converted, nil, GetHeaderSize(), 0, DurabilityNone, false, false, false}, nil
+	}
+	swap, err := checkHeader(fullpath, data, labelsMagic)
+	if err != nil {
+		syscall.Munmap(data)
+		return nil, err
+	}
+	if swap {
+		converted := swapLabelStore(data)
+		syscall.Munmap(data)
+		return &LabelStore{fullpath, converted, nil, GetHeaderSize(), 0, DurabilityNone, false, false, false}, nil
+	}
+
+	return &LabelStore{fullpath, data, nil, GetHeaderSize(), 0, DurabilityNone, false, mlock, true}, nil
+}
+
+// Creates an empty .labels file. The header is written before the file is
+// renamed in place, so readers never find a file without it.
+func createLabelsFile(fullpath string, options LabelOptions) error {
+	tmpname := fullpath + ".tmp"
+	os.Remove(tmpname)
+	file, err := os.OpenFile(tmpname, os.O_RDWR|os.O_CREATE|os.O_EXCL, options.Mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-	return &LabelStore{fullpath, data, nil, 0, 0}, nil
+	header := make([]byte, GetHeaderSize())
+	writeHeader(header, labelsMagic)
+	*(*uint32)(unsafe.Pointer(&header[8])) = uint32(options.LabelBlock)
+	_, err = file.WriteAt(header, 0)
+	if err == nil {
+		err = file.Truncate(int64(MultipleOfPageSize(options.LabelBlock)))
+	}
+	if err == nil {
+		err = os.Rename(tmpname, fullpath)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+	}
+	return err
 }
 
 func OpenLabelsForWriting(fullpath string, options LabelOptions) (*LabelStore, error) {
@@ -65,27 +151,31 @@ func OpenLabelsForWriting(fullpath string, options LabelOptions) (*LabelStore, e
 	}
 
 	file, err := os.OpenFile(fullpath, os.O_RDWR, options.Mode)
-	if err != nil {
-		file, err = os.Create(fullpath)
-		if err != nil {
-			return nil, err
-		}
-		defer file.Close()
-
-		err = file.Truncate(int64(MultipleOfPageSize(options.LabelBlock)))
-		if err != nil {
-			return nil, err
+	if os.IsNotExist(err) {
+		err = createLabelsFile(fullpath, options)
+		if err == nil {
+			file, err = os.OpenFile(fullpath, os.O_RDWR, options.Mode)
 		}
-	} else {
-		defer file.Close()
 	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 
-	data, err := mmapFile(file, syscall.PROT_WRITE)
+	data, err := mmapFile(file, syscall.PROT_WRITE, options.Mlock)
 	if len(data) <= 0 {
 		return nil, err
 	}
+	swap, err := checkHeader(fullpath, data, labelsMagic)
+	if err != nil || swap {
+		syscall.Munmap(data)
+		if swap {
+			return nil, ErrByteOrder
+		}
+		return nil, err
+	}
 
-	return &LabelStore{fullpath, data, nil, 0, options.LabelBlock}, nil
+	return &LabelStore{fullpath, data, nil, GetHeaderSize(), options.LabelBlock, options.Durability, false, options.Mlock, true}, nil
 }
 
 func (ls *LabelStore) reloadCache() error {
@@ -94,7 +184,7 @@ func (ls *LabelStore) reloadCache() error {
 	}
 
 	for offset := ls.offset; offset < len(ls.raw); {
-		label := LabelID(offset + 1)
+		label := offsetLabel(offset)
 		name, err := ls.LoadString(label)
 		if err != nil {
 			return err
@@ -111,7 +201,7 @@ func (ls *LabelStore) reloadCache() error {
 }
 
 func (ls *LabelStore) LoadString(label LabelID) (string, error) {
-	offset := int(label) - 1
+	offset := labelOffset(label)
 	if offset+4 >= len(ls.raw) {
 		return "", fmt.Errorf("Label points outside the file - invalid")
 	}
@@ -128,8 +218,20 @@ func (ls *LabelStore) LoadString(label LabelID) (string, error) {
 	return string(ls.raw[offset+4 : offset+4+int(strsize)]), nil
 }
 
+// Waits for the file to be written to disk.
 func (ds *LabelStore) Sync() {
 	unix.Msync(ds.raw, unix.MS_SYNC|unix.MS_INVALIDATE)
+	ds.dirty = false
+}
+
+// Waits for the labels created since the last sync to be on disk, unless
+// the durability is DurabilityNone. Must be called before appending data
+// entries referencing new labels, so after a crash an entry never points
+// to label space that was not written.
+func (ls *LabelStore) SyncCreated() {
+	if ls.dirty && ls.durability != DurabilityNone {
+		ls.Sync()
+	}
 }
 
 func (ls *LabelStore) Seal() {
@@ -137,7 +239,7 @@ func (ls *LabelStore) Seal() {
 	if err != nil {
 		file, err := os.OpenFile(ls.fullpath, os.O_RDWR, 0666)
 		if err != nil {
-			file.Truncate(int64(MultipleOfPageSize(int(id) + 4 - 1)))
+			file.Truncate(int64(MultipleOfPageSize(labelOffset(id) + 4)))
 			file.Close()
 		}
 	}
@@ -145,7 +247,17 @@ func (ls *LabelStore) Seal() {
 }
 
 func (ls *LabelStore) Close() {
-	ls.Sync()
+	if !ls.mapped {
+		ls.raw = nil
+		ls.cache = nil
+		return
+	}
+	switch ls.durability {
+	case DurabilityAsync:
+		unix.Msync(ls.raw, unix.MS_ASYNC)
+	case DurabilityPeriodic, DurabilitySeal:
+		ls.Sync()
+	}
 	syscall.Munmap(ls.raw)
 	ls.cache = nil
 }
@@ -163,7 +275,7 @@ func (ls *LabelStore) resizeFile(extrasize int) error {
 	defer file.Close()
 	file.Truncate(int64(MultipleOfPageSize(newsize)))
 
-	newraw, err := mmapFile(file, syscall.PROT_WRITE)
+	newraw, err := mmapFile(file, syscall.PROT_WRITE, ls.mlock)
 	if err != nil {
 		return err
 	}
@@ -194,10 +306,11 @@ func (ls *LabelStore) CreateLabel(name string) (LabelID, error) {
 		}
 	}
 
-	label = LabelID(ls.offset + 1)
+	label = offsetLabel(ls.offset)
 	copy(ls.raw[ls.offset+4:], []byte(name))
 	atomic.StoreUint32((*uint32)(unsafe.Pointer(&ls.raw[ls.offset])), uint32(len(name)))
 	ls.offset += (4 + len(name) + 7) / 8 * 8
 	ls.cache[name] = label
+	ls.dirty = true
 	return label, nil
 }
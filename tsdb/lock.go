@@ -0,0 +1,101 @@
+package tsdb
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned when a serie is already owned by a writer in another process.
+type LockedError struct {
+	Path string
+	// Pid of the process holding the lock, 0 if unknown.
+	Pid int
+}
+
+func (e *LockedError) Error() string {
+	if e.Pid <= 0 {
+		return fmt.Sprintf("serie %s is locked by another process", e.Path)
+	}
+	return fmt.Sprintf("serie %s is locked by pid %d", e.Path, e.Pid)
+}
+
+// How often to retry acquiring a lock when waiting for it.
+var lockRetryInterval = 20 * time.Millisecond
+
+func MakeLockFileName(dbbasepath string) string {
+	return dbbasepath + ".lock"
+}
+
+// An advisory lock granting ownership of a serie to a single writer.
+//
+// The lock is an flock() on a .lock file next to the shards of the serie,
+// containing the pid of the owner. The file is never removed, as removing
+// it would allow two processes to lock different files with the same name.
+type SerieLock struct {
+	file *os.File
+}
+
+// Acquires the lock on a serie. If the serie is locked by someone else,
+// retries until timeout expires. A timeout of 0 returns immediately, a
+// negative timeout waits forever.
+//
+// Returns a *LockedError if the lock could not be acquired in time.
+func LockSerie(dbbasepath string, mode os.FileMode, timeout time.Duration) (*SerieLock, error) {
+	filename := MakeLockFileName(dbbasepath)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != unix.EWOULDBLOCK && err != unix.EINTR {
+			file.Close()
+			return nil, &os.PathError{Op: "flock", Path: filename, Err: err}
+		}
+		if timeout >= 0 && !time.Now().Before(deadline) {
+			pid := readLockPid(filename)
+			file.Close()
+			return nil, &LockedError{dbbasepath, pid}
+		}
+		time.Sleep(lockRetryInterval)
+	}
+
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt(pid, 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &SerieLock{file}, nil
+}
+
+func readLockPid(filename string) int {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// Releases the lock. Closing the file releases the flock.
+func (l *SerieLock) Unlock() {
+	l.file.Truncate(0)
+	l.file.Close()
+}
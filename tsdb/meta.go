@@ -0,0 +1,128 @@
+package tsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// What a serie measures, so clients know how to display it.
+type MetricKind string
+
+const (
+	// Unknown, the default.
+	KindUnknown MetricKind = ""
+	// A value that only increases, except when reset. Generally displayed
+	// as a rate.
+	KindCounter MetricKind = "counter"
+	// A value that can go up and down, displayed as is.
+	KindGauge MetricKind = "gauge"
+	// A distribution of values, one serie per bucket.
+	KindHistogram MetricKind = "histogram"
+)
+
+func (k MetricKind) Valid() error {
+	switch k {
+	case KindUnknown, KindCounter, KindGauge, KindHistogram:
+		return nil
+	}
+	return fmt.Errorf("invalid metric kind '%s' - must be counter, gauge or histogram", string(k))
+}
+
+// Describes the content of a serie. Stored as json in a .meta file next
+// to the shards of the serie, see MakeMetaFileName.
+type SerieMeta struct {
+	// Unit of the values, like "bytes", or "ms".
+	Unit        string     `json:"unit,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Kind        MetricKind `json:"kind,omitempty"`
+	// Duration of a unit of time of the points, in nanoseconds in json.
+	// For example, 1000000000 if times are in seconds. 0 if unknown.
+	Resolution time.Duration `json:"resolution,omitempty"`
+}
+
+func (m SerieMeta) Valid() error {
+	if m.Resolution < 0 {
+		return fmt.Errorf("invalid resolution %s - cannot be negative", m.Resolution)
+	}
+	return m.Kind.Valid()
+}
+
+func MakeMetaFileName(dbbasepath string) string {
+	return dbbasepath + ".meta"
+}
+
+// Returns the metadata of a serie. A serie without a .meta file has
+// empty metadata.
+func ReadSerieMeta(dbbasepath string) (SerieMeta, error) {
+	meta := SerieMeta{}
+	data, err := ioutil.ReadFile(MakeMetaFileName(dbbasepath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return meta, fmt.Errorf("invalid metadata in %s: %s", MakeMetaFileName(dbbasepath), err)
+	}
+	return meta, nil
+}
+
+// Replaces the metadata of a serie. The file is replaced atomically, so
+// readers see either the old or the new metadata. Should only be called
+// by the owner of the lock of the serie, see SerieWriter.SetMeta.
+func WriteSerieMeta(dbbasepath string, meta SerieMeta, mode os.FileMode) error {
+	err := meta.Valid()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	filename := MakeMetaFileName(dbbasepath)
+	tmpname := filename + ".tmp"
+	file, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filename)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+	}
+	return err
+}
+
+// Returns the metadata of the serie.
+func (s *SerieWriter) Meta() (SerieMeta, error) {
+	return ReadSerieMeta(s.Path)
+}
+
+// Replaces the metadata of the serie, creating the .meta file if it does
+// not exist. The writer must be open.
+func (s *SerieWriter) SetMeta(meta SerieMeta) error {
+	if s.lock == nil {
+		return fmt.Errorf("serie %s is not open for writing", s.Path)
+	}
+	return WriteSerieMeta(s.Path, meta, s.DataStoreOptions.Mode)
+}
+
+// Returns the metadata of the serie, read again at each call, so changes
+// made by the writer are seen right away.
+func (s *SerieReader) Meta() (SerieMeta, error) {
+	return ReadSerieMeta(s.Path)
+}
@@ -0,0 +1,69 @@
+package tsdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSerieMeta(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	err = s.SetMeta(SerieMeta{"bytes", "", KindCounter, 0})
+	assert.NotNil(t, err)
+
+	// A serie without metadata has empty metadata.
+	r := NewSerieReader(s.Path)
+	defer r.Close()
+	meta, err := r.Meta()
+	assert.Nil(t, err)
+	assert.Equal(t, SerieMeta{}, meta)
+
+	// The first Open creates the metadata.
+	initial := SerieMeta{"", "", KindGauge, time.Millisecond}
+	s.InitialMeta = &initial
+	err = s.Open()
+	assert.Nil(t, err)
+	assert.Nil(t, s.Append(1, 1, nil))
+	meta, err = r.Meta()
+	assert.Nil(t, err)
+	assert.Equal(t, initial, meta)
+
+	expected := SerieMeta{"bytes", "Bytes received", KindCounter, time.Second}
+	assert.Nil(t, s.SetMeta(expected))
+	meta, err = r.Meta()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, meta)
+
+	// Invalid metadata is refused, and the file left unchanged.
+	err = s.SetMeta(SerieMeta{"bytes", "", MetricKind("summary"), 0})
+	assert.NotNil(t, err)
+	err = s.SetMeta(SerieMeta{"bytes", "", KindGauge, -time.Second})
+	assert.NotNil(t, err)
+	meta, err = s.Meta()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, meta)
+	s.Close()
+
+	// Opening the serie again keeps the metadata.
+	assert.Nil(t, s.Open())
+	s.Close()
+	meta, err = r.Meta()
+	assert.Nil(t, err)
+	assert.Equal(t, expected, meta)
+
+	// The .meta file is not mistaken for a serie or a shard.
+	assert.Equal(t, []string{s.Path}, GetSeries(tempdir))
+	assert.Equal(t, 1, len(GetDataFiles(s.Path)))
+
+	err = ioutil.WriteFile(MakeMetaFileName(s.Path), []byte("{"), 0666)
+	assert.Nil(t, err)
+	_, err = r.Meta()
+	assert.NotNil(t, err)
+}
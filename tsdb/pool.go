@@ -0,0 +1,302 @@
+package tsdb
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returns an error if name cannot be used as the name of a serie in a
+// directory, as it would create files outside of it, or hidden files.
+//
+// Names can contain / to store series in subdirectories, like web1/cpu.
+func ValidSerieName(name string) error {
+	if strings.ContainsAny(name, "\\\x00") {
+		return fmt.Errorf("invalid serie name '%s'", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || strings.HasPrefix(part, ".") {
+			return fmt.Errorf("invalid serie name '%s'", name)
+		}
+	}
+	return nil
+}
+
+type pooledWriter struct {
+	name   string
+	lock   sync.Mutex
+	writer *SerieWriter
+	// Position in the list of open writers, nil if not in the list.
+	open *list.Element
+	// Number of appends using the writer, protected by the lock of the pool.
+	users int
+	// When the writer was last used, protected by the lock of the pool.
+	used time.Time
+}
+
+// Default number of writers a WriterPool keeps open.
+const DefaultMaxOpenWriters = 256
+
+// Default time after which CloseIdle closes a writer not written to.
+const DefaultMaxIdle = time.Minute
+
+// A WriterPool keeps a SerieWriter open for each serie written to in a
+// directory, so points can be appended to many series concurrently.
+//
+// Writers are opened on first use, creating the serie if it does not exist,
+// and remain open, and locked, until Close is called, until they are the
+// least recently used past MaxOpenWriters, or until CloseIdle finds them
+// unused for MaxIdle.
+//
+// As long as a writer is open, other processes cannot write to the serie,
+// like tsdb-cli adding values, repairing or upgrading it. Call CloseIdle
+// periodically to let them in once the serie is not written to anymore.
+type WriterPool struct {
+	// Directory containing the series.
+	Path string
+
+	// Options used to open the writers. The ValueType of a new serie is
+	// the type of the first point appended, an existing serie keeps the
+	// type of its last shard.
+	DataStoreOptions
+	LabelOptions
+	RetentionOptions
+	LockTimeout time.Duration
+	OutOfOrder  OutOfOrderPolicy
+	// Metadata of the series created by the pool.
+	InitialMeta SerieMeta
+	// Maximum number of writers to keep open. Each one keeps the shard
+	// being written mapped in memory, and the serie locked. The least
+	// recently used are closed past this number, and opened again when
+	// written to. 0 for no limit.
+	MaxOpenWriters int
+	// How long a writer can remain unused before CloseIdle closes it,
+	// releasing the lock on the serie. 0 to keep writers open.
+	MaxIdle time.Duration
+
+	lock sync.Mutex
+	// Writers open, or being used, by name of the serie.
+	writers map[string]*pooledWriter
+	// Writers open, most recently used first.
+	open *list.List
+}
+
+func NewWriterPool(path string) *WriterPool {
+	return &WriterPool{path, DefaultDataStoreOptions(), DefaultLabelOptions(), DefaultRetentionOptions(), 0, OutOfOrderAllow, SerieMeta{}, DefaultMaxOpenWriters, DefaultMaxIdle, sync.Mutex{}, make(map[string]*pooledWriter), list.New()}
+}
+
+func (p *WriterPool) get(name string) (*pooledWriter, error) {
+	err := ValidSerieName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pw, ok := p.writers[name]
+	if !ok {
+		pw = &pooledWriter{name: name}
+		p.writers[name] = pw
+	}
+	pw.users += 1
+	return pw, nil
+}
+
+// Removes the writer from the pool, if closed and not used anymore.
+// Must be invoked with the lock of the pool held.
+func (p *WriterPool) prune(pw *pooledWriter) {
+	if pw.users <= 0 && pw.open == nil && p.writers[pw.name] == pw {
+		delete(p.writers, pw.name)
+	}
+}
+
+// Appends the points to the serie name, creating it if necessary.
+// Points are appended in a batch, as with SerieWriter.AppendBatch.
+func (p *WriterPool) Append(name string, points []Point) error {
+	if len(points) <= 0 {
+		return nil
+	}
+	pw, err := p.get(name)
+	if err != nil {
+		return err
+	}
+	open, err := p.append(pw, name, points)
+	p.evict(pw, open)
+	return err
+}
+
+// Appends the points with the writer, opening it if necessary. Returns
+// true if the writer is open.
+func (p *WriterPool) append(pw *pooledWriter, name string, points []Point) (bool, error) {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	if pw.writer == nil {
+		writer := NewSerieWriter(filepath.Join(p.Path, name))
+		writer.DataStoreOptions = p.DataStoreOptions
+		writer.LabelOptions = p.LabelOptions
+		writer.RetentionOptions = p.RetentionOptions
+		writer.LockTimeout = p.LockTimeout
+		writer.OutOfOrder = p.OutOfOrder
+		meta := p.InitialMeta
+		writer.InitialMeta = &meta
+
+		writer.ValueType = points[0].Type
+		if last := GetLastFile(writer.Path); last != "" {
+			point, _, err := PeekDataStore(last)
+			if err != nil {
+				return false, err
+			}
+			writer.ValueType = point.Type
+		}
+
+		err := os.MkdirAll(filepath.Dir(writer.Path), 0777)
+		if err != nil {
+			return false, err
+		}
+		err = writer.Open()
+		if err != nil {
+			return false, err
+		}
+		pw.writer = writer
+	}
+
+	return true, pw.writer.AppendBatch(points)
+}
+
+// Marks the writer as the most recently used, and closes the least
+// recently used writers past MaxOpenWriters. Writers are closed without
+// holding the lock of the pool, so appends to other series can proceed.
+//
+// Closed writers are removed from the pool once no append is using them.
+// Until then, appends to the same serie wait for the writer to be closed,
+// and open it again.
+func (p *WriterPool) evict(used *pooledWriter, open bool) {
+	evicted := []*pooledWriter{}
+	p.lock.Lock()
+	used.users -= 1
+	used.used = time.Now()
+	if !open {
+		// Failed to open, nothing to keep.
+		p.prune(used)
+	} else if used.open == nil {
+		used.open = p.open.PushFront(used)
+	} else {
+		p.open.MoveToFront(used.open)
+	}
+	for p.MaxOpenWriters > 0 && p.open.Len() > p.MaxOpenWriters {
+		pw := p.open.Remove(p.open.Back()).(*pooledWriter)
+		pw.open = nil
+		evicted = append(evicted, pw)
+	}
+	p.lock.Unlock()
+	p.closeWriters(evicted)
+}
+
+// Closes the writers not used for MaxIdle, releasing the locks on their
+// series. Does nothing if MaxIdle is 0. Writers are opened again as needed.
+func (p *WriterPool) CloseIdle() {
+	if p.MaxIdle <= 0 {
+		return
+	}
+	idle := []*pooledWriter{}
+	deadline := time.Now().Add(-p.MaxIdle)
+	p.lock.Lock()
+	// The least recently used are at the back of the list.
+	for element := p.open.Back(); element != nil; {
+		pw := element.Value.(*pooledWriter)
+		if !pw.used.Before(deadline) {
+			break
+		}
+		previous := element.Prev()
+		if pw.users <= 0 {
+			p.open.Remove(element)
+			pw.open = nil
+			idle = append(idle, pw)
+		}
+		element = previous
+	}
+	p.lock.Unlock()
+	p.closeWriters(idle)
+}
+
+// Closes writers removed from the list of open writers, and removes them
+// from the pool once no append is using them.
+func (p *WriterPool) closeWriters(closed []*pooledWriter) {
+	for _, pw := range closed {
+		pw.lock.Lock()
+		if pw.writer != nil {
+			pw.writer.Close()
+			pw.writer = nil
+		}
+		pw.lock.Unlock()
+	}
+
+	p.lock.Lock()
+	for _, pw := range closed {
+		p.prune(pw)
+	}
+	p.lock.Unlock()
+}
+
+// Flushes all the open writers to disk.
+func (p *WriterPool) Sync() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, pw := range p.writers {
+		pw.lock.Lock()
+		if pw.writer != nil {
+			pw.writer.Sync()
+		}
+		pw.lock.Unlock()
+	}
+}
+
+// Moves the points backfilled in all the open writers in place, as with
+// SerieWriter.CompactBackfill. Returns the first error, after trying all.
+//
+// Only the serie being compacted is blocked, points can be appended to
+// the others in the meantime.
+func (p *WriterPool) CompactBackfill() error {
+	p.lock.Lock()
+	writers := make(map[string]*pooledWriter, len(p.writers))
+	for name, pw := range p.writers {
+		writers[name] = pw
+	}
+	p.lock.Unlock()
+
+	var result error
+	for name, pw := range writers {
+		pw.lock.Lock()
+		if pw.writer != nil {
+			if err := pw.writer.CompactBackfill(); err != nil && result == nil {
+				result = fmt.Errorf("serie %s: %s", name, err)
+			}
+		}
+		pw.lock.Unlock()
+	}
+	return result
+}
+
+// Closes all the open writers, releasing the locks on the series.
+// The pool can still be used, writers are opened again as needed.
+func (p *WriterPool) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, pw := range p.writers {
+		pw.lock.Lock()
+		if pw.writer != nil {
+			pw.writer.Close()
+			pw.writer = nil
+		}
+		pw.lock.Unlock()
+	}
+	p.open.Init()
+	for _, pw := range p.writers {
+		pw.open = nil
+		p.prune(pw)
+	}
+}
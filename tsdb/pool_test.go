@@ -0,0 +1,190 @@
+package tsdb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriterPool(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "pool-")
+	assert.Nil(t, err)
+
+	pool := NewWriterPool(tempdir)
+	pool.MaxEntries = 32
+	pool.LabelBlock = 128
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := uint64(1); j <= 100; j++ {
+				err := pool.Append(fmt.Sprintf("serie-%d", i%2), []Point{{j, j, []string{"foo"}, TypeUint64}})
+				assert.Nil(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// New series get the type of the first point.
+	err = pool.Append("float", []Point{{1, math.Float64bits(0.5), nil, TypeFloat64}, {2, 3, nil, TypeUint64}})
+	assert.Nil(t, err)
+	for _, name := range []string{"", ".hidden", "../escape", "a/../b", "/abs", "a//b", "a/"} {
+		assert.NotNil(t, pool.Append(name, []Point{{1, 1, nil, TypeUint64}}), name)
+	}
+
+	// Writers keep the series locked until closed.
+	_, err = LockSerie(filepath.Join(tempdir, "serie-0"), 0666, 0)
+	assert.IsType(t, &LockedError{}, err)
+	pool.Close()
+
+	assert.Equal(t, []string{filepath.Join(tempdir, "float"), filepath.Join(tempdir, "serie-0"), filepath.Join(tempdir, "serie-1")}, GetSeries(tempdir))
+
+	// Series can be stored in subdirectories, and are created with the
+	// metadata of the pool.
+	pool.InitialMeta = SerieMeta{"", "", KindGauge, time.Second}
+	err = pool.Append("web1/cpu", []Point{{1, 1, nil, TypeUint64}})
+	assert.Nil(t, err)
+	meta, err := ReadSerieMeta(filepath.Join(tempdir, "web1", "cpu"))
+	assert.Nil(t, err)
+	assert.Equal(t, pool.InitialMeta, meta)
+	assert.Equal(t, []string{filepath.Join(tempdir, "float"), filepath.Join(tempdir, "serie-0"), filepath.Join(tempdir, "serie-1"), filepath.Join(tempdir, "web1", "cpu")}, FindSeries(tempdir))
+	r := NewSerieReader(filepath.Join(tempdir, "serie-1"))
+	assert.Nil(t, r.Open())
+	data, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, len(data))
+
+	// Existing series keep their type, without rotating shards.
+	err = pool.Append("float", []Point{{3, 4, nil, TypeUint64}})
+	assert.Nil(t, err)
+	pool.Close()
+	assert.Equal(t, 1, len(GetDataFiles(filepath.Join(tempdir, "float"))))
+	r = NewSerieReader(filepath.Join(tempdir, "float"))
+	assert.Nil(t, r.Open())
+	data, err = r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(data))
+	assert.Equal(t, 0.5, data[0].Float64())
+	assert.Equal(t, 4.0, data[2].Float64())
+}
+
+func TestWriterPoolEviction(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "pool-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	pool := NewWriterPool(tempdir)
+	pool.MaxEntries = 32
+	pool.LabelBlock = 128
+	pool.MaxOpenWriters = 2
+	defer pool.Close()
+	for _, name := range []string{"a", "b", "a", "c"} {
+		assert.Nil(t, pool.Append(name, []Point{{1, 1, nil, TypeUint64}}))
+	}
+
+	// b was the least recently used, and was closed.
+	lock, err := LockSerie(filepath.Join(tempdir, "b"), 0666, 0)
+	assert.Nil(t, err)
+	lock.Unlock()
+	for _, name := range []string{"a", "c"} {
+		_, err = LockSerie(filepath.Join(tempdir, name), 0666, 0)
+		assert.IsType(t, &LockedError{}, err, name)
+	}
+
+	// And is opened again when written to.
+	assert.Nil(t, pool.Append("b", []Point{{2, 2, nil, TypeUint64}}))
+	assert.Equal(t, 2, len(readAllPoints(t, filepath.Join(tempdir, "b"))))
+	lock, err = LockSerie(filepath.Join(tempdir, "a"), 0666, 0)
+	assert.Nil(t, err)
+	lock.Unlock()
+
+	// Only the open writers are kept, however many series are written.
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, pool.Append(fmt.Sprintf("s%d", i), []Point{{1, 1, nil, TypeUint64}}))
+	}
+	assert.Equal(t, 2, len(pool.writers))
+	assert.Equal(t, 2, pool.open.Len())
+	// Nor writers that failed to open.
+	lock, err = LockSerie(filepath.Join(tempdir, "locked"), 0666, 0)
+	assert.Nil(t, err)
+	assert.NotNil(t, pool.Append("locked", []Point{{1, 1, nil, TypeUint64}}))
+	lock.Unlock()
+	assert.Equal(t, 2, len(pool.writers))
+	pool.Close()
+	assert.Equal(t, 0, len(pool.writers))
+}
+
+func TestWriterPoolCloseIdle(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "pool-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	pool := NewWriterPool(tempdir)
+	pool.MaxEntries = 32
+	pool.LabelBlock = 128
+	pool.MaxIdle = 100 * time.Millisecond
+	defer pool.Close()
+	assert.Nil(t, pool.Append("a", []Point{{1, 1, nil, TypeUint64}}))
+	time.Sleep(2 * pool.MaxIdle)
+	assert.Nil(t, pool.Append("b", []Point{{1, 1, nil, TypeUint64}}))
+
+	// Only a was unused for long enough to be closed.
+	pool.CloseIdle()
+	assert.Equal(t, 1, len(pool.writers))
+	lock, err := LockSerie(filepath.Join(tempdir, "a"), 0666, 0)
+	assert.Nil(t, err)
+	lock.Unlock()
+	_, err = LockSerie(filepath.Join(tempdir, "b"), 0666, 0)
+	assert.IsType(t, &LockedError{}, err)
+
+	// And is opened again when written to.
+	assert.Nil(t, pool.Append("a", []Point{{2, 2, nil, TypeUint64}}))
+	assert.Equal(t, 2, len(readAllPoints(t, filepath.Join(tempdir, "a"))))
+
+	// With MaxIdle 0, writers are kept open.
+	time.Sleep(2 * pool.MaxIdle)
+	pool.MaxIdle = 0
+	pool.CloseIdle()
+	assert.Equal(t, 2, len(pool.writers))
+}
+
+func TestWriterPoolCompactBackfill(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "pool-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	pool := NewWriterPool(tempdir)
+	pool.MaxEntries = 32
+	pool.LabelBlock = 128
+	pool.OutOfOrder = OutOfOrderBackfill
+	defer pool.Close()
+	for _, name := range []string{"a", "b"} {
+		assert.Nil(t, pool.Append(name, []Point{{10, 10, nil, TypeUint64}, {5, 5, nil, TypeUint64}}))
+	}
+
+	// While a serie is busy, the others can still be written to.
+	busy := pool.writers["a"]
+	busy.lock.Lock()
+	done := make(chan error)
+	go func() {
+		done <- pool.CompactBackfill()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, pool.Append("b", []Point{{20, 20, nil, TypeUint64}}))
+	busy.lock.Unlock()
+	assert.Nil(t, <-done)
+
+	for _, name := range []string{"a", "b"} {
+		_, err := os.Stat(BackfillPath(filepath.Join(tempdir, name)))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+	assert.Equal(t, 3, len(readAllPoints(t, filepath.Join(tempdir, "b"))))
+}
@@ -3,10 +3,16 @@ package tsdb
 import (
 	//"time"
 	//"os"
+	"container/list"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	//"syscall"
 )
 
@@ -19,38 +25,123 @@ type shard struct {
 	entries int
 	// The location of the shard in the shard index.
 	index int
+	// True if the last entry is the marker appended by Seal.
+	sealed bool
+	// Type of the values stored in this shard.
+	valuetype ValueType
+	// Inode of the data file when first seen, to detect when it is replaced.
+	inode uint64
 
 	dw *DataStore
 	ls *LabelStore
+	// Index of the labels, once built or read by getLabelIndex.
+	labels *labelIndex
+	// Position in the list of loaded shards, nil if not loaded.
+	loaded *list.Element
+}
+
+// Default number of shards a SerieReader keeps loaded in memory.
+const DefaultMaxLoadedShards = 16
+
+// Default number of backfilled points a SerieReader loads in memory.
+const DefaultMaxBackfilled = 1 << 20
+
+// Limits the number of shards loaded by a group of SerieReaders, like the
+// readers of all the series of a server. Can be shared by readers used
+// from different goroutines.
+//
+// Readers only unload their own shards, as others may be in use: when
+// loading one past Max, and when Trim is called. So Max can be exceeded
+// by the last shard loaded by each reader, until Trim is called on it.
+type ShardBudget struct {
+	// Maximum number of shards loaded by all the readers, 0 for no limit.
+	Max int
+
+	lock   sync.Mutex
+	loaded int
+}
+
+func NewShardBudget(max int) *ShardBudget {
+	return &ShardBudget{max, sync.Mutex{}, 0}
+}
+
+func (b *ShardBudget) add(shards int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.loaded += shards
+}
+
+// True if more shards than Max are loaded.
+func (b *ShardBudget) over() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.Max > 0 && b.loaded > b.Max
+}
+
+// Returns the number of shards loaded by all the readers.
+func (b *ShardBudget) Loaded() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.loaded
 }
 
 type SerieReader struct {
 	// Path of the serie, eg, /var/tsdb/kernel-memory.
 	Path string
+	// Maximum number of shards to keep mapped in memory. Shards are loaded
+	// as needed, the least recently used are unloaded past this number.
+	// 0 for no limit.
+	MaxLoadedShards int
+	// If set, shards are also unloaded when the readers sharing the budget
+	// have more than its Max loaded. nil by default.
+	Budget *ShardBudget
+	// If true, shards are locked in memory with mlock once loaded. Loading
+	// fails if this would exceed RLIMIT_MEMLOCK.
+	Mlock bool
+	// If true, GetData merges in the points stored in the overlay of the
+	// serie by OutOfOrderBackfill. True by default. Series that never had
+	// points backfilled only cost a stat per ReloadShards.
+	Backfill bool
+	// Maximum number of backfilled points loaded in memory from the overlay.
+	// Past this number reads fail, until CompactBackfill moves the points in
+	// place. DefaultMaxBackfilled by default, 0 for no limit.
+	MaxBackfilled int
+
 	// List of shards available. Note that writers can append
 	// new shards any time, or old shards may be rotated out.
 	shard []*shard
 	// Shard indexes by name.
 	byname map[string]*shard
+	// Shards loaded in memory, most recently used first.
+	loaded *list.List
+
+	// Reader of the overlay with the backfilled points, the points it
+	// contains sorted by time, and the cursors they were read at.
+	overlay    *SerieReader
+	backfilled []Point
+	overlaykey string
+	// True if the overlay was ever created, as of the last ReloadShards.
+	hasoverlay bool
 }
 
 func NewSerieReader(dbbasepath string) *SerieReader {
-	return &SerieReader{dbbasepath, nil, make(map[string]*shard)}
+	return &SerieReader{dbbasepath, DefaultMaxLoadedShards, nil, false, true, DefaultMaxBackfilled, nil, make(map[string]*shard), list.New(), nil, nil, "", false}
 }
 
-func (shard *shard) Load(path string) error {
+func (shard *shard) Load(s *SerieReader) error {
 	if shard.dw != nil && shard.ls != nil {
+		s.loaded.MoveToFront(shard.loaded)
 		return nil
 	}
 
-	datafile := MakeDataStoreFileName(path, shard.fileid)
-	dw, err := OpenDataStoreForReading(datafile)
+	datafile := MakeDataStoreFileName(s.Path, shard.fileid)
+	dw, err := openDataStoreForReading(datafile, s.Mlock)
 	if err != nil {
 		return err
 	}
 
-	labelfile := MakeLabelStoreFileName(path, shard.fileid)
-	ls, err := OpenLabelsForReading(labelfile)
+	labelfile := MakeLabelStoreFileName(s.Path, shard.fileid)
+	ls, err := openLabelsForReading(labelfile, s.Mlock)
 	if err != nil {
 		dw.Close()
 		shard.dw = nil
@@ -59,15 +150,50 @@ func (shard *shard) Load(path string) error {
 
 	shard.dw = dw
 	shard.ls = ls
+	shard.valuetype = dw.valuetype
+	// The file may have been replaced since it was peeked.
+	shard.refresh()
+	shard.loaded = s.loaded.PushFront(shard)
+	if s.Budget != nil {
+		s.Budget.add(1)
+	}
+	s.evict()
 	return nil
 }
 
-func (shard *shard) Unload() {
+func (shard *shard) Unload(s *SerieReader) {
 	shard.dw.Close()
 	shard.ls.Close()
 
 	shard.dw = nil
 	shard.ls = nil
+	if shard.labels != nil {
+		shard.labels.Close()
+		shard.labels = nil
+	}
+	s.loaded.Remove(shard.loaded)
+	shard.loaded = nil
+	if s.Budget != nil {
+		s.Budget.add(-1)
+	}
+}
+
+// Unloads the least recently used shards, so no more than MaxLoadedShards
+// are loaded, nor more than allowed by the Budget. The shard loaded last
+// is never unloaded.
+func (s *SerieReader) evict() {
+	for s.loaded.Len() > 1 && ((s.MaxLoadedShards > 0 && s.loaded.Len() > s.MaxLoadedShards) || (s.Budget != nil && s.Budget.over())) {
+		s.loaded.Back().Value.(*shard).Unload(s)
+	}
+}
+
+// Unloads the least recently used shards, all of them if needed, while the
+// readers sharing the Budget have more than its Max loaded. To be called
+// on readers not in use, so the budget is available to the others.
+func (s *SerieReader) Trim() {
+	for s.Budget != nil && s.loaded.Len() > 0 && s.Budget.over() {
+		s.loaded.Back().Value.(*shard).Unload(s)
+	}
 }
 
 func (shard *shard) GetElements(s *SerieReader) int {
@@ -75,12 +201,12 @@ func (shard *shard) GetElements(s *SerieReader) int {
 	if shard != lastshard {
 		return shard.entries
 	}
-	lastshard.Load(s.Path)
+	lastshard.Load(s)
 	return lastshard.dw.GetEntries()
 }
 
 func (shard *shard) Next(s *SerieReader) *shard {
-	if shard.index >= len(s.shard) {
+	if shard.index >= len(s.shard)-1 {
 		return nil
 	}
 	return s.shard[shard.index+1]
@@ -94,64 +220,178 @@ func (shard *shard) Prev(s *SerieReader) *shard {
 }
 
 func (shard *shard) IsLast(s *SerieReader) bool {
-	return shard.index >= len(s.shard)
+	return shard.index >= len(s.shard)-1
+}
+
+// Returns true if the shard is still part of the serie, false if it was
+// removed, for example, by a retention policy.
+func (s *SerieReader) hasShard(shard *shard) bool {
+	return shard != nil && shard.index >= 0 && shard.index < len(s.shard) && s.shard[shard.index] == shard
 }
 
+// Returned when a serie has no shard, as before its first point is written.
+var ErrNoShards = errors.New("serie not found - not a single shard in folder")
+
 func (s *SerieReader) ReloadShards() error {
-	// Check if the last shard filled up or was sealed. If it wasn't, there surely is no new shard to load.
+	// The lock of the overlay is created with it, and never removed.
+	if s.Backfill {
+		_, err := os.Stat(MakeLockFileName(BackfillPath(s.Path)))
+		s.hasoverlay = err == nil
+	}
+
+	// Check if the last shard filled up or was sealed, and if the first shard was removed.
+	// If neither happened, there surely is no shard to load or to forget.
 	var lastshard *shard
 	if len(s.shard) > 0 {
 		lastshard = s.shard[len(s.shard)-1]
-		lastshard.Load(s.Path)
-		more, _ := lastshard.dw.PeekAppend()
-		if more {
-			return nil
+		err := lastshard.Load(s)
+		if err == nil {
+			lastshard.refresh()
+
+			more, _ := lastshard.dw.PeekAppend()
+			_, err := os.Stat(MakeDataStoreFileName(s.Path, s.shard[0].fileid))
+			replaced := fileInode(MakeDataStoreFileName(s.Path, lastshard.fileid)) != lastshard.inode
+			if more && !lastshard.dw.IsSealed() && err == nil && !replaced {
+				return nil
+			}
 		}
 	}
 
-	startid := uint32(1)
-	if lastshard != nil {
-		startid = lastshard.fileid
-	}
-
-	newshards := make([]*shard, len(s.shard))
-	for fileid := startid; ; fileid++ {
-		filename := MakeDataStoreFileName(s.Path, fileid)
+	// Shards are not necessarily numbered from 1, old ones may have been removed.
+	newshards := []*shard{}
+	byname := make(map[string]*shard)
+	for _, filename := range GetDataFiles(s.Path) {
+		// Files replaced, for example by CompactBackfill, are peeked again.
+		inode := fileInode(filename)
 		newshard, ok := s.byname[filename]
+		if ok && newshard.inode != inode {
+			if newshard.dw != nil {
+				newshard.Unload(s)
+			}
+			ok = false
+		}
 		if !ok {
-			point, entries, err := PeekDataStore(MakeDataStoreFileName(s.Path, fileid))
+			fileid := ParseFileName(s.Path, filename)
+			if fileid == 0 {
+				continue
+			}
+			point, entries, sealed, err := peekDataStore(filename)
 			if err != nil {
+				// The shard may have been removed after the directory was listed.
 				if os.IsNotExist(err) {
-					break
+					continue
 				}
 				return err
 			}
-			newshard = &shard{fileid, point.Time, entries, len(newshards), nil, nil}
-			s.byname[filename] = newshard
+			newshard = &shard{fileid, point.Time, entries, 0, sealed, point.Type, inode, nil, nil, nil, nil}
 		}
+		newshard.index = len(newshards)
 		newshards = append(newshards, newshard)
+		byname[filename] = newshard
 	}
-	if len(newshards) <= 0 {
-		return fmt.Errorf("serie not found - not a single shard in folder")
+
+	// Forget the shards that have been removed or replaced, and unload them
+	// right away. Locations pointing to them become invalid, see hasShard.
+	for filename, oldshard := range s.byname {
+		if newshard, ok := byname[filename]; (!ok || newshard != oldshard) && oldshard.dw != nil {
+			oldshard.Unload(s)
+		}
 	}
-	// TODO: we shoul garbage collect / unload old unused / infrequently used shards.
+	s.byname = byname
 	s.shard = newshards
+	if len(newshards) <= 0 {
+		return ErrNoShards
+	}
+
+	// The number of entries of what was the last shard may have changed since it was peeked.
+	if lastshard != nil && s.hasShard(lastshard) && lastshard.dw != nil {
+		lastshard.refresh()
+	}
 	return nil
 }
 
+// Updates the number of entries and first time of a loaded shard, which
+// may have changed if the shard was being written when first peeked.
+func (shard *shard) refresh() {
+	shard.entries = shard.dw.GetEntries()
+	shard.sealed = shard.dw.IsSealed()
+	if shard.entries > 0 {
+		shard.mintime = shard.dw.GetTime(shard.dw.GetOffset(0))
+	}
+}
+
 func (s *SerieReader) Open() error {
 	return s.ReloadShards()
 }
 
+// Unloads all the shards of the serie. The reader can still be used,
+// shards are loaded again as needed.
+func (s *SerieReader) Close() {
+	for s.loaded.Len() > 0 {
+		s.loaded.Front().Value.(*shard).Unload(s)
+	}
+	if s.overlay != nil {
+		s.overlay.Close()
+	}
+}
+
+// Summary of the content of a serie.
+type SerieStats struct {
+	// Time of the first and of the last point of the serie.
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+	// Number of points stored.
+	Entries int `json:"entries"`
+	// Number of shards storing the points.
+	Shards int `json:"shards"`
+}
+
+// Returns a summary of the content of the serie. Only the last shard
+// is loaded, the others are described by their headers.
+func (s *SerieReader) Stats() (SerieStats, error) {
+	err := s.ReloadShards()
+	if err != nil {
+		return SerieStats{}, err
+	}
+
+	stats := SerieStats{Shards: len(s.shard)}
+	for _, shard := range s.shard {
+		entries := shard.GetElements(s)
+		if shard.sealed || (shard.dw != nil && shard.dw.IsSealed()) {
+			entries -= 1
+		}
+		if entries > 0 && stats.Entries == 0 {
+			stats.First = shard.mintime
+		}
+		if entries > 0 {
+			stats.Entries += entries
+		}
+	}
+
+	// The last point is followed by at most a seal marker.
+	end := s.LastLocation()
+	_, err = s.GetData(end.Minus(s, 2), end, func(points []Point, location Location, time, value uint64) []Point {
+		stats.Last = time
+		return points
+	})
+	return stats, err
+}
+
 type Point struct {
-	Time  uint64   `json:"time"`
-	Value uint64   `json:"value"`
-	Label []string `json:"label,omitempty"`
+	Time uint64 `json:"time"`
+	// Value as stored, to be interpreted according to Type.
+	// Use Float64(), Int64() or Uint64() to convert it.
+	Value uint64    `json:"value"`
+	Label []string  `json:"label,omitempty"`
+	Type  ValueType `json:"type,omitempty"`
 }
 
 type Location struct {
 	shard   *shard
 	element int
+	// Point from the overlay of the serie, merged in by GetData before the
+	// element. nil for the points stored in the serie itself.
+	point *Point
 }
 
 func (l *Location) Offset(s *SerieReader, value int) Location {
@@ -169,40 +409,150 @@ func (l *Location) Plus(s *SerieReader, value int) Location {
 	for shard := l.shard; ; {
 		elements := shard.GetElements(s)
 		if elements > l.element+value {
-			return Location{shard, l.element + value}
+			return Location{shard, l.element + value, nil}
 		}
 		if shard == lastshard {
-			return Location{lastshard, elements}
+			return Location{lastshard, elements, nil}
 		}
 
 		value -= elements
 		shard = shard.Next(s)
 	}
 	// Should actually never be reached.
-	return Location{lastshard, lastshard.GetElements(s)}
+	return Location{lastshard, lastshard.GetElements(s), nil}
 }
 
 func (l *Location) Minus(s *SerieReader, value int) Location {
 	if l.element > value {
-		return Location{l.shard, l.element - value}
+		return Location{l.shard, l.element - value, nil}
 	}
 	value -= l.element
 	shard := l.shard.Prev(s)
 	for shard != nil {
 		if shard.entries >= value {
-			return Location{shard, shard.entries - value}
+			return Location{shard, shard.entries - value, nil}
 		}
 		value -= shard.entries
 		shard = shard.Prev(s)
 	}
-	return Location{s.shard[0], 0}
+	return Location{s.shard[0], 0, nil}
+}
+
+// Returns the type of the values stored at the location.
+func (l Location) ValueType() ValueType {
+	if l.point != nil {
+		return l.point.Type
+	}
+	if l.shard == nil {
+		return TypeUint64
+	}
+	return l.shard.valuetype
+}
+
+// Returns true if the location refers to a point of the overlay, merged
+// by GetData before the element of the shard.
+func (l Location) Backfilled() bool {
+	return l.point != nil
+}
+
+// Returns true if the location points to an element of a shard.
+func (l Location) Valid() bool {
+	return l.shard != nil
+}
+
+// Returns true if l points to an element that comes before other.
+func (l Location) Before(other Location) bool {
+	if l.shard.index != other.shard.index {
+		return l.shard.index < other.shard.index
+	}
+	return l.element < other.element
+}
+
+// Returns an opaque string identifying the location, which can be turned
+// back into a Location with ParseCursor, by any SerieReader of the serie.
+// Unlike a Location, a cursor remains valid as shards are added or removed.
+func (l Location) Cursor() string {
+	return fmt.Sprintf("%08x.%x", l.shard.fileid, l.element)
+}
+
+// Returns the location identified by a cursor created with Location.Cursor
+// or CursorAfter.
+// If the shard of the cursor has been removed, for example by a retention
+// policy, returns the location of the first element still available after it.
+func (s *SerieReader) ParseCursor(cursor string) (Location, error) {
+	parts := strings.Split(cursor, ".")
+	if len(parts) < 2 || len(parts) > 4 || (len(parts) == 3 && parts[2] != "-") {
+		return Location{nil, 0, nil}, fmt.Errorf("invalid cursor '%s'", cursor)
+	}
+	fileid, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil || fileid == 0 {
+		return Location{nil, 0, nil}, fmt.Errorf("invalid cursor '%s'", cursor)
+	}
+	element, err := strconv.ParseUint(parts[1], 16, 31)
+	if err != nil {
+		return Location{nil, 0, nil}, fmt.Errorf("invalid cursor '%s'", cursor)
+	}
+	var time, skip uint64
+	if len(parts) == 4 {
+		time, err = strconv.ParseUint(parts[2], 16, 64)
+		if err == nil {
+			skip, err = strconv.ParseUint(parts[3], 16, 32)
+		}
+		if err != nil {
+			return Location{nil, 0, nil}, fmt.Errorf("invalid cursor '%s'", cursor)
+		}
+	}
+
+	err = s.ReloadShards()
+	if err != nil {
+		return Location{nil, 0, nil}, err
+	}
+	index := sort.Search(len(s.shard), func(i int) bool {
+		return s.shard[i].fileid >= uint32(fileid)
+	})
+	if index >= len(s.shard) {
+		return s.LastLocation(), nil
+	}
+
+	shard := s.shard[index]
+	if shard.fileid != uint32(fileid) {
+		return Location{shard, 0, nil}, nil
+	}
+	if elements := shard.GetElements(s); int(element) > elements {
+		element = uint64(elements)
+	}
+	location := Location{shard, int(element), nil}
+
+	// The point backfilled before the element from CursorAfter, if any.
+	if len(parts) == 3 && s.Backfill {
+		location.point = &afterBackfilled
+	}
+	if len(parts) == 4 && s.Backfill {
+		err := s.loadBackfill()
+		if err != nil {
+			return Location{nil, 0, nil}, err
+		}
+		index := sort.Search(len(s.backfilled), func(i int) bool {
+			return s.backfilled[i].Time >= time
+		})
+		for ; skip > 0 && index < len(s.backfilled) && s.backfilled[index].Time == time; skip-- {
+			index += 1
+		}
+		if index < s.backfillIndex(location) {
+			location.point = &s.backfilled[index]
+		}
+	}
+	return location, nil
 }
 
 type Summarizer func(points []Point, location Location, time, value uint64) []Point
 
 func (s *SerieReader) GetLabels(location Location, labels []string) []string {
+	if location.point != nil {
+		return append(labels, location.point.Label...)
+	}
 	shard := location.shard
-	err := shard.Load(s.Path)
+	err := shard.Load(s)
 	if err != nil {
 		return []string{}
 	}
@@ -221,7 +571,7 @@ func (s *SerieReader) GetLabels(location Location, labels []string) []string {
 func (s *SerieReader) GetData(start, end Location, summarizer Summarizer) ([]Point, error) {
 	if summarizer == nil {
 		summarizer = func(points []Point, location Location, time, value uint64) []Point {
-			return append(points, Point{time, value, s.GetLabels(location, nil)})
+			return append(points, Point{time, value, s.GetLabels(location, nil), location.ValueType()})
 		}
 	}
 
@@ -229,21 +579,32 @@ func (s *SerieReader) GetData(start, end Location, summarizer Summarizer) ([]Poi
 	minelement := start.element
 	points := []Point{}
 
-	cursor := start.shard.index
-	if s.shard[cursor] != start.shard {
+	if !s.hasShard(start.shard) {
 		return []Point{}, fmt.Errorf("Start is now invalid - shard is gone")
 	}
-	last := end.shard.index
-	if s.shard[last] != end.shard {
+	if !s.hasShard(end.shard) {
 		return []Point{}, fmt.Errorf("End is now invalid - shard is gone")
 	}
+	cursor := start.shard.index
+	last := end.shard.index
 	if cursor > last {
 		return []Point{}, fmt.Errorf("End < Start is invalid")
 	}
 
+	var backfilled []Point
+	if s.Backfill {
+		err := s.loadBackfill()
+		if err != nil {
+			return []Point{}, err
+		}
+		if len(s.backfilled) > 0 {
+			backfilled = s.backfillRange(start, end)
+		}
+	}
+
 	for ; cursor <= last; cursor++ {
 		shard := s.shard[cursor]
-		err := shard.Load(s.Path)
+		err := shard.Load(s)
 		if err != nil {
 			continue
 		}
@@ -258,49 +619,84 @@ func (s *SerieReader) GetData(start, end Location, summarizer Summarizer) ([]Poi
 			offset := shard.dw.GetOffset(j)
 			time := shard.dw.GetTime(offset)
 			value := shard.dw.GetValue(offset)
+			if time == SealMarker {
+				continue
+			}
 
-			points = summarizer(points, Location{shard, j}, time, value)
+			for len(backfilled) > 0 && backfilled[0].Time < time {
+				points = summarizer(points, Location{shard, j, &backfilled[0]}, backfilled[0].Time, backfilled[0].Value)
+				backfilled = backfilled[1:]
+			}
+			points = summarizer(points, Location{shard, j, nil}, time, value)
 		}
 
 		minelement = 0
 	}
+	// Backfilled points after the last element, but before end.
+	for i := range backfilled {
+		points = summarizer(points, Location{end.shard, end.element, &backfilled[i]}, backfilled[i].Time, backfilled[i].Value)
+	}
 	return points, nil
 }
 
 type Finder func(time uint64) bool
 
 // Returns the very first element in the time serie.
+// The location is not Valid if the serie has no shards.
 func (s *SerieReader) FirstLocation() Location {
 	s.ReloadShards()
+	if len(s.shard) <= 0 {
+		return Location{nil, 0, nil}
+	}
 
-	return Location{s.shard[0], 0}
+	return Location{s.shard[0], 0, nil}
 }
 
 // Returns the last location in the time serie.
 // This is one element past the last value stored, similar
 // to what slice[len(slice)] in go would lead to.
 // This is mostly useful to get the GetData arithmetic to work easily.
+// The location is not Valid if the serie has no shards.
 func (s *SerieReader) LastLocation() Location {
 	s.ReloadShards()
+	if len(s.shard) <= 0 {
+		return Location{nil, 0, nil}
+	}
 
 	lastshard := s.shard[len(s.shard)-1]
-	lastshard.Load(s.Path)
+	lastshard.Load(s)
 
-	return Location{lastshard, lastshard.dw.GetEntries()}
+	return Location{lastshard, lastshard.dw.GetEntries(), nil}
 }
 
+// Returns the location of the first element for which finder returns true.
+// finder must return false for all times before a point, and true after,
+// as with sort.Search. If no element matches, the returned location is
+// one past the last element of the serie.
 func (s *SerieReader) Find(finder Finder) Location {
 	s.ReloadShards()
+	if len(s.shard) <= 0 {
+		return Location{nil, 0, nil}
+	}
 
 	minshard := sort.Search(len(s.shard), func(i int) bool {
+		// An empty shard has no mintime yet, its first point will come after any other.
 		time := s.shard[i].mintime
+		if s.shard[i].entries <= 0 {
+			time = math.MaxUint64
+		}
 		return finder(time)
 	})
+	// The first matching element may be stored at the end of the shard
+	// preceding the first shard with a matching mintime.
+	if minshard > 0 {
+		minshard -= 1
+	}
 
 	shard := s.shard[minshard]
-	err := shard.Load(s.Path)
+	err := shard.Load(s)
 	if err != nil {
-		return Location{nil, 0}
+		return Location{nil, 0, nil}
 	}
 
 	element := sort.Search(shard.dw.GetEntries(), func(i int) bool {
@@ -308,5 +704,5 @@ func (s *SerieReader) Find(finder Finder) Location {
 		return finder(time)
 	})
 
-	return Location{shard, element}
+	return Location{shard, element, nil}
 }
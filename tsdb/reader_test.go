@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -133,3 +134,244 @@ func TestSerieReaderBasics(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 2000, len(data))
 }
+
+func TestSerieReaderFind(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := uint64(0); i < 1000; i++ {
+		err := s.Append(i*2+10, i, nil)
+		assert.Nil(t, err)
+	}
+	s.Close()
+
+	r := NewSerieReader(filepath.Join(tempdir, "test"))
+	err = r.Open()
+	assert.Nil(t, err)
+
+	// Every time, including the ones in the middle of a shard or between
+	// two points, must find the first point at or after it.
+	for i := uint64(0); i < 1000; i++ {
+		for _, time := range []uint64{i*2 + 9, i*2 + 10} {
+			location := r.Find(func(t uint64) bool {
+				return t >= time
+			})
+			assert.True(t, location.Valid())
+
+			data, err := r.GetData(location, location.Plus(r, 1), nil)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, len(data))
+			assert.Equal(t, i*2+10, data[0].Time)
+		}
+	}
+
+	// Times before and after the serie.
+	first := r.Find(func(t uint64) bool { return t >= 0 })
+	assert.False(t, first.Before(r.FirstLocation()))
+	assert.False(t, r.FirstLocation().Before(first))
+
+	last := r.Find(func(t uint64) bool { return t > 100000 })
+	assert.False(t, last.Before(r.LastLocation()))
+	assert.False(t, r.LastLocation().Before(last))
+}
+
+func TestSerieReaderCursor(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := uint64(0); i < 1000; i++ {
+		err := s.Append(i+10, i, nil)
+		assert.Nil(t, err)
+	}
+	s.Close()
+
+	r := NewSerieReader(filepath.Join(tempdir, "test"))
+	err = r.Open()
+	assert.Nil(t, err)
+
+	// Cursors can be used by other readers.
+	other := NewSerieReader(filepath.Join(tempdir, "test"))
+	first := r.FirstLocation()
+	for _, offset := range []int{0, 1, 126, 127, 500, 999} {
+		location := first.Plus(r, offset)
+		resumed, err := other.ParseCursor(location.Cursor())
+		assert.Nil(t, err)
+
+		data, err := other.GetData(resumed, other.LastLocation(), nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 1000-offset, len(data))
+		assert.Equal(t, uint64(offset+10), data[0].Time)
+	}
+	last, err := other.ParseCursor(r.LastLocation().Cursor())
+	assert.Nil(t, err)
+	assert.False(t, last.Before(other.LastLocation()))
+
+	// Removed shards resume from the first point available.
+	location := first.Plus(r, 10)
+	cursor := location.Cursor()
+	err = RemoveShard(filepath.Join(tempdir, "test"), 1)
+	assert.Nil(t, err)
+	resumed, err := other.ParseCursor(cursor)
+	assert.Nil(t, err)
+	assert.False(t, resumed.Before(other.FirstLocation()))
+	assert.False(t, other.FirstLocation().Before(resumed))
+
+	for _, invalid := range []string{"", "1", "00000000.1", "foo.bar", "1.-1"} {
+		_, err := other.ParseCursor(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestSerieReaderStats(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := uint64(1); i <= 300; i++ {
+		assert.Nil(t, s.Append(i+10, i, nil))
+	}
+	s.Close()
+
+	// Changing the labels per entry seals, and compresses, the last shard.
+	s.LabelsPerEntry = 2
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := uint64(301); i <= 310; i++ {
+		assert.Nil(t, s.Append(i+10, i, nil))
+	}
+	s.Close()
+
+	r := NewSerieReader(filepath.Join(tempdir, "test"))
+	stats, err := r.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, SerieStats{11, 320, 310, 4}, stats)
+	r.Close()
+
+	// Readers that loaded the shards get the same result.
+	_, err = r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	stats, err = r.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, SerieStats{11, 320, 310, 4}, stats)
+
+	_, err = NewSerieReader(filepath.Join(tempdir, "missing")).Stats()
+	assert.NotNil(t, err)
+}
+
+func TestSerieReaderLoadedShards(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.CompactOnSeal = false
+	s.ValueType = TypeInt64
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := uint64(1); i <= 1000; i++ {
+		err := s.AppendInt64(i, -int64(i), []string{fmt.Sprintf("host=%d", i%3)})
+		assert.Nil(t, err)
+	}
+	s.Close()
+
+	r := NewSerieReader(filepath.Join(tempdir, "test"))
+	r.MaxLoadedShards = 3
+	err = r.Open()
+	assert.Nil(t, err)
+	assert.Equal(t, 8, len(r.shard))
+
+	data, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(data))
+	assert.Equal(t, int64(-1000), data[999].Int64())
+	assert.Equal(t, []string{"host=1"}, data[999].Label)
+	assert.Equal(t, 3, r.loaded.Len())
+
+	// The most recently used shards are the ones kept loaded.
+	loaded := 0
+	for i, shard := range r.shard {
+		if shard.dw != nil {
+			assert.True(t, i >= 5)
+			loaded += 1
+		}
+	}
+	assert.Equal(t, 3, loaded)
+
+	// Unloaded shards still know their value type.
+	first := r.FirstLocation()
+	assert.Nil(t, r.shard[0].dw)
+	assert.Equal(t, TypeInt64, first.ValueType())
+
+	r.Close()
+	assert.Equal(t, 0, r.loaded.Len())
+	for _, shard := range r.shard {
+		assert.Nil(t, shard.dw)
+	}
+}
+
+func TestShardBudget(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	assert.Nil(t, s.Open())
+	for i := uint64(1); i <= 1000; i++ {
+		assert.Nil(t, s.Append(i, i, nil))
+	}
+	s.Close()
+
+	// Two readers sharing a budget of 4 shards, each allowed 3.
+	budget := NewShardBudget(4)
+	readers := []*SerieReader{}
+	for i := 0; i < 2; i++ {
+		r := NewSerieReader(s.Path)
+		r.MaxLoadedShards = 3
+		r.Budget = budget
+		readers = append(readers, r)
+		data, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 1000, len(data))
+	}
+	// The first reader kept 3, the second had to unload all but the last.
+	assert.Equal(t, 3, readers[0].loaded.Len())
+	assert.Equal(t, 1, readers[1].loaded.Len())
+	assert.Equal(t, 4, budget.Loaded())
+
+	// Each reader keeps the last shard it loaded, even past the budget,
+	// until the shards of readers not in use are unloaded by Trim.
+	r := NewSerieReader(s.Path)
+	r.Budget = budget
+	readers = append(readers, r)
+	assert.True(t, r.FirstLocation().Valid())
+	assert.Nil(t, r.shard[0].Load(r))
+	assert.Equal(t, 1, r.loaded.Len())
+	assert.Equal(t, 5, budget.Loaded())
+	readers[0].Trim()
+	assert.Equal(t, 2, readers[0].loaded.Len())
+	assert.Equal(t, 4, budget.Loaded())
+	readers[0].Trim()
+	assert.Equal(t, 2, readers[0].loaded.Len())
+
+	for _, r := range readers {
+		r.Close()
+	}
+	assert.Equal(t, 0, budget.Loaded())
+}
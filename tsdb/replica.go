@@ -0,0 +1,503 @@
+package tsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Replication copies the shards of the series of a primary directory to
+// a follower, while they are being written.
+//
+// The follower sends the position it reached in each serie, its last
+// shard, and the cursor and end of the labels of that shard. The primary
+// replies with the entries and labels appended after that position, and
+// the shards created after it. Entries are copied as they are in the
+// .data files, labels as they are in the .labels files, so the follower
+// has the same files as the primary, and its position can be recovered
+// from the files after a restart.
+//
+// Shards that are not written in place, compressed or with a different
+// byte order, are copied as a whole. Points in the overlay of backfilled
+// points are not replicated, nor are shards rewritten by CompactBackfill
+// after the follower copied them.
+
+// Position of a follower in a serie.
+type SyncPosition struct {
+	// Last shard of the follower.
+	Id uint32 `json:"id"`
+	// Cursor of the shard, bytes of entries copied.
+	Cursor uint64 `json:"cursor"`
+	// Offset of the end of the labels copied in the .labels file.
+	Labels int `json:"labels"`
+	// True if the shard will not change anymore, sealed, full, or copied
+	// as a whole.
+	Complete bool `json:"complete"`
+}
+
+type SyncRequest struct {
+	// Position by name of the serie, relative to the directory. Series
+	// the follower does not have are copied from their first shard.
+	Serie map[string]SyncPosition `json:"serie"`
+}
+
+// Changes to apply to a shard of the follower.
+type ShardSync struct {
+	Id uint32 `json:"id"`
+
+	// Set if the follower must create the shard, with files of the sizes
+	// indicated starting with the headers, before applying the changes.
+	DataHeader   []byte `json:"dataheader,omitempty"`
+	DataSize     int64  `json:"datasize,omitempty"`
+	LabelsHeader []byte `json:"labelsheader,omitempty"`
+	// Size of the .labels file, which grows as labels are added.
+	LabelsSize int64 `json:"labelssize"`
+
+	// Entries to write at the cursor From, and the cursor after them.
+	From    uint64 `json:"from"`
+	Cursor  uint64 `json:"cursor"`
+	Entries []byte `json:"entries,omitempty"`
+	// Labels to write at the offset LabelsFrom of the .labels file.
+	LabelsFrom int    `json:"labelsfrom"`
+	Labels     []byte `json:"labels,omitempty"`
+
+	// Set for shards copied as a whole, replacing the files of the follower.
+	DataFile   []byte `json:"datafile,omitempty"`
+	LabelsFile []byte `json:"labelsfile,omitempty"`
+}
+
+func (ss *ShardSync) size() int {
+	return len(ss.Entries) + len(ss.Labels) + len(ss.DataFile) + len(ss.LabelsFile)
+}
+
+type SerieSync struct {
+	// First shard of the primary. The follower removes the older ones.
+	First uint32      `json:"first"`
+	Meta  SerieMeta   `json:"meta"`
+	Shard []ShardSync `json:"shard"`
+}
+
+type SyncReply struct {
+	Serie map[string]*SerieSync `json:"serie"`
+	// True if there was more to copy than fit in the reply. The follower
+	// should send a new request with its new position.
+	Truncated bool `json:"truncated"`
+}
+
+// Returns the changes to apply to a follower in the position of the
+// request to copy the series in basepath, and its subdirectories.
+//
+// The reply contains at most about maxbytes of entries and labels, but
+// always at least one entry, or one shard copied as a whole.
+func ReadSync(basepath string, request SyncRequest, maxbytes int) (*SyncReply, error) {
+	reply := &SyncReply{make(map[string]*SerieSync), false}
+	budget := maxbytes
+	for _, serie := range FindSeries(basepath) {
+		name, err := filepath.Rel(basepath, serie)
+		if err != nil {
+			return nil, err
+		}
+		name = filepath.ToSlash(name)
+		files := GetDataFiles(serie)
+		if len(files) <= 0 {
+			continue
+		}
+		meta, err := ReadSerieMeta(serie)
+		if err != nil {
+			return nil, err
+		}
+		ss := &SerieSync{ParseFileName(serie, files[0]), meta, []ShardSync{}}
+		reply.Serie[name] = ss
+
+		position, known := request.Serie[name]
+		for _, file := range files {
+			id := ParseFileName(serie, file)
+			from := SyncPosition{id, 0, 0, false}
+			if known {
+				if id < position.Id || (id == position.Id && position.Complete) {
+					continue
+				}
+				if id == position.Id {
+					from = position
+				}
+			}
+			if budget <= 0 {
+				reply.Truncated = true
+				break
+			}
+
+			shard, more, err := readShardSync(serie, from, budget)
+			// Removed by a retention policy since the files were listed.
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if shard.size() > 0 || shard.DataHeader != nil {
+				ss.Shard = append(ss.Shard, shard)
+				budget -= shard.size()
+			}
+			if more {
+				reply.Truncated = true
+				break
+			}
+		}
+		if reply.Truncated {
+			break
+		}
+	}
+	return reply, nil
+}
+
+// Returns the changes to a shard after the position from, with at most
+// about budget bytes of entries, and true if there are more entries.
+func readShardSync(dbbasepath string, from SyncPosition, budget int) (ShardSync, bool, error) {
+	shard := ShardSync{Id: from.Id}
+	datafile, labelsfile := MakeDataStoreFileName(dbbasepath, from.Id), MakeLabelStoreFileName(dbbasepath, from.Id)
+
+	file, err := os.Open(datafile)
+	if err != nil {
+		return shard, false, err
+	}
+	defer file.Close()
+	data, err := mmapFile(file, unix.PROT_READ, false)
+	if len(data) <= 0 {
+		if err == nil {
+			err = fmt.Errorf("%s is empty", datafile)
+		}
+		return shard, false, err
+	}
+	defer unix.Munmap(data)
+
+	// Files without header are sent whole, with the header readers add.
+	if !hasMagic(data, dataMagic) {
+		var labels []byte
+		shard.DataFile, err = upgradeDataStore(datafile, data)
+		if err == nil {
+			labels, err = ioutil.ReadFile(labelsfile)
+		}
+		if err == nil {
+			shard.LabelsFile, err = upgradeLabelStore(labelsfile, labels)
+		}
+		return shard, false, err
+	}
+	swap, err := checkHeader(datafile, data, dataMagic)
+	if err != nil {
+		return shard, false, err
+	}
+
+	// Shards not written in place are only created once complete.
+	if swap || getDataFormat(data) != FormatRaw {
+		shard.LabelsFile, err = ioutil.ReadFile(labelsfile)
+		if err == nil {
+			shard.DataFile = append([]byte(nil), data...)
+		}
+		return shard, false, err
+	}
+
+	lpe := int(*(*uint8)(unsafe.Pointer(&data[16])))
+	entry := GetEntrySize(lpe)
+	cursor := atomic.LoadUint64((*uint64)(unsafe.Pointer(&data[8])))
+	entries := GetEntries(cursor, len(data)-GetHeaderSize(), lpe)
+
+	// Create the shard from scratch if the position is not valid anymore,
+	// for example if the files were replaced.
+	first := int(from.Cursor) / entry
+	if from.Cursor%uint64(entry) != 0 || first > entries || from.Labels > 0 && from.Labels < GetHeaderSize() {
+		first, from.Labels = 0, 0
+	}
+	if first == 0 && from.Labels == 0 {
+		shard.DataHeader = append([]byte(nil), data[:GetHeaderSize()]...)
+		*(*uint64)(unsafe.Pointer(&shard.DataHeader[8])) = 0
+		shard.DataSize = int64(len(data))
+		from.Labels = GetHeaderSize()
+	}
+
+	last := entries
+	if max := first + budget/entry; max < last {
+		last = max
+	}
+	if last <= first && first < entries {
+		last = first + 1
+	}
+	shard.From, shard.Cursor = uint64(first*entry), uint64(last*entry)
+	shard.Entries = append([]byte(nil), data[GetHeaderSize()+first*entry:GetHeaderSize()+last*entry]...)
+
+	lfile, err := os.Open(labelsfile)
+	if err != nil {
+		return shard, false, err
+	}
+	defer lfile.Close()
+	raw, err := mmapFile(lfile, unix.PROT_READ, false)
+	if len(raw) <= 0 {
+		if err == nil {
+			err = fmt.Errorf("%s is empty", labelsfile)
+		}
+		return shard, false, err
+	}
+	defer unix.Munmap(raw)
+	if shard.DataHeader != nil {
+		shard.LabelsHeader = append([]byte(nil), raw[:GetHeaderSize()]...)
+	}
+	shard.LabelsSize = int64(len(raw))
+
+	end, err := labelsEnd(labelsfile, raw, maxLabel(data, lpe, first, last))
+	if err != nil {
+		return shard, false, err
+	}
+	shard.LabelsFrom = from.Labels
+	if end > from.Labels {
+		shard.Labels = append([]byte(nil), raw[from.Labels:end]...)
+	}
+	return shard, last < entries, nil
+}
+
+// Returns the position of a follower in the serie dbbasepath, false if
+// the serie has no shards.
+func LocalSyncPosition(dbbasepath string) (SyncPosition, bool, error) {
+	position := SyncPosition{}
+	last := GetLastFile(dbbasepath)
+	if last == "" {
+		return position, false, nil
+	}
+	position.Id = ParseFileName(dbbasepath, last)
+
+	header, _, err := readHeader(last, dataMagic)
+	if err != nil {
+		return position, false, err
+	}
+	if getByteOrder(header) != HostByteOrder() || getDataFormat(header) != FormatRaw {
+		position.Complete = true
+		return position, true, nil
+	}
+	_, entries, sealed, err := peekDataStore(last)
+	if err != nil {
+		return position, false, err
+	}
+	entry := GetEntrySize(int(*(*uint8)(unsafe.Pointer(&header[16]))))
+	position.Cursor = uint64(entries * entry)
+	position.Complete = sealed || int64(position.Cursor)+int64(entry) > getFileSize(last)-int64(GetHeaderSize())
+
+	raw, err := ioutil.ReadFile(MakeLabelStoreFileName(dbbasepath, position.Id))
+	if err != nil {
+		return position, false, err
+	}
+	position.Labels = GetHeaderSize()
+	for position.Labels+4 <= len(raw) {
+		size := int(*(*uint32)(unsafe.Pointer(&raw[position.Labels])))
+		if size == 0 || position.Labels+4+size > len(raw) {
+			break
+		}
+		position.Labels += (4 + size + 7) / 8 * 8
+	}
+	return position, true, nil
+}
+
+// Applies the changes read by ReadSync from the primary to the serie
+// dbbasepath of the follower.
+//
+// Labels are written before the entries referencing them, and entries
+// before the cursor that makes them visible, so SerieReaders can read
+// the serie while it is being updated.
+func ApplySync(dbbasepath string, ss *SerieSync) error {
+	for _, file := range GetDataFiles(dbbasepath) {
+		if id := ParseFileName(dbbasepath, file); id < ss.First {
+			err := RemoveShard(dbbasepath, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := range ss.Shard {
+		err := applyShardSync(dbbasepath, &ss.Shard[i])
+		if err != nil {
+			return fmt.Errorf("shard %08x: %s", ss.Shard[i].Id, err)
+		}
+	}
+
+	meta, err := ReadSerieMeta(dbbasepath)
+	if err == nil && meta != ss.Meta {
+		err = WriteSerieMeta(dbbasepath, ss.Meta, 0666)
+	}
+	return err
+}
+
+// Creates filename with data, extended with zeros to size, replacing it
+// atomically if it exists.
+func replaceFile(filename string, data []byte, size int64) error {
+	tmpname := filename + ".tmp"
+	file, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil && size > int64(len(data)) {
+		err = file.Truncate(size)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filename)
+	}
+	if err != nil {
+		os.Remove(tmpname)
+	}
+	return err
+}
+
+// Maps filename for writing, after extending it to at least size bytes.
+func mmapForSync(filename string, size int64) ([]byte, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Size() < size {
+		err = file.Truncate(size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mmapFile(file, unix.PROT_WRITE, false)
+}
+
+func applyShardSync(dbbasepath string, shard *ShardSync) error {
+	datafile, labelsfile := MakeDataStoreFileName(dbbasepath, shard.Id), MakeLabelStoreFileName(dbbasepath, shard.Id)
+
+	// The .data file is created last, as it makes the shard visible.
+	if shard.DataFile != nil {
+		err := replaceFile(labelsfile, shard.LabelsFile, 0)
+		if err == nil {
+			err = replaceFile(datafile, shard.DataFile, 0)
+		}
+		return err
+	}
+	if shard.DataHeader != nil {
+		err := replaceFile(labelsfile, shard.LabelsHeader, shard.LabelsSize)
+		if err == nil {
+			err = replaceFile(datafile, shard.DataHeader, shard.DataSize)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	raw, err := mmapForSync(labelsfile, shard.LabelsSize)
+	if err != nil {
+		return err
+	}
+	if shard.LabelsFrom+len(shard.Labels) > len(raw) {
+		unix.Munmap(raw)
+		return fmt.Errorf("labels end at %d, after the end of the file", shard.LabelsFrom+len(shard.Labels))
+	}
+	copy(raw[shard.LabelsFrom:], shard.Labels)
+	unix.Munmap(raw)
+
+	data, err := mmapForSync(datafile, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Munmap(data)
+	start := GetHeaderSize() + int(shard.From)
+	if start+len(shard.Entries) > len(data) || shard.Cursor != shard.From+uint64(len(shard.Entries)) {
+		return fmt.Errorf("entries from %d to %d do not fit the file", shard.From, shard.Cursor)
+	}
+	copy(data[start:], shard.Entries)
+	atomic.StoreUint64((*uint64)(unsafe.Pointer(&data[8])), shard.Cursor)
+	return nil
+}
+
+// A Follower replicates the series of a primary MetricsServer into a
+// local directory, which can be read as any other, see ReadSync.
+type Follower struct {
+	// URL of the sync handler of the primary.
+	URL string
+	// Directory to copy the series into.
+	Path   string
+	Client *http.Client
+}
+
+func NewFollower(url, path string) *Follower {
+	return &Follower{url, path, http.DefaultClient}
+}
+
+// Copies all the changes of the primary since the last call, or since
+// the follower stopped, as the position is read from the local files.
+// Returns the number of shards changed.
+func (f *Follower) Sync() (int, error) {
+	changed := 0
+	for {
+		request := SyncRequest{make(map[string]SyncPosition)}
+		for _, serie := range FindSeries(f.Path) {
+			name, err := filepath.Rel(f.Path, serie)
+			if err != nil {
+				return changed, err
+			}
+			position, ok, err := LocalSyncPosition(serie)
+			if err != nil {
+				return changed, err
+			}
+			if ok {
+				request.Serie[filepath.ToSlash(name)] = position
+			}
+		}
+
+		reply, err := f.request(request)
+		if err != nil {
+			return changed, err
+		}
+		for name, ss := range reply.Serie {
+			// Names come from the network, do not write outside of Path.
+			err := ValidSerieName(name)
+			if err != nil {
+				return changed, err
+			}
+			path := filepath.Join(f.Path, filepath.FromSlash(name))
+			err = os.MkdirAll(filepath.Dir(path), 0777)
+			if err == nil {
+				err = ApplySync(path, ss)
+			}
+			if err != nil {
+				return changed, fmt.Errorf("serie %s: %s", name, err)
+			}
+			changed += len(ss.Shard)
+		}
+		if !reply.Truncated {
+			return changed, nil
+		}
+	}
+}
+
+func (f *Follower) request(request SyncRequest) (*SyncReply, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := f.Client.Post(f.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		return nil, fmt.Errorf("primary returned %s: %s", response.Status, bytes.TrimSpace(message))
+	}
+
+	reply := &SyncReply{}
+	err = json.NewDecoder(response.Body).Decode(reply)
+	return reply, err
+}
@@ -0,0 +1,132 @@
+package tsdb
+
+import (
+	"os"
+)
+
+// RetentionOptions define when old shards of a serie are removed.
+// A shard is only removed as a whole, together with its labels, so
+// a serie may keep more data than strictly required.
+type RetentionOptions struct {
+	// Remove shards whose points are all older than MaxAge, measured
+	// from the time of the last point in the serie, and in the same unit.
+	// 0 to keep shards regardless of their age.
+	MaxAge uint64
+	// Remove the oldest shards until the files of the serie use at most
+	// MaxBytes on disk. 0 to keep shards regardless of their size.
+	MaxBytes int64
+	// Remove the oldest shards until the serie has at most MaxShards.
+	// 0 to keep shards regardless of their number.
+	MaxShards int
+}
+
+func DefaultRetentionOptions() RetentionOptions {
+	return RetentionOptions{0, 0, 0}
+}
+
+func (ro RetentionOptions) Enabled() bool {
+	return ro.MaxAge > 0 || ro.MaxBytes > 0 || ro.MaxShards > 0
+}
+
+// Removes a shard from disk. The data file is removed first, so readers
+// stop considering the shard before its labels disappear.
+func RemoveShard(dbbasepath string, id uint32) error {
+	err := os.Remove(MakeDataStoreFileName(dbbasepath, id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(MakeLabelStoreFileName(dbbasepath, id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(MakeIndexFileName(dbbasepath, id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func getFileSize(filename string) int64 {
+	st, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return st.Size()
+}
+
+// Removes the oldest shards of the serie, as required by the RetentionOptions.
+// The shard being written is never removed.
+//
+// Expire is invoked automatically every time a shard fills up, but can be
+// called at any time by the owner of the serie.
+func (s *SerieWriter) Expire() error {
+	if !s.RetentionOptions.Enabled() || s.dw == nil {
+		return nil
+	}
+
+	type candidate struct {
+		id      uint32
+		size    int64
+		mintime uint64
+	}
+	candidates := []candidate{}
+	total := int64(0)
+	for _, filename := range GetDataFiles(s.Path) {
+		id := ParseFileName(s.Path, filename)
+		if id == 0 || id > s.Id {
+			continue
+		}
+
+		point, _, err := PeekDataStore(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		size := getFileSize(filename) + getFileSize(MakeLabelStoreFileName(s.Path, id)) + getFileSize(MakeIndexFileName(s.Path, id))
+		candidates = append(candidates, candidate{id, size, point.Time})
+		total += size
+	}
+	if len(candidates) <= 1 {
+		return nil
+	}
+
+	// Shards that can be removed, starting from the oldest. The last one is being written.
+	toremove := 0
+	if s.MaxShards > 0 && len(candidates) > s.MaxShards {
+		toremove = len(candidates) - s.MaxShards
+	}
+	if s.MaxBytes > 0 {
+		size := total
+		for i := 0; i < len(candidates)-1 && size > s.MaxBytes; i++ {
+			size -= candidates[i].size
+			if i+1 > toremove {
+				toremove = i + 1
+			}
+		}
+	}
+	if s.MaxAge > 0 && s.dw.GetEntries() > 0 {
+		last, _, _ := s.dw.GetOne(-1)
+		if last > s.MaxAge {
+			cutoff := last - s.MaxAge
+			// All points in a shard are older than the first point of the following shard.
+			for i := 0; i < len(candidates)-1 && candidates[i+1].mintime <= cutoff; i++ {
+				if i+1 > toremove {
+					toremove = i + 1
+				}
+			}
+		}
+	}
+	if toremove > len(candidates)-1 {
+		toremove = len(candidates) - 1
+	}
+
+	for _, candidate := range candidates[:toremove] {
+		err := RemoveShard(s.Path, candidate.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
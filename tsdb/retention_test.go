@@ -0,0 +1,93 @@
+package tsdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRetentionMaxShards(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.MaxShards = 3
+	err = s.Open()
+	assert.Nil(t, err)
+
+	// Keep a reader open while shards are removed underneath it.
+	r := NewSerieReader(filepath.Join(tempdir, "test"))
+	for i := uint64(0); i < 2000; i++ {
+		err := s.Append(i, i+1024, []string{"foo"})
+		assert.Nil(t, err)
+
+		if i%100 == 0 {
+			err = r.ReloadShards()
+			assert.Nil(t, err)
+			data, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+			assert.Nil(t, err)
+			assert.Equal(t, i, data[len(data)-1].Time)
+			assert.True(t, len(r.shard) <= 3)
+		}
+	}
+	s.Close()
+
+	files := GetDataFiles(filepath.Join(tempdir, "test"))
+	assert.Equal(t, 3, len(files))
+	assert.Equal(t, uint32(14), ParseFileName(filepath.Join(tempdir, "test"), files[0]))
+
+	r = NewSerieReader(filepath.Join(tempdir, "test"))
+	err = r.Open()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(r.shard))
+	data, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2*127+95, len(data))
+	assert.Equal(t, uint64(13*127), data[0].Time)
+	assert.Equal(t, []string{"foo"}, data[0].Label)
+}
+
+func TestRetentionMaxAgeAndBytes(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.MaxAge = 500
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := uint64(0); i < 2000; i++ {
+		err := s.Append(i, i, nil)
+		assert.Nil(t, err)
+	}
+
+	r := NewSerieReader(filepath.Join(tempdir, "test"))
+	err = r.Open()
+	assert.Nil(t, err)
+	first := r.FirstLocation()
+	data, err := r.GetData(first, first.Plus(r, 1), nil)
+	assert.Nil(t, err)
+	// The oldest point kept must be within 500 + a shard from the last one.
+	assert.True(t, data[0].Time <= 1999-500)
+	assert.True(t, data[0].Time > 1999-500-127)
+
+	// Limit the size to roughly 2 shards.
+	size := getFileSize(MakeDataStoreFileName(s.Path, s.Id)) + getFileSize(MakeLabelStoreFileName(s.Path, s.Id))
+	s.MaxAge = 0
+	s.MaxBytes = 2 * size
+	err = s.Expire()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(GetDataFiles(s.Path)))
+	s.Close()
+
+	err = r.ReloadShards()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(r.shard))
+	data, err = r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 127+95, len(data))
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"github.com/ccontavalli/goutils/httpu"
@@ -9,55 +10,604 @@ import (
 	"net/http"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 type lockedSerie struct {
 	lock   sync.RWMutex
 	reader *tsdb.SerieReader
+	// Returned by List, nil until computed, refreshed by Rescan.
+	info *SerieInfo
 }
 
 type MetricsServer struct {
 	MaxEntriesPerReply int
 
+	// Bearer tokens accepted by Put. Writes are refused if empty.
+	WriteTokens []string
+	// Maximum size in bytes of the body of a Put request.
+	MaxPutBytes int64
+	// Writers used by Put. Options can be changed before the first write.
+	Writers *tsdb.WriterPool
+	// How often Tail checks for new points.
+	TailInterval time.Duration
+	// Maximum number of shards each serie keeps mapped in memory, see
+	// SerieReader. Applies to the series opened after it is changed.
+	MaxLoadedShards int
+	// Limits the shards mapped in memory by all the series together, to
+	// 256 by default. Each serie in use may keep one more loaded, until
+	// Rescan unloads the shards of the series not in use.
+	LoadedShards *tsdb.ShardBudget
+	// Maximum bytes of entries and labels returned by each Sync request.
+	MaxSyncBytes int
+	// Maximum size in bytes of the body of a Sync request, which grows
+	// with the number of series of the follower.
+	MaxSyncRequestBytes int64
+
 	basepath string
-	sr       map[string]*lockedSerie
+	lock     sync.RWMutex
+	// Series by name, relative to basepath, like cpu, or web1/cpu.
+	sr map[string]*lockedSerie
+	// Closed to stop Watch.
+	done chan struct{}
 }
 
+// Creates a MetricsServer for the series in path, and its subdirectories.
 func New(path string) (*MetricsServer, error) {
-	sr := make(map[string]*lockedSerie)
-	series := tsdb.GetSeries(path)
-	for _, serie := range series {
-		basename := filepath.Base(serie)
-		sr[basename] = &lockedSerie{}
+	ms := &MetricsServer{1000, nil, 16 * 1048576, tsdb.NewWriterPool(path), 500 * time.Millisecond, tsdb.DefaultMaxLoadedShards, tsdb.NewShardBudget(256), 16 * 1048576, 4 * 1048576, path, sync.RWMutex{}, make(map[string]*lockedSerie), make(chan struct{})}
+	ms.Rescan()
+	return ms, nil
+}
+
+// Closes the writers opened by Put, and stops Watch.
+func (ms *MetricsServer) Close() {
+	ms.Writers.Close()
+	select {
+	case <-ms.done:
+	default:
+		close(ms.done)
+	}
+}
+
+// Updates the series known to the server with the ones on disk. Series
+// created since the last scan are added, removed ones are forgotten, and
+// the stats and metadata returned by List are refreshed. Shards loaded
+// past the LoadedShards budget are unloaded.
+func (ms *MetricsServer) Rescan() {
+	found := make(map[string]bool)
+	for _, serie := range tsdb.FindSeries(ms.basepath) {
+		name, err := filepath.Rel(ms.basepath, serie)
+		if err != nil {
+			continue
+		}
+		found[filepath.ToSlash(name)] = true
+	}
+
+	removed := []*lockedSerie{}
+	kept := make(map[string]*lockedSerie)
+	ms.lock.Lock()
+	for name := range found {
+		if _, ok := ms.sr[name]; !ok {
+			ms.sr[name] = &lockedSerie{}
+		}
+	}
+	for name, sr := range ms.sr {
+		if !found[name] {
+			delete(ms.sr, name)
+			removed = append(removed, sr)
+		} else {
+			kept[name] = sr
+		}
+	}
+	ms.lock.Unlock()
+
+	for name, sr := range kept {
+		ms.readInfo(name, sr)
+	}
+	// Release the shards of the series not in use, if others need them.
+	for _, sr := range kept {
+		sr.lock.Lock()
+		if sr.reader != nil {
+			sr.reader.Trim()
+		}
+		sr.lock.Unlock()
 	}
 
-	return &MetricsServer{1000, path, sr}, nil
+	// Requests still in progress can keep using the readers, which load
+	// shards again as needed, and fail once the files are gone.
+	for _, sr := range removed {
+		sr.lock.Lock()
+		if sr.reader != nil {
+			sr.reader.Close()
+		}
+		sr.lock.Unlock()
+	}
+}
+
+// Calls Rescan every interval, in background, until Close is called.
+// Also closes the writers idle for Writers.MaxIdle, so other processes
+// can lock the series.
+func (ms *MetricsServer) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ms.done:
+				return
+			case <-ticker.C:
+				ms.Rescan()
+				ms.Writers.CloseIdle()
+			}
+		}
+	}()
 }
 
 func (ms *MetricsServer) Register(url string, mux *http.ServeMux) {
 	mux.HandleFunc(path.Join(url, "list"), ms.List)
+	mux.HandleFunc(path.Join(url, "put"), ms.Put)
+	mux.HandleFunc(path.Join(url, "tail")+"/", ms.Tail)
+	mux.HandleFunc(path.Join(url, "meta")+"/", ms.Meta)
+	mux.HandleFunc(path.Join(url, "sync"), ms.Sync)
 	mux.HandleFunc(path.Join(url, "get", "offset")+"/", ms.GetOffset)
 	mux.HandleFunc(path.Join(url, "get", "range")+"/", ms.GetRange)
+	mux.HandleFunc(path.Join(url, "get", "stream")+"/", ms.GetStream)
+	mux.HandleFunc(path.Join(url, "get", "labels")+"/", ms.GetLabels)
+}
+
+// Parameters to downsample the returned points.
+type AggregateRequest struct {
+	// Size of the time buckets to group points into. 0 to return all points.
+	Step uint64 `json:"step,omitempty"`
+	// How to compute the value of each bucket. One of tsdb.Aggregates,
+	// "avg" by default.
+	Aggregate string `json:"aggregate,omitempty"`
+}
+
+// Returns the summarizer to use to satisfy the request, nil if all points
+// have to be returned.
+func (ar *AggregateRequest) summarizer() (tsdb.Summarizer, error) {
+	if ar.Step == 0 {
+		if ar.Aggregate != "" {
+			return nil, fmt.Errorf("aggregate '%s' requires a step", ar.Aggregate)
+		}
+		return nil, nil
+	}
+	if ar.Aggregate == "" {
+		ar.Aggregate = "avg"
+	}
+	return tsdb.NewSummarizer(ar.Aggregate, ar.Step)
+}
+
+// Parameters to select the returned points by label.
+type LabelRequest struct {
+	// Only return points matching all the expressions, as accepted by
+	// tsdb.ParseLabelMatcher. For example, "host=web1", or "!canary".
+	Match []string `json:"match,omitempty"`
+	// If set, return the points in one group per distinct value of the
+	// label with this name.
+	GroupBy string `json:"groupby,omitempty"`
+}
+
+// Limits the number of points returned by getData, across calls.
+type pageLimit struct {
+	reader *tsdb.SerieReader
+	// Maximum number of points to return.
+	limit int
+	// Points returned so far, and location of the last one.
+	count int
+	last  tsdb.Location
+	// True if points past the limit were dropped.
+	dropped bool
+}
+
+// Returns a Summarizer that passes the points to summarizer, or returns
+// them as they are if nil, until the limit is reached.
+func (pl *pageLimit) wrap(summarizer tsdb.Summarizer) tsdb.Summarizer {
+	return func(points []tsdb.Point, location tsdb.Location, time, value uint64) []tsdb.Point {
+		if pl.count >= pl.limit {
+			pl.dropped = true
+			return points
+		}
+		pl.count += 1
+		pl.last = location
+		if summarizer == nil {
+			return append(points, tsdb.Point{Time: time, Value: value, Label: pl.reader.GetLabels(location, nil), Type: location.ValueType()})
+		}
+		return summarizer(points, location, time, value)
+	}
+}
+
+// Reads the points between start and end, as required by the request.
+// Returns the points, or the groups if a group by was requested.
+//
+// If limit is not nil, only the points within the limit are returned.
+func getData(reader *tsdb.SerieReader, start, end tsdb.Location, ar *AggregateRequest, lr *LabelRequest, limit *pageLimit) ([]tsdb.Point, []tsdb.Group, error) {
+	filter, err := tsdb.ParseLabelFilter(lr.Match)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if lr.GroupBy != "" {
+		groups, err := reader.GetGroupedData(start, end, lr.GroupBy, filter, func() tsdb.Summarizer {
+			summarizer, _ := ar.summarizer()
+			if limit != nil {
+				return limit.wrap(summarizer)
+			}
+			return summarizer
+		})
+		return nil, groups, err
+	}
+
+	summarizer, err := ar.summarizer()
+	if err != nil {
+		return nil, nil, err
+	}
+	if limit != nil {
+		summarizer = limit.wrap(summarizer)
+	}
+	points, err := reader.GetFilteredData(start, end, filter, summarizer)
+	return points, nil, err
+}
+
+// Merges the groups in other into groups, both sorted by value.
+func mergeGroups(groups, other []tsdb.Group) []tsdb.Group {
+	merged := make([]tsdb.Group, 0, len(groups)+len(other))
+	for len(groups) > 0 || len(other) > 0 {
+		switch {
+		case len(other) <= 0 || (len(groups) > 0 && groups[0].Value < other[0].Value):
+			merged, groups = append(merged, groups[0]), groups[1:]
+		case len(groups) <= 0 || other[0].Value < groups[0].Value:
+			merged, other = append(merged, other[0]), other[1:]
+		default:
+			merged = append(merged, tsdb.Group{Value: groups[0].Value, Point: append(groups[0].Point, other[0].Point...)})
+			groups, other = groups[1:], other[1:]
+		}
+	}
+	return merged
 }
 
 type getRangeRequest struct {
-	// Offset from the end of the first entry to get.
+	// Time of the first entry to get.
 	Start uint64 `json:"start"`
-	End   uint64 `json:"end"`
-	// Maximum number of entries to return.
+	// Time of the last entry to get, inclusive.
+	End uint64 `json:"end"`
+	// Maximum number of entries to return, counting only those matching
+	// the label filter. With a step, maximum number of buckets to return.
 	Entries int `json:"entries"`
+	// If set, continue reading from where the reply containing this
+	// cursor in Next stopped, rather than from Start.
+	Cursor string `json:"cursor,omitempty"`
+
+	AggregateRequest
+	LabelRequest
+}
+
+type getRangeReply struct {
+	// The request as interpreted by the server.
+	Request getRangeRequest `json:"request"`
+	// True if there were more points in the range than the server was
+	// willing to return. Only the first Request.Entries points are returned.
+	Truncated bool `json:"truncated"`
+	// If Truncated, cursor to send in the next request, unchanged
+	// otherwise, to get the following points.
+	Next  string       `json:"next,omitempty"`
+	Point []tsdb.Point `json:"point"`
+	// Set instead of Point when the request had a GroupBy.
+	Group []tsdb.Group `json:"group,omitempty"`
+}
+
+// Validates a range request, and returns the summarizer to use for it.
+func (rreq *getRangeRequest) validate(maxentries int) (tsdb.Summarizer, error) {
+	if rreq.End < rreq.Start {
+		return nil, fmt.Errorf("end must be >= start")
+	}
+	if rreq.Entries <= 0 || rreq.Entries >= maxentries {
+		rreq.Entries = maxentries
+	}
+	summarizer, err := rreq.summarizer()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tsdb.ParseLabelFilter(rreq.Match)
+	if err != nil {
+		return nil, err
+	}
+	return summarizer, nil
+}
+
+// Returns the locations of the first and last point of the range, as
+// selected by the Start, End, and Cursor of the request.
+//
+// Must be invoked with the lock held.
+func (rreq *getRangeRequest) locations(reader *tsdb.SerieReader) (tsdb.Location, tsdb.Location, error) {
+	var start tsdb.Location
+	if rreq.Cursor != "" {
+		var err error
+		start, err = reader.ParseCursor(rreq.Cursor)
+		if err != nil {
+			return start, start, err
+		}
+	} else {
+		start = reader.Find(func(time uint64) bool {
+			return time >= rreq.Start
+		})
+	}
+	end := reader.Find(func(time uint64) bool {
+		return time > rreq.End
+	})
+	if !start.Valid() || !end.Valid() {
+		return start, end, fmt.Errorf("could not read serie")
+	}
+	if end.Before(start) {
+		end = start
+	}
+	return start, end, nil
+}
+
+// Reads a page of at most Entries points, or buckets, between start and end.
+// Returns the cursor the next page starts at, and true if the page was
+// truncated.
+//
+// Must be invoked with the lock held.
+func (rreq *getRangeRequest) readPage(reader *tsdb.SerieReader, start, end tsdb.Location) ([]tsdb.Point, []tsdb.Group, string, bool, error) {
+	if rreq.Step == 0 {
+		return rreq.readPoints(reader, start, end)
+	}
+
+	// Limit the range to the maximum number of buckets that can be returned.
+	// When resuming from a cursor, the page starts at the first point left.
+	truncated := false
+	first := rreq.Start
+	if rreq.Cursor != "" {
+		// Skip over the seal marker, in case start points to it.
+		points, err := reader.GetData(start, start.Plus(reader, 2), nil)
+		if err != nil {
+			return nil, nil, "", false, err
+		}
+		if len(points) > 0 && points[0].Time > first {
+			first = points[0].Time
+		}
+	}
+
+	maxend := first - first%rreq.Step + uint64(rreq.Entries)*rreq.Step - 1
+	if maxend >= first && maxend < rreq.End {
+		limit := reader.Find(func(time uint64) bool {
+			return time > maxend
+		})
+		if limit.Valid() && limit.Before(end) {
+			end = limit
+			truncated = true
+		}
+	}
+
+	points, groups, err := getData(reader, start, end, &rreq.AggregateRequest, &rreq.LabelRequest, nil)
+	return points, groups, end.Cursor(), truncated, err
+}
+
+// Reads a page of at most Entries points between start and end, as
+// readPage does without a step.
+//
+// The limit applies to the points matching the label filter, so the entries
+// are read in windows growing in size, until enough points are found. The
+// next page starts after the last point returned.
+func (rreq *getRangeRequest) readPoints(reader *tsdb.SerieReader, start, end tsdb.Location) ([]tsdb.Point, []tsdb.Group, string, bool, error) {
+	limit := &pageLimit{reader: reader, limit: rreq.Entries}
+	points, groups := []tsdb.Point{}, []tsdb.Group(nil)
+	window, to := rreq.Entries, start
+	for from := start; limit.count < limit.limit; from = to {
+		to = from.Plus(reader, window)
+		if !to.Before(end) {
+			to = end
+		}
+		more, grouped, err := getData(reader, from, to, &rreq.AggregateRequest, &rreq.LabelRequest, limit)
+		if err != nil {
+			return nil, nil, "", false, err
+		}
+		points = append(points, more...)
+		if rreq.GroupBy != "" {
+			groups = mergeGroups(groups, grouped)
+		}
+		if !to.Before(end) {
+			break
+		}
+		window *= 2
+	}
+	if rreq.GroupBy != "" {
+		points = nil
+	}
+	truncated := limit.dropped || (limit.count >= limit.limit && to.Before(end))
+	if !truncated {
+		return points, groups, "", false, nil
+	}
+	return points, groups, reader.CursorAfter(limit.last), true, nil
 }
 
 func (ms *MetricsServer) GetRange(w http.ResponseWriter, r *http.Request) {
+	sr := ms.getSerieReader("/get/range/", w, r)
+	if sr == nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	rreq := getRangeRequest{}
+	err := decoder.Decode(&rreq)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not decode request '%s'", err), http.StatusBadRequest)
+		return
+	}
+	_, err = rreq.validate(ms.MaxEntriesPerReply)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request '%s'", err), http.StatusBadRequest)
+		return
+	}
+
+	rrep := getRangeReply{}
+	rrep.Request = rreq
+
+	sr.lock.Lock()
+	start, end, err := rreq.locations(sr.reader)
+	if err != nil {
+		sr.lock.Unlock()
+		http.Error(w, fmt.Sprintf("invalid request '%s'", err), http.StatusBadRequest)
+		return
+	}
+
+	var next string
+	rrep.Point, rrep.Group, next, rrep.Truncated, err = rreq.readPage(sr.reader, start, end)
+	if rrep.Truncated {
+		rrep.Next = next
+	}
+	sr.lock.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read serie '%s'", err), http.StatusInternalServerError)
+		return
+	}
+
+	httpu.SendJsonReply(w, rrep)
+}
+
+type getLabelsRequest struct {
+	// Time of the first entry to consider.
+	Start uint64 `json:"start"`
+	// Time of the last entry to consider, inclusive.
+	End uint64 `json:"end"`
+}
+
+type getLabelsReply struct {
+	Request getLabelsRequest `json:"request"`
+	// Labels of the points in the range, sorted.
+	Label []string `json:"label"`
+}
+
+// Returns the labels of the points in a time range, each one once.
+func (ms *MetricsServer) GetLabels(w http.ResponseWriter, r *http.Request) {
+	sr := ms.getSerieReader("/get/labels/", w, r)
+	if sr == nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	lreq := getLabelsRequest{}
+	err := decoder.Decode(&lreq)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not decode request '%s'", err), http.StatusBadRequest)
+		return
+	}
+	if lreq.End < lreq.Start {
+		http.Error(w, "invalid request 'end must be >= start'", http.StatusBadRequest)
+		return
+	}
+
+	lrep := getLabelsReply{}
+	lrep.Request = lreq
+
+	sr.lock.Lock()
+	rreq := getRangeRequest{Start: lreq.Start, End: lreq.End}
+	start, end, err := rreq.locations(sr.reader)
+	if err == nil {
+		lrep.Label, err = sr.reader.ListLabels(start, end)
+	}
+	sr.lock.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read serie '%s'", err), http.StatusInternalServerError)
+		return
+	}
+
+	httpu.SendJsonReply(w, lrep)
+}
+
+// Returns all the points in the range as a stream of json objects, one
+// per line (ndjson), with no limit on the number of points returned.
+// The request is the same as for GetRange, except that GroupBy is not
+// supported, and Entries is ignored.
+//
+// Points are read in pages of MaxEntriesPerReply, so writers are not
+// blocked for the whole duration of the request. If an error happens
+// while streaming, the last line is an object with an "error" field.
+func (ms *MetricsServer) GetStream(w http.ResponseWriter, r *http.Request) {
+	sr := ms.getSerieReader("/get/stream/", w, r)
+	if sr == nil {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	rreq := getRangeRequest{}
+	err := decoder.Decode(&rreq)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not decode request '%s'", err), http.StatusBadRequest)
+		return
+	}
+	if rreq.GroupBy != "" {
+		http.Error(w, "invalid request 'groupby is not supported when streaming'", http.StatusBadRequest)
+		return
+	}
+	rreq.Entries = 0
+	_, err = rreq.validate(ms.MaxEntriesPerReply)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request '%s'", err), http.StatusBadRequest)
+		return
+	}
+
+	sr.lock.Lock()
+	start, _, err := rreq.locations(sr.reader)
+	if err == nil && rreq.Cursor == "" {
+		rreq.Cursor = start.Cursor()
+	}
+	sr.lock.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request '%s'", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for {
+		var points []tsdb.Point
+		var end tsdb.Location
+		truncated := false
+
+		sr.lock.Lock()
+		// Shards may have been added or removed while the lock was released,
+		// invalidating the locations, but not the cursors.
+		start, end, err = rreq.locations(sr.reader)
+		if err == nil {
+			points, _, rreq.Cursor, truncated, err = rreq.readPage(sr.reader, start, end)
+		}
+		sr.lock.Unlock()
+		if err != nil {
+			encoder.Encode(map[string]string{"error": fmt.Sprintf("could not read serie '%s'", err)})
+			return
+		}
+
+		for _, point := range points {
+			err := encoder.Encode(point)
+			if err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if !truncated {
+			return
+		}
+	}
 }
 
 type GetOffsetRequest struct {
 	// Offset from the end of the first entry to get.
 	Start uint64 `json:"start"`
-	// How many entries to retrieve.
+	// How many entries to retrieve. With a step, how many buckets to
+	// retrieve, ending with the bucket containing the last entry.
 	Entries int `json:"entries"`
+
+	AggregateRequest
+	LabelRequest
 }
 
 type GetOffsetReply struct {
@@ -67,7 +617,11 @@ type GetOffsetReply struct {
 	// the # of pointers returned against the entries the server was
 	// willing to return.
 	Request GetOffsetRequest `json:"request"`
-	Point   []tsdb.Point     `json:"point"`
+	// Cursor to send to get/range to get the points added after this reply.
+	Next  string       `json:"next"`
+	Point []tsdb.Point `json:"point"`
+	// Set instead of Point when the request had a GroupBy.
+	Group []tsdb.Group `json:"group,omitempty"`
 }
 
 func (ms *MetricsServer) getSerieReader(handler string, w http.ResponseWriter, r *http.Request) *lockedSerie {
@@ -80,26 +634,58 @@ func (ms *MetricsServer) getSerieReader(handler string, w http.ResponseWriter, r
 	}
 
 	serie := path[index+len(tostrip):]
-	sr, ok := ms.sr[serie]
-	if !ok {
+	sr := ms.getSerie(serie)
+	if sr == nil {
 		http.Error(w, fmt.Sprintf("unknown serie '%s'", serie), http.StatusBadRequest)
 		return nil
 	}
 
-	if sr.reader == nil {
-		sr.lock.Lock()
-		sr.reader = tsdb.NewSerieReader(filepath.Join(ms.basepath, serie))
-		err := sr.reader.Open()
-		sr.lock.Unlock()
-		if err != nil {
-			http.Error(w, fmt.Sprintf("unknown serie '%s'", serie), http.StatusInternalServerError)
-			return nil
-		}
+	err := ms.openSerie(serie, sr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unknown serie '%s'", serie), http.StatusInternalServerError)
+		return nil
 	}
-
 	return sr
 }
 
+// Returns the serie with the specified name, nil if it does not exist.
+// Series created on disk since the last Rescan are found as well.
+func (ms *MetricsServer) getSerie(serie string) *lockedSerie {
+	ms.lock.RLock()
+	sr, ok := ms.sr[serie]
+	ms.lock.RUnlock()
+	if ok {
+		return sr
+	}
+
+	if tsdb.ValidSerieName(serie) != nil || len(tsdb.GetDataFiles(filepath.Join(ms.basepath, serie))) <= 0 {
+		return nil
+	}
+	ms.addSerie(serie)
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.sr[serie]
+}
+
+// Creates the reader of the serie, if not created already.
+func (ms *MetricsServer) openSerie(serie string, sr *lockedSerie) error {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	if sr.reader != nil {
+		return nil
+	}
+
+	reader := tsdb.NewSerieReader(filepath.Join(ms.basepath, serie))
+	reader.MaxLoadedShards = ms.MaxLoadedShards
+	reader.Budget = ms.LoadedShards
+	err := reader.Open()
+	if err != nil {
+		return err
+	}
+	sr.reader = reader
+	return nil
+}
+
 func (ms *MetricsServer) GetOffset(w http.ResponseWriter, r *http.Request) {
 	sr := ms.getSerieReader("/get/offset/", w, r)
 	if sr == nil {
@@ -117,20 +703,252 @@ func (ms *MetricsServer) GetOffset(w http.ResponseWriter, r *http.Request) {
 	if oreq.Entries <= 0 || oreq.Entries >= ms.MaxEntriesPerReply {
 		oreq.Entries = ms.MaxEntriesPerReply
 	}
+	summarizer, err := oreq.summarizer()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request '%s'", err), http.StatusBadRequest)
+		return
+	}
+	_, err = tsdb.ParseLabelFilter(oreq.Match)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request '%s'", err), http.StatusBadRequest)
+		return
+	}
 
 	orep := GetOffsetReply{}
 	orep.Request = oreq
 
 	sr.lock.Lock()
 	end := sr.reader.LastLocation()
-	start := end.Minus(sr.reader, oreq.Entries)
-	orep.Point, err = sr.reader.GetData(start, end, nil)
+	if !end.Valid() {
+		sr.lock.Unlock()
+		http.Error(w, "could not read serie", http.StatusInternalServerError)
+		return
+	}
+	start := end.Minus(sr.reader, 1)
+	if summarizer == nil {
+		start = end.Minus(sr.reader, oreq.Entries)
+	} else if last, err := sr.reader.GetData(start, end, nil); err == nil && len(last) > 0 {
+		// Find the first point of the oldest bucket to return.
+		mintime := last[0].Time - last[0].Time%oreq.Step
+		if span := uint64(oreq.Entries-1) * oreq.Step; mintime > span {
+			mintime -= span
+		} else {
+			mintime = 0
+		}
+		start = sr.reader.Find(func(time uint64) bool {
+			return time >= mintime
+		})
+	}
+	orep.Point, orep.Group, err = getData(sr.reader, start, end, &oreq.AggregateRequest, &oreq.LabelRequest, nil)
+	orep.Next = end.Cursor()
 	sr.lock.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read serie '%s'", err), http.StatusInternalServerError)
+		return
+	}
 
 	httpu.SendJsonReply(w, orep)
 }
 
+// A serie returned by List.
+type SerieInfo struct {
+	Name string `json:"name"`
+	tsdb.SerieStats
+	Meta tsdb.SerieMeta `json:"meta"`
+	// Why the metadata could not be read, if so. Meta is empty then.
+	Error string `json:"error,omitempty"`
+}
+
+// Computes the SerieInfo returned by List for a serie, and keeps it in
+// the serie. Returns nil if the serie cannot be read, as when removed
+// since it was found.
+func (ms *MetricsServer) readInfo(serie string, sr *lockedSerie) *SerieInfo {
+	if ms.openSerie(serie, sr) != nil {
+		return nil
+	}
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	stats, err := sr.reader.Stats()
+	if err != nil {
+		return nil
+	}
+	// A serie with invalid metadata is still listed, with the error.
+	info := &SerieInfo{serie, stats, tsdb.SerieMeta{}, ""}
+	meta, err := sr.reader.Meta()
+	if err != nil {
+		info.Error = err.Error()
+	} else {
+		info.Meta = meta
+	}
+	sr.info = info
+	return info
+}
+
+// Returns the series known to the server, sorted by name, with their
+// first and last time, number of entries, and metadata. A serie whose
+// metadata can not be read is listed with empty metadata and the error.
+//
+// Stats and metadata are as of the last Rescan, or of the first List
+// after the serie was found, so listing many series is cheap. Use Watch
+// to keep them up to date.
 func (ms *MetricsServer) List(w http.ResponseWriter, r *http.Request) {
+	ms.lock.RLock()
 	keys := misc.StringKeysOrPanic(ms.sr)
-	httpu.SendJsonReply(w, keys)
+	ms.lock.RUnlock()
+	sort.Strings(keys)
+
+	series := []SerieInfo{}
+	for _, key := range keys {
+		sr := ms.getSerie(key)
+		if sr == nil {
+			continue
+		}
+		sr.lock.RLock()
+		info := sr.info
+		sr.lock.RUnlock()
+		if info == nil {
+			info = ms.readInfo(key, sr)
+		}
+		if info != nil {
+			series = append(series, *info)
+		}
+	}
+	httpu.SendJsonReply(w, series)
+}
+
+// Returns the metadata of a serie, as set with SerieWriter.SetMeta.
+func (ms *MetricsServer) Meta(w http.ResponseWriter, r *http.Request) {
+	sr := ms.getSerieReader("/meta/", w, r)
+	if sr == nil {
+		return
+	}
+
+	sr.lock.Lock()
+	meta, err := sr.reader.Meta()
+	sr.lock.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read metadata '%s'", err), http.StatusInternalServerError)
+		return
+	}
+	httpu.SendJsonReply(w, meta)
+}
+
+// Points to append to a serie.
+type PutSerie struct {
+	// Name of the serie, created if it does not exist.
+	Name  string       `json:"name"`
+	Point []tsdb.Point `json:"point"`
+}
+
+type PutRequest struct {
+	Serie []PutSerie `json:"serie"`
+}
+
+type PutReply struct {
+	// Number of points written.
+	Written int `json:"written"`
+}
+
+// Returns true if the request carries one of the WriteTokens.
+func (ms *MetricsServer) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for _, valid := range ms.WriteTokens {
+		if subtle.ConstantTimeCompare(token, []byte(valid)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Makes a serie created by Put visible to the read handlers.
+func (ms *MetricsServer) addSerie(serie string) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, ok := ms.sr[serie]; !ok {
+		ms.sr[serie] = &lockedSerie{}
+	}
+}
+
+// Appends the points in a PutRequest to their series, creating the series
+// that do not exist yet. Requests must be authenticated with an
+// "Authorization: Bearer <token>" header, with one of the WriteTokens.
+func (ms *MetricsServer) Put(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed - use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ms.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized - a valid bearer token is required", http.StatusUnauthorized)
+		return
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, ms.MaxPutBytes))
+	preq := PutRequest{}
+	err := decoder.Decode(&preq)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not decode request '%s'", err), http.StatusBadRequest)
+		return
+	}
+	// Validate the whole request first, so invalid requests write nothing.
+	for _, serie := range preq.Serie {
+		if err := tsdb.ValidSerieName(serie.Name); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request '%s'", err), http.StatusBadRequest)
+			return
+		}
+		for _, point := range serie.Point {
+			// Reserved to mark the end of sealed shards.
+			if point.Time == tsdb.SealMarker {
+				http.Error(w, fmt.Sprintf("invalid request 'time of points in serie %s cannot be 0xfff... (-1)'", serie.Name), http.StatusBadRequest)
+				return
+			}
+			if len(point.Label) > ms.Writers.LabelsPerEntry {
+				http.Error(w, fmt.Sprintf("invalid request 'points in serie %s cannot have more than %d labels'", serie.Name, ms.Writers.LabelsPerEntry), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	prep := PutReply{}
+	for _, serie := range preq.Serie {
+		err := ms.Writers.Append(serie.Name, serie.Point)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not write serie %s after writing %d points '%s'", serie.Name, prep.Written, err), http.StatusInternalServerError)
+			return
+		}
+		ms.addSerie(serie.Name)
+		prep.Written += len(serie.Point)
+	}
+	httpu.SendJsonReply(w, prep)
+}
+
+// Returns the changes to the series since the position of a follower, as
+// a tsdb.SyncReply, to replicate them with a tsdb.Follower. The request
+// is a tsdb.SyncRequest.
+func (ms *MetricsServer) Sync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed - use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, ms.MaxSyncRequestBytes))
+	sreq := tsdb.SyncRequest{}
+	err := decoder.Decode(&sreq)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not decode request '%s'", err), http.StatusBadRequest)
+		return
+	}
+
+	srep, err := tsdb.ReadSync(ms.basepath, sreq, ms.MaxSyncBytes)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read series '%s'", err), http.StatusInternalServerError)
+		return
+	}
+	httpu.SendJsonReply(w, srep)
 }
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ccontavalli/goutils/tsdb"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Starts a MetricsServer on a temporary directory, with a serie "test" of
+// 300 points, every 10th with label "host=a", the others "host=b".
+func newTestServer(t *testing.T) (*MetricsServer, *httptest.Server, string) {
+	tempdir, err := ioutil.TempDir("", "server-")
+	assert.Nil(t, err)
+
+	s := tsdb.NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	assert.Nil(t, s.Open())
+	for i := uint64(1); i <= 300; i++ {
+		host := "host=b"
+		if i%10 == 0 {
+			host = "host=a"
+		}
+		assert.Nil(t, s.Append(i, i, []string{host}))
+	}
+	s.Close()
+
+	ms, err := New(tempdir)
+	assert.Nil(t, err)
+	mux := http.NewServeMux()
+	ms.Register("/", mux)
+	return ms, httptest.NewServer(mux), tempdir
+}
+
+// Posts request as json to url, and decodes the json reply in reply.
+func postJson(t *testing.T, url string, request, reply interface{}) int {
+	body, err := json.Marshal(request)
+	assert.Nil(t, err)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && reply != nil {
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(reply))
+	}
+	return resp.StatusCode
+}
+
+func TestGetRangePaging(t *testing.T) {
+	ms, hs, tempdir := newTestServer(t)
+	defer os.RemoveAll(tempdir)
+	defer ms.Close()
+	defer hs.Close()
+
+	// The limit applies to the points matching the filter.
+	times := []uint64{}
+	rreq := getRangeRequest{Start: 0, End: 1000, Entries: 7, LabelRequest: LabelRequest{Match: []string{"host=a"}}}
+	for pages := 1; ; pages++ {
+		rrep := getRangeReply{}
+		assert.Equal(t, http.StatusOK, postJson(t, hs.URL+"/get/range/test", rreq, &rrep))
+		if rrep.Truncated {
+			assert.Equal(t, 7, len(rrep.Point))
+		}
+		for _, point := range rrep.Point {
+			assert.Equal(t, []string{"host=a"}, point.Label)
+			times = append(times, point.Time)
+		}
+		if !rrep.Truncated {
+			assert.Equal(t, 5, pages)
+			break
+		}
+		assert.NotEqual(t, "", rrep.Next)
+		rreq.Cursor = rrep.Next
+	}
+	assert.Equal(t, 30, len(times))
+	for i, time := range times {
+		assert.Equal(t, uint64(i+1)*10, time)
+	}
+
+	// Without filter, pages end where the limit is reached.
+	rrep := getRangeReply{}
+	rreq = getRangeRequest{Start: 5, End: 1000, Entries: 50}
+	assert.Equal(t, http.StatusOK, postJson(t, hs.URL+"/get/range/test", rreq, &rrep))
+	assert.True(t, rrep.Truncated)
+	assert.Equal(t, 50, len(rrep.Point))
+	assert.Equal(t, uint64(54), rrep.Point[49].Time)
+	rreq.Cursor = rrep.Next
+	assert.Equal(t, http.StatusOK, postJson(t, hs.URL+"/get/range/test", rreq, &rrep))
+	assert.Equal(t, uint64(55), rrep.Point[0].Time)
+
+	// Groups are limited in the same way.
+	rrep = getRangeReply{}
+	rreq = getRangeRequest{Start: 0, End: 1000, Entries: 15, LabelRequest: LabelRequest{GroupBy: "host"}}
+	assert.Equal(t, http.StatusOK, postJson(t, hs.URL+"/get/range/test", rreq, &rrep))
+	assert.True(t, rrep.Truncated)
+	assert.Equal(t, 2, len(rrep.Group))
+	assert.Equal(t, "a", rrep.Group[0].Value)
+	assert.Equal(t, 1, len(rrep.Group[0].Point))
+	assert.Equal(t, 14, len(rrep.Group[1].Point))
+}
+
+func TestGetRangeStepPaging(t *testing.T) {
+	ms, hs, tempdir := newTestServer(t)
+	defer os.RemoveAll(tempdir)
+	defer ms.Close()
+	defer hs.Close()
+
+	// Pages of 4 buckets of 10, each counting the 9 points with host=b.
+	buckets := []tsdb.Point{}
+	rreq := getRangeRequest{Start: 0, End: 1000, Entries: 4, AggregateRequest: AggregateRequest{Step: 10, Aggregate: "count"}, LabelRequest: LabelRequest{Match: []string{"host=b"}}}
+	for pages := 1; ; pages++ {
+		rrep := getRangeReply{}
+		assert.Equal(t, http.StatusOK, postJson(t, hs.URL+"/get/range/test", rreq, &rrep))
+		assert.True(t, len(rrep.Point) <= 4)
+		buckets = append(buckets, rrep.Point...)
+		if !rrep.Truncated {
+			assert.Equal(t, 8, pages)
+			break
+		}
+		rreq.Cursor = rrep.Next
+	}
+	assert.Equal(t, 30, len(buckets))
+	for i, bucket := range buckets {
+		assert.Equal(t, uint64(i)*10, bucket.Time)
+		assert.Equal(t, uint64(9), bucket.Value)
+	}
+}
+
+func TestGetStreamPaging(t *testing.T) {
+	ms, hs, tempdir := newTestServer(t)
+	defer os.RemoveAll(tempdir)
+	defer ms.Close()
+	defer hs.Close()
+	// Forces the stream to be read in many pages.
+	ms.MaxEntriesPerReply = 4
+
+	rreq := getRangeRequest{Start: 15, End: 1000, LabelRequest: LabelRequest{Match: []string{"host=a"}}}
+	body, err := json.Marshal(rreq)
+	assert.Nil(t, err)
+	resp, err := http.Post(hs.URL+"/get/stream/test", "application/json", bytes.NewReader(body))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	times := []uint64{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		point := tsdb.Point{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &point), "%s", scanner.Text())
+		assert.Equal(t, []string{"host=a"}, point.Label)
+		times = append(times, point.Time)
+	}
+	assert.Equal(t, 29, len(times), "%v", times)
+	for i, time := range times {
+		assert.Equal(t, uint64(i+2)*10, time, fmt.Sprintf("point %d", i))
+	}
+}
+
+func uint64Point(time, value uint64, labels ...string) tsdb.Point {
+	return tsdb.Point{Time: time, Value: value, Label: labels, Type: tsdb.TypeUint64}
+}
+
+// Posts a PutRequest with the token, empty for none.
+func put(t *testing.T, url, token string, preq PutRequest) (int, PutReply) {
+	body, err := json.Marshal(preq)
+	assert.Nil(t, err)
+	request, err := http.NewRequest(http.MethodPost, url+"/put", bytes.NewReader(body))
+	assert.Nil(t, err)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	prep := PutReply{}
+	if resp.StatusCode == http.StatusOK {
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&prep))
+	}
+	return resp.StatusCode, prep
+}
+
+func TestPutAuth(t *testing.T) {
+	ms, hs, tempdir := newTestServer(t)
+	defer os.RemoveAll(tempdir)
+	defer ms.Close()
+	defer hs.Close()
+
+	preq := PutRequest{[]PutSerie{{"web1/cpu", []tsdb.Point{uint64Point(0, 1), uint64Point(1, 2, "host=web1")}}}}
+
+	// Without WriteTokens, all writes are refused.
+	status, _ := put(t, hs.URL, "", preq)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = put(t, hs.URL, "secret", preq)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	ms.WriteTokens = []string{"other", "secret"}
+	resp, err := http.Get(hs.URL + "/put")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	status, _ = put(t, hs.URL, "", preq)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = put(t, hs.URL, "wrong", preq)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, 0, len(tsdb.GetDataFiles(filepath.Join(tempdir, "web1", "cpu"))))
+
+	status, prep := put(t, hs.URL, "secret", preq)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, prep.Written)
+	// The new serie is readable right away, points at time 0 included.
+	rrep := getRangeReply{}
+	assert.Equal(t, http.StatusOK, postJson(t, hs.URL+"/get/range/web1/cpu", getRangeRequest{End: 10}, &rrep))
+	assert.Equal(t, preq.Serie[0].Point, rrep.Point)
+
+	// Invalid requests write nothing.
+	for _, invalid := range []PutSerie{
+		{"../cpu", []tsdb.Point{uint64Point(2, 1)}},
+		{"web1/cpu", []tsdb.Point{uint64Point(tsdb.SealMarker, 1)}},
+	} {
+		status, _ = put(t, hs.URL, "secret", PutRequest{[]PutSerie{{"web1/cpu", []tsdb.Point{uint64Point(3, 3)}}, invalid}})
+		assert.Equal(t, http.StatusBadRequest, status, invalid.Name)
+	}
+	ms.Writers.Close()
+	assert.Equal(t, 2, len(readAllPoints(t, filepath.Join(tempdir, "web1", "cpu"))))
+}
+
+func TestList(t *testing.T) {
+	ms, hs, tempdir := newTestServer(t)
+	defer os.RemoveAll(tempdir)
+	defer ms.Close()
+	defer hs.Close()
+
+	list := func() []map[string]interface{} {
+		resp, err := http.Get(hs.URL + "/list")
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		series := []map[string]interface{}{}
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&series))
+		return series
+	}
+	series := list()
+	assert.Equal(t, []map[string]interface{}{{
+		"name": "test", "first": 1.0, "last": 300.0, "entries": 300.0, "shards": 3.0,
+		"meta": map[string]interface{}{},
+	}}, series)
+
+	// Series created on disk are listed after a Rescan, sorted by name, and
+	// those with invalid metadata with the error.
+	for _, name := range []string{"web1/mem", "cpu"} {
+		s := tsdb.NewSerieWriter(filepath.Join(tempdir, name))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(s.Path), 0777))
+		assert.Nil(t, s.Open())
+		assert.Nil(t, s.Append(5, 5, nil))
+		s.Close()
+	}
+	assert.Nil(t, ioutil.WriteFile(tsdb.MakeMetaFileName(filepath.Join(tempdir, "cpu")), []byte("{invalid"), 0666))
+	assert.Equal(t, 1, len(list()))
+	ms.Rescan()
+	series = list()
+	assert.Equal(t, 3, len(series))
+	assert.Equal(t, "cpu", series[0]["name"])
+	assert.Contains(t, series[0]["error"], "invalid")
+	assert.Equal(t, "test", series[1]["name"])
+	assert.Equal(t, map[string]interface{}{
+		"name": "web1/mem", "first": 5.0, "last": 5.0, "entries": 1.0, "shards": 1.0,
+		"meta": map[string]interface{}{},
+	}, series[2])
+
+	// Stats are refreshed by Rescan, not computed at each call.
+	s := tsdb.NewSerieWriter(filepath.Join(tempdir, "web1", "mem"))
+	assert.Nil(t, s.Open())
+	assert.Nil(t, s.Append(6, 6, nil))
+	s.Close()
+	assert.Equal(t, 5.0, list()[2]["last"])
+	ms.Rescan()
+	assert.Equal(t, 6.0, list()[2]["last"])
+	assert.Equal(t, 2.0, list()[2]["entries"])
+}
+
+func TestMeta(t *testing.T) {
+	ms, hs, tempdir := newTestServer(t)
+	defer os.RemoveAll(tempdir)
+	defer ms.Close()
+	defer hs.Close()
+
+	getMeta := func(name string) (int, tsdb.SerieMeta) {
+		resp, err := http.Get(hs.URL + "/meta/" + name)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		meta := tsdb.SerieMeta{}
+		if resp.StatusCode == http.StatusOK {
+			assert.Nil(t, json.NewDecoder(resp.Body).Decode(&meta))
+		}
+		return resp.StatusCode, meta
+	}
+	status, meta := getMeta("test")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, tsdb.SerieMeta{}, meta)
+
+	// Changes by the writer are returned right away.
+	s := tsdb.NewSerieWriter(filepath.Join(tempdir, "test"))
+	assert.Nil(t, s.Open())
+	expected := tsdb.SerieMeta{Unit: "bytes", Description: "memory used", Kind: tsdb.KindGauge, Resolution: time.Second}
+	assert.Nil(t, s.SetMeta(expected))
+	s.Close()
+	status, meta = getMeta("test")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, expected, meta)
+
+	// Invalid metadata is an error, as are unknown series.
+	assert.Nil(t, ioutil.WriteFile(tsdb.MakeMetaFileName(filepath.Join(tempdir, "test")), []byte("{invalid"), 0666))
+	status, _ = getMeta("test")
+	assert.Equal(t, http.StatusInternalServerError, status)
+	status, _ = getMeta("unknown")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ccontavalli/goutils/tsdb"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readAllPoints(t *testing.T, dbbasepath string) []tsdb.Point {
+	r := tsdb.NewSerieReader(dbbasepath)
+	defer r.Close()
+	points, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	return points
+}
+
+func TestFollower(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+	primary, replica := filepath.Join(tempdir, "primary"), filepath.Join(tempdir, "replica")
+	assert.Nil(t, os.MkdirAll(filepath.Join(primary, "web1"), 0777))
+
+	ms, err := New(primary)
+	assert.Nil(t, err)
+	defer ms.Close()
+	// A small limit, so copies need many requests.
+	ms.MaxSyncBytes = 2000
+	mux := http.NewServeMux()
+	ms.Register("/", mux)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sync" {
+			requests += 1
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	cpu := tsdb.NewSerieWriter(filepath.Join(primary, "cpu"))
+	cpu.MaxEntries = 32
+	cpu.LabelBlock = 128
+	cpu.CompactOnSeal = true
+	assert.Nil(t, cpu.Open())
+	assert.Nil(t, cpu.SetMeta(tsdb.SerieMeta{Unit: "%", Kind: tsdb.KindGauge}))
+	mem := tsdb.NewSerieWriter(filepath.Join(primary, "web1", "mem"))
+	mem.MaxEntries = 32
+	mem.LabelBlock = 128
+	mem.CompactOnSeal = false
+	assert.Nil(t, mem.Open())
+	for i := uint64(1); i <= 200; i++ {
+		assert.Nil(t, cpu.Append(i, i, []string{fmt.Sprintf("cpu-%d", i)}))
+		assert.Nil(t, mem.Append(i, i*2, []string{"host=web1", fmt.Sprintf("mem-%d", i)}))
+	}
+
+	verify := func() {
+		for _, name := range []string{"cpu", "web1/mem"} {
+			expected := readAllPoints(t, filepath.Join(primary, name))
+			assert.Equal(t, expected, readAllPoints(t, filepath.Join(replica, name)), name)
+			check, err := tsdb.CheckSerie(filepath.Join(replica, name))
+			assert.Nil(t, err)
+			assert.Equal(t, 0, len(check.Problems()), "%v", check.Problems())
+		}
+		meta, err := tsdb.ReadSerieMeta(filepath.Join(replica, "cpu"))
+		assert.Nil(t, err)
+		assert.Equal(t, tsdb.SerieMeta{Unit: "%", Kind: tsdb.KindGauge}, meta)
+	}
+
+	follower := tsdb.NewFollower(server.URL+"/sync", replica)
+	changed, err := follower.Sync()
+	assert.Nil(t, err)
+	assert.True(t, changed > 0)
+	assert.True(t, requests > 2)
+	verify()
+
+	// Nothing changed, nothing to copy.
+	changed, err = follower.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, changed)
+
+	// A reader of the replica sees the points copied after it was opened,
+	// and a new follower resumes from the files.
+	reader := tsdb.NewSerieReader(filepath.Join(replica, "cpu"))
+	defer reader.Close()
+	points, err := reader.GetData(reader.FirstLocation(), reader.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, len(points))
+	for i := uint64(201); i <= 500; i++ {
+		assert.Nil(t, cpu.Append(i, i, []string{fmt.Sprintf("cpu-%d", i)}))
+	}
+	requests = 0
+	follower = tsdb.NewFollower(server.URL+"/sync", replica)
+	_, err = follower.Sync()
+	assert.Nil(t, err)
+	verify()
+	points, err = reader.GetData(reader.FirstLocation(), reader.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(points))
+	// Only the new entries and labels were copied.
+	assert.True(t, requests < 12, "%d requests", requests)
+
+	// Shards removed from the primary are removed from the replica, shards
+	// sealed and compressed are copied as a whole.
+	files := tsdb.GetDataFiles(cpu.Path)
+	assert.Nil(t, tsdb.RemoveShard(cpu.Path, tsdb.ParseFileName(cpu.Path, files[0])))
+	cpu.Close()
+	mem.Close()
+	_, err = follower.Sync()
+	assert.Nil(t, err)
+	verify()
+	check, err := tsdb.CheckSerie(filepath.Join(replica, "cpu"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(files)-1, len(check.Shard))
+	compressed := 0
+	for _, shard := range check.Shard {
+		if shard.Compressed {
+			compressed += 1
+		}
+	}
+	assert.Equal(t, len(files)-2, compressed)
+
+	// Requests are limited in size, independently of Put.
+	ms.MaxSyncRequestBytes = 10
+	resp, err := http.Post(server.URL+"/sync", "application/json", bytes.NewReader([]byte(`{"serie": {"cpu": {}}}`)))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	ms.MaxSyncRequestBytes = 4 * 1048576
+	ms.MaxPutBytes = 10
+	_, err = follower.Sync()
+	assert.Nil(t, err)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ccontavalli/goutils/tsdb"
+	"net/http"
+	"time"
+)
+
+// Sends a comment every this many polls without new points, so proxies
+// do not close idle connections.
+const tailKeepalivePolls = 30
+
+// Reads the points appended after the cursor, up to max points.
+// Returns the points, and the cursor to use to get the following ones.
+func readTail(sr *lockedSerie, cursor string, filter tsdb.LabelFilter, max int) ([]tsdb.Point, []string, string, error) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	end := sr.reader.LastLocation()
+	if !end.Valid() {
+		return nil, nil, cursor, fmt.Errorf("could not read serie")
+	}
+	start := end
+	if cursor != "" {
+		var err error
+		start, err = sr.reader.ParseCursor(cursor)
+		if err != nil {
+			return nil, nil, cursor, err
+		}
+	}
+	if limit := start.Plus(sr.reader, max); limit.Before(end) {
+		end = limit
+	}
+	if !start.Before(end) && !start.Backfilled() {
+		return nil, nil, start.Cursor(), nil
+	}
+
+	// Each point carries the cursor to resume from after it.
+	cursors := []string{}
+	filtered := sr.reader.Filter(filter, nil)
+	points, err := sr.reader.GetData(start, end, func(points []tsdb.Point, location tsdb.Location, time, value uint64) []tsdb.Point {
+		before := len(points)
+		points = filtered(points, location, time, value)
+		if len(points) > before {
+			cursors = append(cursors, sr.reader.CursorAfter(location))
+		}
+		return points
+	})
+	return points, cursors, end.Cursor(), err
+}
+
+// Streams the points appended to a serie as Server-Sent Events, one event
+// per point, with the point as json data, and as event id the cursor to
+// resume from after the point, backfilled or not.
+//
+// Points can be filtered with one or more match query parameters, with
+// label expressions as in LabelRequest. A cursor query parameter, as
+// returned by the other handlers, resumes from a previous position.
+// Without a cursor, only points appended after the request are sent.
+// The Last-Event-ID header sent by browsers when reconnecting takes
+// precedence over the cursor parameter.
+func (ms *MetricsServer) Tail(w http.ResponseWriter, r *http.Request) {
+	sr := ms.getSerieReader("/tail/", w, r)
+	if sr == nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	filter, err := tsdb.ParseLabelFilter(r.URL.Query()["match"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request '%s'", err), http.StatusBadRequest)
+		return
+	}
+	cursor := r.URL.Query().Get("cursor")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		cursor = id
+	}
+
+	// Resolve the initial position right away, so points appended while
+	// the first poll is pending are not lost.
+	_, _, cursor, err = readTail(sr, cursor, filter, 0)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request '%s'", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(ms.TailInterval)
+	defer ticker.Stop()
+	idle := 0
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		var points []tsdb.Point
+		var cursors []string
+		points, cursors, cursor, err = readTail(sr, cursor, filter, ms.MaxEntriesPerReply)
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+			flusher.Flush()
+			return
+		}
+
+		if len(points) <= 0 {
+			if idle += 1; idle >= tailKeepalivePolls {
+				idle = 0
+				fmt.Fprintf(w, ": keepalive\n\n")
+				flusher.Flush()
+			}
+			continue
+		}
+		idle = 0
+
+		for i, point := range points {
+			data, err := json.Marshal(point)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", cursors[i], data)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
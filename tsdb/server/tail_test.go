@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/ccontavalli/goutils/tsdb"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type tailEvent struct {
+	id    string
+	point tsdb.Point
+}
+
+// Opens a tail of url, and returns the events received on a channel,
+// closed at the end of the stream. headers are added to the request.
+func openTail(t *testing.T, ctx context.Context, url string, headers map[string]string) <-chan tailEvent {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	assert.Nil(t, err)
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(request.WithContext(ctx))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan tailEvent, 100)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		event := tailEvent{}
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.point))
+			case line == "":
+				// Events are terminated by an empty line.
+				events <- event
+				event = tailEvent{}
+			default:
+				t.Errorf("unexpected line '%s'", line)
+			}
+		}
+	}()
+	return events
+}
+
+// Returns the next event, or fails after a timeout.
+func nextEvent(t *testing.T, events <-chan tailEvent) tailEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	return tailEvent{}
+}
+
+func TestTail(t *testing.T) {
+	ms, hs, tempdir := newTestServer(t)
+	defer os.RemoveAll(tempdir)
+	defer ms.Close()
+	defer hs.Close()
+	ms.TailInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Only the points appended after the request are sent.
+	events := openTail(t, ctx, hs.URL+"/tail/test?match=host%3Da", nil)
+
+	s := tsdb.NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	assert.Nil(t, s.Open())
+	defer s.Close()
+	for i := uint64(301); i <= 320; i++ {
+		host := "host=b"
+		if i%10 == 0 {
+			host = "host=a"
+		}
+		assert.Nil(t, s.Append(i, i, []string{host}))
+	}
+	s.Sync()
+
+	first := nextEvent(t, events)
+	assert.Equal(t, uint64(310), first.point.Time)
+	assert.Equal(t, []string{"host=a"}, first.point.Label)
+	assert.NotEqual(t, "", first.id)
+	second := nextEvent(t, events)
+	assert.Equal(t, uint64(320), second.point.Time)
+	cancel()
+
+	// Reconnecting with the id of an event resumes after it, the header
+	// taking precedence over the cursor parameter.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	events = openTail(t, ctx, hs.URL+"/tail/test?match=host%3Da&cursor="+second.id, map[string]string{"Last-Event-ID": first.id})
+	assert.Equal(t, second, nextEvent(t, events))
+
+	// Invalid cursors are refused before the stream starts.
+	resp, err := http.Get(hs.URL + "/tail/test?cursor=invalid")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
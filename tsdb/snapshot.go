@@ -0,0 +1,320 @@
+package tsdb
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"unsafe"
+)
+
+// What SnapshotSerie did to copy a serie.
+type SnapshotStats struct {
+	// Number of files hardlinked, sealed shards and their labels.
+	Linked int
+	// Number of files copied, the shards still being written, and the
+	// shards on a different filesystem, where hardlinks are not possible.
+	Copied int
+	// Bytes written for the files copied.
+	Bytes int64
+}
+
+func (ss *SnapshotStats) add(other SnapshotStats) {
+	ss.Linked += other.Linked
+	ss.Copied += other.Copied
+	ss.Bytes += other.Bytes
+}
+
+// Creates a consistent copy of the serie dbbasepath as destpath, while
+// writers keep appending to it. destpath must not have shards already.
+//
+// Sealed, or full, shards are never modified, and are hardlinked. Shards being
+// written are copied up to the cursor at the time of the snapshot, with
+// only the labels referenced by the entries copied, so each shard is
+// consistent, as if the writer had stopped at that point. Shards sealed
+// or created while the snapshot is in progress may or may not be part of
+// the copy. The metadata, and the overlay of points backfilled, are
+// copied as well.
+//
+// Files are synced to disk before returning.
+func SnapshotSerie(dbbasepath, destpath string) (SnapshotStats, error) {
+	stats := SnapshotStats{}
+	files := GetDataFiles(dbbasepath)
+	if len(files) <= 0 {
+		return stats, fmt.Errorf("serie %s has no data files", dbbasepath)
+	}
+	if len(GetDataFiles(destpath)) > 0 {
+		return stats, fmt.Errorf("snapshot destination %s already has shards", destpath)
+	}
+	err := os.MkdirAll(filepath.Dir(destpath), 0777)
+	if err != nil {
+		return stats, err
+	}
+
+	for _, file := range files {
+		id := ParseFileName(dbbasepath, file)
+		shard, err := snapshotShard(dbbasepath, destpath, id)
+		stats.add(shard)
+		// Removed by a retention policy since the files were listed.
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	size, err := copyFile(MakeMetaFileName(dbbasepath), MakeMetaFileName(destpath))
+	if err == nil {
+		stats.Copied += 1
+		stats.Bytes += size
+	} else if !os.IsNotExist(err) {
+		return stats, err
+	}
+
+	if backfill := BackfillPath(dbbasepath); len(GetDataFiles(backfill)) > 0 {
+		overlay, err := SnapshotSerie(backfill, BackfillPath(destpath))
+		stats.add(overlay)
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// Snapshots all the series in basepath, and its subdirectories, as with
+// SnapshotSerie, in the same relative paths under destdir. Returns the
+// series copied, as relative paths.
+func SnapshotSeries(basepath, destdir string) ([]string, SnapshotStats, error) {
+	stats := SnapshotStats{}
+	copied := []string{}
+	for _, serie := range FindSeries(basepath) {
+		name, err := filepath.Rel(basepath, serie)
+		if err != nil {
+			return copied, stats, err
+		}
+		serie, err := SnapshotSerie(serie, filepath.Join(destdir, name))
+		stats.add(serie)
+		if err != nil {
+			return copied, stats, fmt.Errorf("serie %s: %s", name, err)
+		}
+		copied = append(copied, name)
+	}
+	return copied, stats, nil
+}
+
+// Copies a shard. The data file is opened first, so if it is sealed,
+// the labels are sealed as well, and if it is being written, all the
+// labels referenced by the entries before its cursor are in the labels
+// file opened next.
+func snapshotShard(dbbasepath, destpath string, id uint32) (SnapshotStats, error) {
+	stats := SnapshotStats{}
+	srcdata, dstdata := MakeDataStoreFileName(dbbasepath, id), MakeDataStoreFileName(destpath, id)
+	srclabels, dstlabels := MakeLabelStoreFileName(dbbasepath, id), MakeLabelStoreFileName(destpath, id)
+
+	file, err := os.Open(srcdata)
+	if err != nil {
+		return stats, err
+	}
+	defer file.Close()
+	data, err := mmapFile(file, unix.PROT_READ, false)
+	if len(data) <= 0 {
+		if err == nil {
+			err = fmt.Errorf("%s is empty", srcdata)
+		}
+		return stats, err
+	}
+	defer unix.Munmap(data)
+
+	// Files without header are upgraded before being written again, see
+	// SerieWriter.Open, so they are copied as they are.
+	legacy := !hasMagic(data, dataMagic)
+	swap := false
+	if !legacy {
+		swap, err = checkHeader(srcdata, data, dataMagic)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	// Files with a different byte order, or compressed, are never written,
+	// and neither are files with a full ring.
+	var cursor uint64
+	var lpe, ringlen, entries int
+	sealed := legacy
+	if !legacy {
+		cursor = atomic.LoadUint64((*uint64)(unsafe.Pointer(&data[8])))
+		lpe = int(*(*uint8)(unsafe.Pointer(&data[16])))
+		ringlen = len(data) - GetHeaderSize()
+		entries = GetEntries(cursor, ringlen, lpe)
+		sealed = swap || getDataFormat(data) != FormatRaw || cursor+uint64(GetEntrySize(lpe)) > uint64(ringlen)
+	}
+	if !sealed && entries > 0 {
+		last := GetHeaderSize() + (entries-1)*GetEntrySize(lpe)
+		sealed = *(*uint64)(unsafe.Pointer(&data[last])) == SealMarker
+	}
+
+	if sealed {
+		// Link the labels first, the data file is what makes the shard visible.
+		for _, pair := range [][2]string{{srclabels, dstlabels}, {srcdata, dstdata}} {
+			linked, size, err := linkOrCopy(pair[0], pair[1])
+			if err != nil {
+				return stats, err
+			}
+			if linked {
+				stats.Linked += 1
+			} else {
+				stats.Copied += 1
+				stats.Bytes += size
+			}
+		}
+		return stats, nil
+	}
+
+	size, err := snapshotLabels(srclabels, dstlabels, maxLabel(data, lpe, 0, entries))
+	if err != nil {
+		return stats, err
+	}
+	stats.Copied += 1
+	stats.Bytes += size
+
+	// Copy the data with the cursor that was read, and no entry after it.
+	used := GetHeaderSize() + entries*GetEntrySize(lpe)
+	copied := append([]byte(nil), data[:used]...)
+	*(*uint64)(unsafe.Pointer(&copied[8])) = uint64(entries * GetEntrySize(lpe))
+	err = writeFile(dstdata, copied, int64(len(data)), file)
+	if err != nil {
+		return stats, err
+	}
+	stats.Copied += 1
+	stats.Bytes += int64(used)
+	return stats, nil
+}
+
+// Returns the highest LabelID referenced by the entries from first to
+// last, excluded, of the content of a .data file in FormatRaw.
+func maxLabel(data []byte, lpe, first, last int) LabelID {
+	maxlabel := LabelID(0)
+	for entry := first; entry < last; entry++ {
+		offset := GetHeaderSize() + entry*GetEntrySize(lpe) + 16
+		for i := 0; i < lpe; i++ {
+			if label := LabelID(*(*uint32)(unsafe.Pointer(&data[offset+i*4]))); label > maxlabel {
+				maxlabel = label
+			}
+		}
+	}
+	return maxlabel
+}
+
+// Returns the offset of the end of label in the content of a .labels
+// file, the end of the header if label is 0.
+func labelsEnd(filename string, raw []byte, label LabelID) (int, error) {
+	if label == 0 {
+		return GetHeaderSize(), nil
+	}
+	offset := labelOffset(label)
+	if offset+4 > len(raw) {
+		return 0, fmt.Errorf("%s: label %d referenced by the data is outside the file", filename, label)
+	}
+	size := int(atomic.LoadUint32((*uint32)(unsafe.Pointer(&raw[offset]))))
+	end := offset + (4+size+7)/8*8
+	if size == 0 || end > len(raw) {
+		return 0, fmt.Errorf("%s: label %d referenced by the data is invalid", filename, label)
+	}
+	return end, nil
+}
+
+// Copies the labels of a .labels file being written, up to maxlabel.
+func snapshotLabels(srclabels, dstlabels string, maxlabel LabelID) (int64, error) {
+	file, err := os.Open(srclabels)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	raw, err := mmapFile(file, unix.PROT_READ, false)
+	if len(raw) <= 0 {
+		if err == nil {
+			err = fmt.Errorf("%s is empty", srclabels)
+		}
+		return 0, err
+	}
+	defer unix.Munmap(raw)
+	_, err = checkHeader(srclabels, raw, labelsMagic)
+	if err != nil {
+		return 0, err
+	}
+
+	used, err := labelsEnd(srclabels, raw, maxlabel)
+	if err != nil {
+		return 0, err
+	}
+	copied := append([]byte(nil), raw[:used]...)
+	return int64(used), writeFile(dstlabels, copied, int64(len(raw)), file)
+}
+
+// Creates filename with data, extended with zeros to size, and the mode
+// of the file source. Syncs it to disk.
+func writeFile(filename string, data []byte, size int64, source *os.File) error {
+	st, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, st.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Truncate(size)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Hardlinks src as dst, or copies it if hardlinks are not possible, like
+// across filesystems. Returns true if the file was linked, and the bytes
+// copied otherwise.
+func linkOrCopy(src, dst string) (bool, int64, error) {
+	err := os.Link(src, dst)
+	if err == nil {
+		return true, 0, nil
+	}
+	if os.IsExist(err) {
+		return false, 0, err
+	}
+	size, err := copyFile(src, dst)
+	return false, size, err
+}
+
+// Copies src to dst, and syncs dst to disk. dst must not exist.
+func copyFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, st.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	copied, err := io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return copied, err
+}
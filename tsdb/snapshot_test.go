@@ -0,0 +1,83 @@
+package tsdb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotSerie(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tempdir)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "data", "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.CompactOnSeal = false
+	assert.Nil(t, os.MkdirAll(filepath.Dir(s.Path), 0777))
+	err = s.Open()
+	assert.Nil(t, err)
+	assert.Nil(t, s.SetMeta(SerieMeta{"bytes", "", KindCounter, 0}))
+	for i := uint64(1); i <= 300; i++ {
+		assert.Nil(t, s.Append(i, i, []string{fmt.Sprintf("label-%d", i)}))
+	}
+
+	// Snapshots taken while the writer keeps appending.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := uint64(301); i <= 3000; i++ {
+			s.Append(i, i, []string{fmt.Sprintf("label-%d", i)})
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		dest := filepath.Join(tempdir, fmt.Sprintf("snapshot-%d", i), "test")
+		stats, err := SnapshotSerie(s.Path, dest)
+		assert.Nil(t, err)
+		assert.True(t, stats.Linked >= 4, "%v", stats)
+
+		check, err := CheckSerie(dest)
+		assert.Nil(t, err)
+		assert.Equal(t, []Problem{}, append([]Problem{}, check.Problems()...))
+
+		points := readAllPoints(t, dest)
+		assert.True(t, len(points) >= 300)
+		for j, point := range points {
+			assert.Equal(t, uint64(j+1), point.Time)
+			assert.Equal(t, []string{fmt.Sprintf("label-%d", point.Time)}, point.Label)
+		}
+		meta, err := ReadSerieMeta(dest)
+		assert.Nil(t, err)
+		assert.Equal(t, KindCounter, meta.Kind)
+	}
+	<-done
+	s.Close()
+
+	// Sealed shards are hardlinked, the last one is copied.
+	dest := filepath.Join(tempdir, "final", "test")
+	stats, err := SnapshotSerie(s.Path, dest)
+	assert.Nil(t, err)
+	files := GetDataFiles(s.Path)
+	assert.Equal(t, SnapshotStats{2 * (len(files) - 1), 3, stats.Bytes}, stats)
+	for i, file := range GetDataFiles(dest) {
+		src, err := os.Stat(files[i])
+		assert.Nil(t, err)
+		dst, err := os.Stat(file)
+		assert.Nil(t, err)
+		assert.Equal(t, i < len(files)-1, os.SameFile(src, dst), file)
+	}
+	assert.Equal(t, readAllPoints(t, s.Path), readAllPoints(t, dest))
+
+	// The destination must not have shards already.
+	_, err = SnapshotSerie(s.Path, dest)
+	assert.NotNil(t, err)
+
+	series, _, err := SnapshotSeries(filepath.Join(tempdir, "data"), filepath.Join(tempdir, "all"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test"}, series)
+	assert.Equal(t, readAllPoints(t, s.Path), readAllPoints(t, filepath.Join(tempdir, "all", "test")))
+}
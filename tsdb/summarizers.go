@@ -0,0 +1,301 @@
+package tsdb
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A bucket accumulates all the values falling in the same time step,
+// and computes the aggregated value to return. All values added to a
+// bucket are of the type the bucket was created with.
+type bucket interface {
+	Add(time, value uint64)
+	Value() (uint64, ValueType)
+}
+
+// Implemented by buckets whose value depends on the points before them.
+type continuedBucket interface {
+	bucket
+	// Invoked on a new bucket with the bucket preceding it.
+	Continue(previous bucket)
+}
+
+// Returns true if a < b, interpreting them as values of type vt.
+func lessValue(a, b uint64, vt ValueType) bool {
+	switch vt {
+	case TypeInt64:
+		return int64(a) < int64(b)
+	case TypeFloat64:
+		return math.Float64frombits(a) < math.Float64frombits(b)
+	}
+	return a < b
+}
+
+// Returns a + b, interpreting them as values of type vt.
+func addValue(a, b uint64, vt ValueType) uint64 {
+	if vt == TypeFloat64 {
+		return math.Float64bits(math.Float64frombits(a) + math.Float64frombits(b))
+	}
+	// Two's complement addition works the same for int64 and uint64.
+	return a + b
+}
+
+type minBucket struct {
+	value uint64
+	vt    ValueType
+}
+
+func (b *minBucket) Add(time, value uint64) {
+	if lessValue(value, b.value, b.vt) {
+		b.value = value
+	}
+}
+func (b *minBucket) Value() (uint64, ValueType) { return b.value, b.vt }
+
+type maxBucket struct {
+	value uint64
+	vt    ValueType
+}
+
+func (b *maxBucket) Add(time, value uint64) {
+	if lessValue(b.value, value, b.vt) {
+		b.value = value
+	}
+}
+func (b *maxBucket) Value() (uint64, ValueType) { return b.value, b.vt }
+
+type sumBucket struct {
+	value uint64
+	vt    ValueType
+}
+
+func (b *sumBucket) Add(time, value uint64)     { b.value = addValue(b.value, value, b.vt) }
+func (b *sumBucket) Value() (uint64, ValueType) { return b.value, b.vt }
+
+type countBucket struct{ value uint64 }
+
+func (b *countBucket) Add(time, value uint64)     { b.value += 1 }
+func (b *countBucket) Value() (uint64, ValueType) { return b.value, TypeUint64 }
+
+type firstBucket struct {
+	value uint64
+	vt    ValueType
+}
+
+func (b *firstBucket) Add(time, value uint64)     {}
+func (b *firstBucket) Value() (uint64, ValueType) { return b.value, b.vt }
+
+type lastBucket struct {
+	value uint64
+	vt    ValueType
+}
+
+func (b *lastBucket) Add(time, value uint64)     { b.value = value }
+func (b *lastBucket) Value() (uint64, ValueType) { return b.value, b.vt }
+
+type avgBucket struct {
+	sum   float64
+	count uint64
+	vt    ValueType
+}
+
+func (b *avgBucket) Add(time, value uint64) {
+	b.sum += Point{Value: value, Type: b.vt}.Float64()
+	b.count += 1
+}
+func (b *avgBucket) Value() (uint64, ValueType) {
+	return math.Float64bits(b.sum / float64(b.count)), TypeFloat64
+}
+
+// Computes the increase per unit of time of a counter. If the counter
+// goes backward, it is assumed it was reset to 0.
+type rateBucket struct {
+	first, last uint64
+	previous    float64
+	increase    float64
+	vt          ValueType
+}
+
+func (b *rateBucket) increaseTo(current float64) {
+	if current >= b.previous {
+		b.increase += current - b.previous
+	} else {
+		b.increase += current
+	}
+	b.previous = current
+}
+
+func (b *rateBucket) Add(time, value uint64) {
+	b.increaseTo(Point{Value: value, Type: b.vt}.Float64())
+	b.last = time
+}
+
+// Starts from the last point of the previous bucket, so the increase
+// between the two buckets is counted in this one.
+func (b *rateBucket) Continue(previous bucket) {
+	last, ok := previous.(*rateBucket)
+	if !ok {
+		return
+	}
+	current := b.previous
+	b.first, b.previous = last.last, last.previous
+	b.increaseTo(current)
+}
+func (b *rateBucket) Value() (uint64, ValueType) {
+	if b.last <= b.first {
+		return math.Float64bits(0), TypeFloat64
+	}
+	return math.Float64bits(b.increase / float64(b.last-b.first)), TypeFloat64
+}
+
+// Heap of values, ordered by less.
+type valueHeap struct {
+	values []uint64
+	less   func(a, b uint64) bool
+}
+
+func (h *valueHeap) Len() int           { return len(h.values) }
+func (h *valueHeap) Less(i, j int) bool { return h.less(h.values[i], h.values[j]) }
+func (h *valueHeap) Swap(i, j int)      { h.values[i], h.values[j] = h.values[j], h.values[i] }
+func (h *valueHeap) Push(x interface{}) { h.values = append(h.values, x.(uint64)) }
+func (h *valueHeap) Pop() interface{} {
+	last := h.values[len(h.values)-1]
+	h.values = h.values[:len(h.values)-1]
+	return last
+}
+
+// Computes a percentile using the nearest rank method.
+//
+// The summarizer asks for the value after each point added, so values are
+// kept in two heaps: lower, with the values up to the rank, largest first,
+// and upper with the others, smallest first. Adding a value costs O(log n),
+// the percentile is the top of lower.
+type percentileBucket struct {
+	percentile float64
+	lower      *valueHeap
+	upper      *valueHeap
+	vt         ValueType
+}
+
+func newPercentileBucket(percentile float64, value uint64, vt ValueType) *percentileBucket {
+	lower := &valueHeap{[]uint64{value}, func(a, b uint64) bool { return lessValue(b, a, vt) }}
+	upper := &valueHeap{[]uint64{}, func(a, b uint64) bool { return lessValue(a, b, vt) }}
+	return &percentileBucket{percentile, lower, upper, vt}
+}
+
+func (b *percentileBucket) Add(time, value uint64) {
+	if lessValue(b.lower.values[0], value, b.vt) {
+		heap.Push(b.upper, value)
+	} else {
+		heap.Push(b.lower, value)
+	}
+
+	rank := int(math.Ceil(b.percentile / 100 * float64(b.lower.Len()+b.upper.Len())))
+	if rank < 1 {
+		rank = 1
+	}
+	for b.lower.Len() > rank {
+		heap.Push(b.upper, heap.Pop(b.lower))
+	}
+	for b.lower.Len() < rank {
+		heap.Push(b.lower, heap.Pop(b.upper))
+	}
+}
+func (b *percentileBucket) Value() (uint64, ValueType) {
+	return b.lower.values[0], b.vt
+}
+
+// Returns a function creating a new bucket initialized with the first
+// time and value falling in it.
+func newBucketFactory(aggregate string) (func(time, value uint64, vt ValueType) bucket, error) {
+	switch aggregate {
+	case "min":
+		return func(time, value uint64, vt ValueType) bucket { return &minBucket{value, vt} }, nil
+	case "max":
+		return func(time, value uint64, vt ValueType) bucket { return &maxBucket{value, vt} }, nil
+	case "sum":
+		return func(time, value uint64, vt ValueType) bucket { return &sumBucket{value, vt} }, nil
+	case "count":
+		return func(time, value uint64, vt ValueType) bucket { return &countBucket{1} }, nil
+	case "first":
+		return func(time, value uint64, vt ValueType) bucket { return &firstBucket{value, vt} }, nil
+	case "last":
+		return func(time, value uint64, vt ValueType) bucket { return &lastBucket{value, vt} }, nil
+	case "avg":
+		return func(time, value uint64, vt ValueType) bucket {
+			return &avgBucket{Point{Value: value, Type: vt}.Float64(), 1, vt}
+		}, nil
+	case "rate":
+		return func(time, value uint64, vt ValueType) bucket {
+			return &rateBucket{time, time, Point{Value: value, Type: vt}.Float64(), 0, vt}
+		}, nil
+	}
+
+	if strings.HasPrefix(aggregate, "p") {
+		percentile, err := strconv.ParseFloat(aggregate[1:], 64)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			return nil, fmt.Errorf("invalid percentile '%s' - must be between p0 and p100, excluding p0", aggregate)
+		}
+		return func(time, value uint64, vt ValueType) bucket {
+			return newPercentileBucket(percentile, value, vt)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown aggregate '%s' - valid ones are: %s", aggregate, strings.Join(Aggregates, ", "))
+}
+
+// List of aggregates supported by NewSummarizer. Percentiles are expressed
+// as p followed by a number, like p50, p90, or p99.9.
+var Aggregates = []string{"min", "max", "avg", "sum", "count", "first", "last", "rate", "p50", "p90", "p99"}
+
+// Returns a Summarizer grouping the points in buckets of step time units,
+// and returning a single point per bucket with the value computed by the
+// specified aggregate.
+//
+// The time of each returned point is the start of its bucket, aligned to
+// a multiple of step. Labels are not returned. Points must be supplied in
+// time order, as GetData does.
+//
+// avg and rate always return float64 values, count uint64 values, all other
+// aggregates return values of the same type as the points in the bucket.
+// rate computes the increase from the last point of the previous bucket,
+// so the increase between two buckets is not lost.
+//
+// A Summarizer keeps state across calls, a new one must be created for each
+// call to GetData.
+func NewSummarizer(aggregate string, step uint64) (Summarizer, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be > 0")
+	}
+	factory, err := newBucketFactory(aggregate)
+	if err != nil {
+		return nil, err
+	}
+
+	var current bucket
+	var currenttype ValueType
+	return func(points []Point, location Location, time, value uint64) []Point {
+		start := time - time%step
+		vt := location.ValueType()
+		if current != nil && len(points) > 0 && points[len(points)-1].Time == start {
+			// A bucket may span shards storing different types. Values that
+			// cannot be represented in the type of the bucket are ignored.
+			converted, err := ConvertValue(value, vt, currenttype)
+			if err == nil {
+				current.Add(time, converted)
+				points[len(points)-1].Value, points[len(points)-1].Type = current.Value()
+			}
+			return points
+		}
+
+		previous := current
+		current, currenttype = factory(time, value, vt), vt
+		if continued, ok := current.(continuedBucket); ok && previous != nil {
+			continued.Continue(previous)
+		}
+		result, resulttype := current.Value()
+		return append(points, Point{start, result, nil, resulttype})
+	}, nil
+}
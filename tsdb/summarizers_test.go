@@ -0,0 +1,91 @@
+package tsdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func summarize(t *testing.T, aggregate string, step uint64, times, values []uint64) []Point {
+	summarizer, err := NewSummarizer(aggregate, step)
+	assert.Nil(t, err)
+
+	points := []Point{}
+	for i := range times {
+		points = summarizer(points, Location{}, times[i], values[i])
+	}
+	return points
+}
+
+func TestSummarizers(t *testing.T) {
+	times := []uint64{10, 11, 12, 13, 20, 21, 25, 40}
+	values := []uint64{5, 1, 7, 3, 10, 20, 60, 8}
+
+	expected := map[string][]float64{
+		"min":   {1, 10, 8},
+		"max":   {7, 60, 8},
+		"sum":   {16, 90, 8},
+		"count": {4, 3, 1},
+		"first": {5, 10, 8},
+		"last":  {3, 60, 8},
+		"avg":   {4, 30, 8},
+		"p50":   {3, 20, 8},
+		"p100":  {7, 60, 8},
+		"p1":    {1, 10, 8},
+	}
+	for aggregate, result := range expected {
+		points := summarize(t, aggregate, 10, times, values)
+		assert.Equal(t, 3, len(points), aggregate)
+		for i, point := range points {
+			assert.Equal(t, result[i], point.Float64(), aggregate)
+			assert.Nil(t, point.Label)
+		}
+		assert.Equal(t, uint64(10), points[0].Time)
+		assert.Equal(t, uint64(20), points[1].Time)
+		assert.Equal(t, uint64(40), points[2].Time)
+	}
+}
+
+func TestRateSummarizer(t *testing.T) {
+	// Counter increasing by 10 per unit of time, reset in the second bucket.
+	times := []uint64{0, 1, 2, 3, 4, 5, 6, 7}
+	values := []uint64{100, 110, 120, 130, 140, 10, 20, 30}
+
+	points := summarize(t, "rate", 4, times, values)
+	assert.Equal(t, 2, len(points))
+	assert.Equal(t, TypeFloat64, points[0].Type)
+	assert.Equal(t, 10.0, points[0].Float64())
+	assert.Equal(t, 10.0, points[1].Float64())
+
+	// The increase between buckets is counted in the following one, even
+	// if it has a single point.
+	times = []uint64{0, 3, 4, 9, 12}
+	values = []uint64{0, 30, 40, 90, 120}
+	points = summarize(t, "rate", 4, times, values)
+	assert.Equal(t, 4, len(points))
+	for _, point := range points {
+		assert.Equal(t, 10.0, point.Float64())
+	}
+}
+
+func TestPercentileLargeBucket(t *testing.T) {
+	// A week of points, one per second, in a single bucket.
+	times, values := make([]uint64, 604800), make([]uint64, 604800)
+	for i := range times {
+		times[i] = uint64(i)
+		values[i] = uint64((i * 7919) % 604800)
+	}
+	points := summarize(t, "p99", 604800, times, values)
+	assert.Equal(t, 1, len(points))
+	assert.Equal(t, uint64(598751), points[0].Value)
+}
+
+func TestInvalidSummarizer(t *testing.T) {
+	_, err := NewSummarizer("median", 10)
+	assert.NotNil(t, err)
+	_, err = NewSummarizer("p0", 10)
+	assert.NotNil(t, err)
+	_, err = NewSummarizer("p101", 10)
+	assert.NotNil(t, err)
+	_, err = NewSummarizer("avg", 0)
+	assert.NotNil(t, err)
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/ccontavalli/goutils/misc"
 	"github.com/ccontavalli/goutils/tsdb"
-	//"fmt"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
@@ -18,15 +24,68 @@ var (
 		"we will ever save. Defaults to 4 when < 0")
 	fl_maxentries = flag.Int("maxentries", -1, "Maximum number of entries to store per file "+
 		"before rotating it. Defaults to 604800 (a week of 1 second points) or ~20Mb")
+	fl_maxage = flag.Uint64("maxage", 0, "When adding values, remove the shards whose points are all older "+
+		"than this, in the same unit as --time, from the last point. Disabled when 0")
+	fl_maxbytes = flag.Int64("maxbytes", 0, "When adding values, remove the oldest shards to keep the serie "+
+		"below this size in bytes. Disabled when 0")
+	fl_maxshards = flag.Int("maxshards", 0, "When adding values, remove the oldest shards to keep at most "+
+		"this number of shards. Disabled when 0")
+	fl_wait = flag.Duration("wait", 0, "When adding values, repairing or upgrading, how long to wait for another process writing "+
+		"to the same serie to finish. Fails immediately when 0, waits forever when negative")
 
 	fl_action = flag.String("action", "add-value", "Action to perform. Can be: "+
-		"add-value to add a single value (use --time, --value), list (to list values)")
+		"add-value to add a single value (use --time, --value), list (to list values, "+
+		"use --from, --to, --last, --filter, --format), labels (to list the labels of the points, use --from, --to), fsck (to check the consistency of the serie, "+
+		"use --repair), set-meta (to set the metadata of the serie, use --unit, --description, --kind, --resolution), "+
+		"meta (to show the metadata of the serie), export (to write all the points and options of the serie, "+
+		"use --format, --file), import (to append points written by export, use --format, --file, --batch), "+
+		"snapshot (to copy the serie, or all the series in --dir, while they are being written, use --dest), "+
+		"follow (to replicate the series of a primary server in --dir, use --primary, --interval), "+
+		"upgrade (to rewrite the shards written by a version without file headers)")
 
-	fl_time  = flag.Uint64("time", 0, "Time point to save in the database. Must be used with --value.")
-	fl_value = flag.Uint64("value", 0, "Value to save in the database. Must be used with --time.")
+	fl_time      = flag.Uint64("time", 0, "Time point to save in the database. Must be used with --value.")
+	fl_value     = flag.String("value", "", "Value to save in the database, of the type specified with --valuetype. Must be used with --time.")
+	fl_valuetype = flag.String("valuetype", "", "Type of the values stored in the serie. Can be: uint64, int64, float64. "+
+		"When empty, the type of the last shard of an existing serie, uint64 for a new one. "+
+		"Changing the type of an existing serie starts a new shard.")
 	fl_label = misc.MultiString("label", nil, "Labels to associate to the point to save. Must be used with --value and --time.")
+
+	fl_from   = flag.Uint64("from", 0, "When listing values or labels, time of the first point to show.")
+	fl_to     = flag.Uint64("to", 0, "When listing values or labels, time of the last point to show. Defaults to the end of the serie when not specified.")
+	fl_last   = flag.Int("last", 0, "When listing values, only show the last N points matching the other options.")
+	fl_filter = misc.MultiString("filter", nil, "When listing values, only show points with labels matching "+
+		"this expression, like name=value, name!=value, name=~regexp, name!~regexp, name, or !name. Can be repeated.")
+	fl_format = flag.String("format", "text", "When listing values, output format to use. Can be: text, csv, or jsonl (json lines). "+
+		"When exporting or importing, format of the file. Can be: csv, jsonl, binary. Defaults to binary.")
+	fl_file  = flag.String("file", "-", "When exporting or importing, file to write to or read from. - for stdout or stdin.")
+	fl_batch = flag.Int("batch", 1000, "When importing, number of points to append at once.")
+
+	fl_dir = flag.String("dir", "", "When taking a snapshot, directory containing the series to copy, instead of --serie. "+
+		"When following, directory to copy the series into.")
+	fl_dest = flag.String("dest", "", "When taking a snapshot, path of the copy. A serie name with --serie, a directory with --dir.")
+
+	fl_primary  = flag.String("primary", "", "When following, URL of the sync handler of the primary, like http://primary:8080/sync.")
+	fl_interval = flag.Duration("interval", 10*time.Second, "When following, how often to copy the changes of the primary. "+
+		"Copies them once and exits when 0")
+
+	fl_unit        = flag.String("unit", "", "When setting metadata, or adding a value to a new serie, unit of the values, like bytes or ms.")
+	fl_description = flag.String("description", "", "When setting metadata, or adding a value to a new serie, description of the serie.")
+	fl_kind        = flag.String("kind", "", "When setting metadata, or adding a value to a new serie, kind of metric. Can be: counter, gauge, histogram.")
+	fl_resolution  = flag.Duration("resolution", 0, "When setting metadata, or adding a value to a new serie, duration of a unit of time of the points, like 1s or 1ms.")
+
+	fl_repair = flag.Bool("repair", false, "When checking a serie, drop all the entries after the last consistent "+
+		"one in each shard with problems. Data dropped cannot be recovered.")
 )
 
+// Explains how to get the lock on a serie, if err is a *tsdb.LockedError.
+func lockedHint(err error) string {
+	if _, ok := err.(*tsdb.LockedError); !ok {
+		return ""
+	}
+	return " - a tsdb-ingest or metrics server writing to the serie keeps it locked until it is " +
+		"not written to for --maxidle. Use --wait to wait for it"
+}
+
 func AddValue() {
 	if *fl_serie == "" {
 		log.Fatalf("Must specify --serie, to indicate where to store the data")
@@ -45,26 +104,395 @@ func AddValue() {
 	if *fl_maxentries > 0 {
 		s.MaxEntries = *fl_maxentries
 	}
+	valuetype := valueType(*fl_serie)
+	s.ValueType = valuetype
+	value, err := tsdb.ParseValue(*fl_value, valuetype)
+	if err != nil {
+		log.Fatalf("Invalid --value, must be a valid %s: %s", valuetype, err)
+	}
+	s.MaxAge = *fl_maxage
+	s.MaxBytes = *fl_maxbytes
+	s.MaxShards = *fl_maxshards
+	s.LockTimeout = *fl_wait
+	s.InitialMeta = &tsdb.SerieMeta{Unit: *fl_unit, Description: *fl_description, Kind: tsdb.MetricKind(*fl_kind), Resolution: *fl_resolution}
 
 	if len(*fl_label) > int(s.LabelsPerEntry) {
 		log.Fatalf("Too many labels requested via --lable, must be less than --labelsperentry")
 	}
-	if *fl_time == 0 || *fl_time == 0xffffffffffffffff {
+	if *fl_time == 0 || *fl_time == tsdb.SealMarker {
 		log.Fatalf("Time cannot be 0 or 0xfff... (-1) - those are reserved values")
 	}
 
-	err := s.Open()
+	err = s.Open()
 	if err != nil {
-		log.Fatalf("Failed to open time serie: %s", err)
+		log.Fatalf("Failed to open time serie: %s%s", err, lockedHint(err))
 	}
 
-	err = s.Append(*fl_time, *fl_value, *fl_label)
+	err = s.Append(*fl_time, value, *fl_label)
 	if err != nil {
 		log.Fatalf("Failed to open time serie: %s", err)
 	}
 }
 
+// Returns the type of the values to append to a serie: the one requested
+// with --valuetype, or if empty the type of the last shard of the serie,
+// so appending does not start a new shard, and uint64 for a new serie.
+func valueType(serie string) tsdb.ValueType {
+	if *fl_valuetype == "" {
+		last := tsdb.GetLastFile(serie)
+		if last == "" {
+			return tsdb.TypeUint64
+		}
+		point, _, err := tsdb.PeekDataStore(last)
+		if err != nil {
+			log.Fatalf("Failed to read the type of the values of the serie: %s", err)
+		}
+		return point.Type
+	}
+
+	valuetype, err := tsdb.ParseValueType(*fl_valuetype)
+	if err != nil {
+		log.Fatalf("Invalid --valuetype: %s", err)
+	}
+	return valuetype
+}
+
+// Writes the points, one at a time, in a specific format.
+type pointWriter func(point tsdb.Point) error
+
+func newPointWriter(format string) (pointWriter, func() error, error) {
+	switch format {
+	case "text":
+		return func(point tsdb.Point) error {
+			_, err := fmt.Printf("%d\t%s\t%s\n", point.Time, tsdb.FormatValue(point.Value, point.Type), strings.Join(point.Label, " "))
+			return err
+		}, func() error { return nil }, nil
+
+	case "csv":
+		writer := csv.NewWriter(os.Stdout)
+		return func(point tsdb.Point) error {
+			record := append([]string{strconv.FormatUint(point.Time, 10), tsdb.FormatValue(point.Value, point.Type)}, point.Label...)
+			return writer.Write(record)
+		}, func() error { writer.Flush(); return writer.Error() }, nil
+
+	case "jsonl":
+		encoder := json.NewEncoder(os.Stdout)
+		return func(point tsdb.Point) error {
+			return encoder.Encode(point)
+		}, func() error { return nil }, nil
+	}
+	return nil, nil, fmt.Errorf("unknown format '%s' - must be text, csv or jsonl", format)
+}
+
+// Returns true if the flag name was specified on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// Returns the locations of the points between --from and --to.
+func getRange(r *tsdb.SerieReader) (tsdb.Location, tsdb.Location) {
+	start := r.FirstLocation()
+	if flagSet("from") {
+		start = r.Find(func(time uint64) bool { return time >= *fl_from })
+	}
+	end := r.LastLocation()
+	if flagSet("to") {
+		end = r.Find(func(time uint64) bool { return time > *fl_to })
+	}
+	return start, end
+}
+
 func List() {
+	if *fl_serie == "" {
+		log.Fatalf("Must specify --serie, to indicate the data to show")
+	}
+	if flagSet("to") && *fl_to < *fl_from {
+		log.Fatalf("--to must be >= --from")
+	}
+	write, flush, err := newPointWriter(*fl_format)
+	if err != nil {
+		log.Fatalf("Invalid --format: %s", err)
+	}
+	filter, err := tsdb.ParseLabelFilter(*fl_filter)
+	if err != nil {
+		log.Fatalf("Invalid --filter: %s", err)
+	}
+
+	r := tsdb.NewSerieReader(*fl_serie)
+	err = r.Open()
+	if err != nil {
+		log.Fatalf("Failed to open time serie: %s", err)
+	}
+
+	start, end := getRange(r)
+	// Without filters, there is no need to read more than the last N points.
+	if *fl_last > 0 && len(filter) <= 0 {
+		if last := end.Minus(r, *fl_last); start.Before(last) {
+			start = last
+		}
+	}
+
+	points, err := r.GetFilteredData(start, end, filter, nil)
+	if err != nil {
+		log.Fatalf("Failed to read time serie: %s", err)
+	}
+	if *fl_last > 0 && len(points) > *fl_last {
+		points = points[len(points)-*fl_last:]
+	}
+
+	for _, point := range points {
+		err := write(point)
+		if err != nil {
+			log.Fatalf("Failed to write output: %s", err)
+		}
+	}
+	err = flush()
+	if err != nil {
+		log.Fatalf("Failed to write output: %s", err)
+	}
+}
+
+// Updates the metadata of the serie with the flags specified, leaving the
+// other fields unchanged.
+func SetMeta() {
+	if *fl_serie == "" {
+		log.Fatalf("Must specify --serie, to indicate the serie to update")
+	}
+
+	// Only take the lock, opening a writer could start a new shard if
+	// the options do not match the ones of the serie.
+	lock, err := tsdb.LockSerie(*fl_serie, 0666, *fl_wait)
+	if err != nil {
+		log.Fatalf("Failed to lock time serie: %s%s", err, lockedHint(err))
+	}
+	defer lock.Unlock()
+
+	meta, err := tsdb.ReadSerieMeta(*fl_serie)
+	if err != nil {
+		log.Fatalf("Failed to read metadata: %s", err)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "unit":
+			meta.Unit = *fl_unit
+		case "description":
+			meta.Description = *fl_description
+		case "kind":
+			meta.Kind = tsdb.MetricKind(*fl_kind)
+		case "resolution":
+			meta.Resolution = *fl_resolution
+		}
+	})
+	err = tsdb.WriteSerieMeta(*fl_serie, meta, 0666)
+	if err != nil {
+		log.Fatalf("Failed to set metadata: %s", err)
+	}
+}
+
+func ListLabels() {
+	if *fl_serie == "" {
+		log.Fatalf("Must specify --serie, to indicate the labels to show")
+	}
+	if flagSet("to") && *fl_to < *fl_from {
+		log.Fatalf("--to must be >= --from")
+	}
+
+	r := tsdb.NewSerieReader(*fl_serie)
+	err := r.Open()
+	if err != nil {
+		log.Fatalf("Failed to open time serie: %s", err)
+	}
+	start, end := getRange(r)
+	labels, err := r.ListLabels(start, end)
+	if err != nil {
+		log.Fatalf("Failed to read time serie: %s", err)
+	}
+	for _, label := range labels {
+		fmt.Println(label)
+	}
+}
+
+func ShowMeta() {
+	if *fl_serie == "" {
+		log.Fatalf("Must specify --serie, to indicate the serie to show")
+	}
+
+	meta, err := tsdb.ReadSerieMeta(*fl_serie)
+	if err != nil {
+		log.Fatalf("Failed to read metadata: %s", err)
+	}
+	fmt.Printf("unit: %s\ndescription: %s\nkind: %s\nresolution: %s\n", meta.Unit, meta.Description, meta.Kind, meta.Resolution)
+}
+
+// Returns the format requested for export or import, binary unless
+// --format was specified.
+func exportFormat() tsdb.ExportFormat {
+	name := "binary"
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "format" {
+			name = *fl_format
+		}
+	})
+	format, err := tsdb.ParseExportFormat(name)
+	if err != nil {
+		log.Fatalf("Invalid --format: %s", err)
+	}
+	return format
+}
+
+func Export() {
+	if *fl_serie == "" {
+		log.Fatalf("Must specify --serie, to indicate the serie to export")
+	}
+	format := exportFormat()
+
+	output := os.Stdout
+	if *fl_file != "-" {
+		var err error
+		output, err = os.Create(*fl_file)
+		if err != nil {
+			log.Fatalf("Failed to create output: %s", err)
+		}
+	}
+	written, err := tsdb.ExportSerie(*fl_serie, output, format)
+	if err == nil {
+		err = output.Close()
+	}
+	if err != nil {
+		log.Fatalf("Failed to export time serie after %d points: %s", written, err)
+	}
+}
+
+func Import() {
+	if *fl_serie == "" {
+		log.Fatalf("Must specify --serie, to indicate where to store the data")
+	}
+	format := exportFormat()
+
+	input := os.Stdin
+	if *fl_file != "-" {
+		var err error
+		input, err = os.Open(*fl_file)
+		if err != nil {
+			log.Fatalf("Failed to open input: %s", err)
+		}
+		defer input.Close()
+	}
+	written, err := tsdb.ImportSerie(*fl_serie, input, format, *fl_batch, *fl_wait)
+	if err != nil {
+		log.Fatalf("Failed to import time serie after %d points: %s%s", written, err, lockedHint(err))
+	}
+	log.Printf("Imported %d points", written)
+}
+
+func Snapshot() {
+	if (*fl_serie == "") == (*fl_dir == "") {
+		log.Fatalf("Must specify either --serie or --dir, to indicate what to copy")
+	}
+	if *fl_dest == "" {
+		log.Fatalf("Must specify --dest, to indicate where to copy the data")
+	}
+
+	var stats tsdb.SnapshotStats
+	var err error
+	if *fl_serie != "" {
+		stats, err = tsdb.SnapshotSerie(*fl_serie, *fl_dest)
+	} else {
+		var series []string
+		series, stats, err = tsdb.SnapshotSeries(*fl_dir, *fl_dest)
+		log.Printf("Copied %d series", len(series))
+	}
+	if err != nil {
+		log.Fatalf("Failed to take snapshot: %s", err)
+	}
+	log.Printf("Linked %d files, copied %d files, %d bytes", stats.Linked, stats.Copied, stats.Bytes)
+}
+
+func Follow() {
+	if *fl_dir == "" {
+		log.Fatalf("Must specify --dir, to indicate where to store the data")
+	}
+	if *fl_primary == "" {
+		log.Fatalf("Must specify --primary, to indicate the server to follow")
+	}
+
+	follower := tsdb.NewFollower(*fl_primary, *fl_dir)
+	for {
+		changed, err := follower.Sync()
+		if err != nil {
+			log.Printf("Failed to sync with %s: %s", *fl_primary, err)
+		} else if changed > 0 {
+			log.Printf("Updated %d shards", changed)
+		}
+		if *fl_interval <= 0 {
+			if err != nil {
+				os.Exit(1)
+			}
+			return
+		}
+		time.Sleep(*fl_interval)
+	}
+}
+
+func Fsck() {
+	if *fl_serie == "" {
+		log.Fatalf("Must specify --serie, to indicate the serie to check")
+	}
+
+	var result *tsdb.SerieCheck
+	var err error
+	if *fl_repair {
+		result, err = tsdb.RepairSerie(*fl_serie, *fl_wait)
+	} else {
+		result, err = tsdb.CheckSerie(*fl_serie)
+	}
+	if err != nil {
+		log.Fatalf("Failed to check time serie: %s%s", err, lockedHint(err))
+	}
+
+	for _, shard := range result.Shard {
+		for _, problem := range shard.Problems {
+			fmt.Println(problem)
+		}
+		for _, warning := range shard.Warnings {
+			fmt.Println("warning:", warning)
+		}
+		if shard.Valid < shard.Entries {
+			action := "would drop"
+			if shard.Repaired {
+				action = "dropped"
+			}
+			fmt.Printf("shard %08x: %s %d of %d entries\n", shard.Id, action, shard.Entries-shard.Valid, shard.Entries)
+		}
+	}
+
+	if *fl_repair {
+		result, err = tsdb.CheckSerie(*fl_serie)
+		if err != nil {
+			log.Fatalf("Failed to check time serie after repair: %s", err)
+		}
+	}
+	if problems := result.Problems(); len(problems) > 0 {
+		log.Fatalf("Serie %s has %d problems", *fl_serie, len(problems))
+	}
+}
+
+func Upgrade() {
+	if *fl_serie == "" {
+		log.Fatalf("Must specify --serie, to indicate the serie to upgrade")
+	}
+
+	upgraded, err := tsdb.UpgradeSerie(*fl_serie, *fl_wait)
+	if err != nil {
+		log.Fatalf("Failed to upgrade time serie after %d files: %s%s", upgraded, err, lockedHint(err))
+	}
+	fmt.Printf("upgraded %d files\n", upgraded)
 }
 
 func main() {
@@ -75,6 +503,24 @@ func main() {
 		AddValue()
 	case "list":
 		List()
+	case "labels":
+		ListLabels()
+	case "fsck":
+		Fsck()
+	case "set-meta":
+		SetMeta()
+	case "meta":
+		ShowMeta()
+	case "export":
+		Export()
+	case "import":
+		Import()
+	case "snapshot":
+		Snapshot()
+	case "follow":
+		Follow()
+	case "upgrade":
+		Upgrade()
 	default:
 		log.Fatalf("Invalid action specified. Use --help to see list of valid actions")
 	}
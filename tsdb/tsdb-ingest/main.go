@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"github.com/ccontavalli/goutils/misc"
+	"github.com/ccontavalli/goutils/tsdb"
+	"github.com/ccontavalli/goutils/tsdb/ingest"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	fl_path = flag.String("path", "", "Directory where to store the series, one per metric received. "+
+		"Dots in the names of the metrics separate subdirectories, like servers/web1/cpu for servers.web1.cpu.")
+
+	fl_graphite = misc.MultiString("graphite", nil, "Address to receive graphite plaintext on, as "+
+		"network:address, like tcp::2003 or udp:127.0.0.1:2003. Can be repeated.")
+	fl_influx = misc.MultiString("influx", nil, "Address to receive influx line protocol on, as "+
+		"network:address, like tcp::8094 or udp::8089. Can be repeated.")
+	fl_precision = flag.Duration("precision", time.Nanosecond, "Unit of the timestamps received in influx line protocol.")
+	fl_timeunit  = flag.Duration("timeunit", time.Second, "Unit of the times stored in the series.")
+
+	fl_labelsperentry = flag.Int("labelsperentry", 4, "Maximum number of labels per sample. Samples with "+
+		"more labels, like influx points with more tags, are dropped with an error.")
+
+	fl_maxage = flag.Uint64("maxage", 0, "Remove the shards whose points are all older "+
+		"than this, in the unit of --timeunit, from the last point. Disabled when 0")
+	fl_maxbytes = flag.Int64("maxbytes", 0, "Remove the oldest shards to keep each serie "+
+		"below this size in bytes. Disabled when 0")
+	fl_maxshards = flag.Int("maxshards", 0, "Remove the oldest shards to keep at most "+
+		"this number of shards per serie. Disabled when 0")
+
+	fl_compress = flag.Bool("compress", false, "Compress the shards once complete. They take less space on disk, "+
+		"but each is decompressed in memory when read, instead of being mapped.")
+
+	fl_durability = flag.String("durability", "seal", "When to sync the series to disk. Can be: none, "+
+		"async (schedule a write after each sample), periodic (every --syncevery samples), seal (when a file is complete).")
+	fl_syncevery = flag.Int("syncevery", 1000, "With --durability=periodic, number of samples between syncs of a serie.")
+
+	fl_outoforder = flag.String("outoforder", "allow", "What to do with samples older than the last one of their serie. Can be: "+
+		"allow (append them anyway), backfill (store them aside, merged on read), reject (drop them with an error).")
+	fl_compactinterval = flag.Duration("compactinterval", time.Hour, "With --outoforder=backfill, how often to move "+
+		"the backfilled samples in place. Disabled when 0")
+	fl_maxidle = flag.Duration("maxidle", tsdb.DefaultMaxIdle, "Close the series not written to for this long, so other "+
+		"processes like tsdb-cli can add values to, repair or upgrade them. Series are kept open when 0")
+)
+
+func serve(server *ingest.Server, listen string, errors chan error) {
+	index := strings.Index(listen, ":")
+	if index < 0 {
+		log.Fatalf("Invalid address '%s' - must be network:address, like tcp::2003", listen)
+	}
+	network, address := listen[:index], listen[index+1:]
+	log.Printf("Listening on %s %s", network, address)
+	go func() {
+		errors <- server.ListenAndServe(network, address)
+	}()
+}
+
+func main() {
+	flag.Parse()
+
+	if *fl_path == "" {
+		log.Fatalf("Must specify --path, to indicate where to store the data")
+	}
+	if len(*fl_graphite) <= 0 && len(*fl_influx) <= 0 {
+		log.Fatalf("Must specify at least one address to listen on with --graphite or --influx")
+	}
+
+	durability, err := tsdb.ParseDurability(*fl_durability)
+	if err != nil {
+		log.Fatalf("Invalid --durability: %s", err)
+	}
+	outoforder, err := tsdb.ParseOutOfOrderPolicy(*fl_outoforder)
+	if err != nil {
+		log.Fatalf("Invalid --outoforder: %s", err)
+	}
+
+	if *fl_labelsperentry < 0 || *fl_labelsperentry > 256 {
+		log.Fatalf("Invalid --labelsperentry: must be between 0 and 256")
+	}
+
+	pool := tsdb.NewWriterPool(*fl_path)
+	pool.LabelsPerEntry = *fl_labelsperentry
+	pool.DataStoreOptions.Durability = durability
+	pool.DataStoreOptions.SyncEvery = *fl_syncevery
+	pool.DataStoreOptions.CompactOnSeal = *fl_compress
+	pool.LabelOptions.Durability = durability
+	pool.MaxAge = *fl_maxage
+	pool.MaxBytes = *fl_maxbytes
+	pool.MaxShards = *fl_maxshards
+	pool.OutOfOrder = outoforder
+	pool.InitialMeta.Resolution = *fl_timeunit
+	pool.MaxIdle = *fl_maxidle
+	if *fl_maxidle > 0 {
+		go func() {
+			for range time.Tick(*fl_maxidle / 2) {
+				pool.CloseIdle()
+			}
+		}()
+	}
+	if outoforder == tsdb.OutOfOrderBackfill && *fl_compactinterval > 0 {
+		go func() {
+			for range time.Tick(*fl_compactinterval) {
+				if err := pool.CompactBackfill(); err != nil {
+					log.Printf("Failed to compact backfilled samples: %s", err)
+				}
+			}
+		}()
+	}
+
+	errors := make(chan error)
+	for _, listen := range *fl_graphite {
+		server := ingest.NewServer(pool, ingest.ParseGraphite)
+		server.TimeUnit = *fl_timeunit
+		serve(server, listen, errors)
+	}
+	for _, listen := range *fl_influx {
+		server := ingest.NewServer(pool, ingest.InfluxParser(*fl_precision))
+		server.TimeUnit = *fl_timeunit
+		serve(server, listen, errors)
+	}
+
+	// Flush and unlock the series before exiting, also on SIGINT or SIGTERM.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err = <-errors:
+		log.Printf("Failed to serve: %s", err)
+	case sig := <-signals:
+		log.Printf("Received %s, exiting", sig)
+		err = nil
+	}
+	pool.Sync()
+	pool.Close()
+	if err != nil {
+		os.Exit(1)
+	}
+}
@@ -43,6 +43,24 @@ func GetSeries(basepath string) []string {
 	return found
 }
 
+// Like GetSeries, but also returns the series in the subdirectories of
+// basepath, recursively. Hidden directories are skipped.
+func FindSeries(basepath string) []string {
+	found := []string{}
+	filepath.Walk(basepath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if path != basepath && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		found = append(found, GetSeries(path)...)
+		return nil
+	})
+	sort.Strings(found)
+	return found
+}
+
 // dbbasepath is the path of a serie. For example, /path/to/directory/serie-name.
 func GetDataFiles(dbbasepath string) []string {
 	pattern := dbbasepath + "-[0-9a-f][0-9a-f][0-9a-f][0-9a-f][0-9a-f][0-9a-f][0-9a-f][0-9a-f]" + ".data"
@@ -82,7 +100,9 @@ func MakeLabelStoreFileName(dbbasepath string, number uint32) string {
 	return MakeFileName(dbbasepath, number, "labels")
 }
 
-func mmapFile(f *os.File, flags int) ([]byte, error) {
+// Maps the whole file in memory, shared. If mlock is true, the mapping is
+// also locked in memory, and an error returned if that fails.
+func mmapFile(f *os.File, flags int, mlock bool) ([]byte, error) {
 	st, err := f.Stat()
 	if err != nil {
 		return []byte{}, err
@@ -96,8 +116,26 @@ func mmapFile(f *os.File, flags int) ([]byte, error) {
 		return []byte{}, err
 	}
 
-	err = syscall.Mlock(data)
-	return data[:size], err
+	if mlock {
+		err = syscall.Mlock(data)
+		if err != nil {
+			syscall.Munmap(data)
+			return []byte{}, fmt.Errorf("could not mlock %s: %s", f.Name(), err)
+		}
+	}
+	return data[:size], nil
+}
+
+// Returns the inode of a file, 0 if it cannot be read.
+func fileInode(filename string) uint64 {
+	st, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		return uint64(sys.Ino)
+	}
+	return 0
 }
 
 func MultipleOfPageSize(value int) int {
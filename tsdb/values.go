@@ -0,0 +1,218 @@
+package tsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Type of the values stored in a data file. Values are always stored as
+// 64 bits, the type defines how to interpret them.
+type ValueType uint8
+
+const (
+	TypeUint64  ValueType = 0
+	TypeInt64   ValueType = 1
+	TypeFloat64 ValueType = 2
+)
+
+var valueTypeNames = map[ValueType]string{
+	TypeUint64:  "uint64",
+	TypeInt64:   "int64",
+	TypeFloat64: "float64",
+}
+
+func (vt ValueType) String() string {
+	name, ok := valueTypeNames[vt]
+	if !ok {
+		return fmt.Sprintf("unknown(%d)", uint8(vt))
+	}
+	return name
+}
+
+func (vt ValueType) Valid() error {
+	if _, ok := valueTypeNames[vt]; !ok {
+		return fmt.Errorf("invalid value type %d", uint8(vt))
+	}
+	return nil
+}
+
+func ParseValueType(name string) (ValueType, error) {
+	for vt, vtname := range valueTypeNames {
+		if vtname == name {
+			return vt, nil
+		}
+	}
+	return TypeUint64, fmt.Errorf("unknown value type '%s' - must be uint64, int64 or float64", name)
+}
+
+// Parses a value in its string representation.
+func ParseValue(value string, vt ValueType) (uint64, error) {
+	switch vt {
+	case TypeUint64:
+		return strconv.ParseUint(value, 10, 64)
+	case TypeInt64:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		return uint64(parsed), err
+	case TypeFloat64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		return math.Float64bits(parsed), err
+	}
+	return 0, vt.Valid()
+}
+
+// Returns the string representation of a value, as accepted by ParseValue.
+func FormatValue(value uint64, vt ValueType) string {
+	switch vt {
+	case TypeInt64:
+		return strconv.FormatInt(int64(value), 10)
+	case TypeFloat64:
+		return strconv.FormatFloat(math.Float64frombits(value), 'g', -1, 64)
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+// Converts a value from one type to another. Returns an error if the value
+// cannot be represented in the new type, like a negative number as uint64,
+// or 1.5 as int64. Large integers may lose precision when converted to float64.
+func ConvertValue(value uint64, from, to ValueType) (uint64, error) {
+	if from == to {
+		return value, nil
+	}
+
+	switch from {
+	case TypeUint64:
+		switch to {
+		case TypeInt64:
+			if value > math.MaxInt64 {
+				return 0, fmt.Errorf("value %d overflows int64", value)
+			}
+			return value, nil
+		case TypeFloat64:
+			return math.Float64bits(float64(value)), nil
+		}
+	case TypeInt64:
+		switch to {
+		case TypeUint64:
+			if int64(value) < 0 {
+				return 0, fmt.Errorf("value %d is negative, cannot be uint64", int64(value))
+			}
+			return value, nil
+		case TypeFloat64:
+			return math.Float64bits(float64(int64(value))), nil
+		}
+	case TypeFloat64:
+		float := math.Float64frombits(value)
+		if float != math.Trunc(float) || math.IsInf(float, 0) {
+			return 0, fmt.Errorf("value %g is not an integer", float)
+		}
+		switch to {
+		case TypeUint64:
+			if float < 0 || float >= math.MaxUint64 {
+				return 0, fmt.Errorf("value %g does not fit an uint64", float)
+			}
+			return uint64(float), nil
+		case TypeInt64:
+			if float < math.MinInt64 || float >= math.MaxInt64 {
+				return 0, fmt.Errorf("value %g does not fit an int64", float)
+			}
+			return uint64(int64(float)), nil
+		}
+	}
+	if err := from.Valid(); err != nil {
+		return 0, err
+	}
+	return 0, to.Valid()
+}
+
+// Returns the value of the point as a float64, regardless of its type.
+func (p Point) Float64() float64 {
+	switch p.Type {
+	case TypeInt64:
+		return float64(int64(p.Value))
+	case TypeFloat64:
+		return math.Float64frombits(p.Value)
+	}
+	return float64(p.Value)
+}
+
+// Returns the value of the point as an int64. Values of other types are
+// converted, truncating them if necessary.
+func (p Point) Int64() int64 {
+	switch p.Type {
+	case TypeFloat64:
+		return int64(math.Float64frombits(p.Value))
+	}
+	return int64(p.Value)
+}
+
+// Returns the value of the point as an uint64. Values of other types are
+// converted, truncating them if necessary.
+func (p Point) Uint64() uint64 {
+	switch p.Type {
+	case TypeFloat64:
+		return uint64(math.Float64frombits(p.Value))
+	}
+	return p.Value
+}
+
+type jsonPoint struct {
+	Time  uint64          `json:"time"`
+	Value json.RawMessage `json:"value"`
+	Type  string          `json:"type,omitempty"`
+	Label []string        `json:"label,omitempty"`
+}
+
+// Points are represented in json with their value as a number of the
+// correct type. Infinities and NaN, not representable in json, are
+// encoded as the strings "+Inf", "-Inf" and "NaN".
+func (p Point) MarshalJSON() ([]byte, error) {
+	jp := jsonPoint{Time: p.Time, Label: p.Label}
+	if p.Type != TypeUint64 {
+		jp.Type = p.Type.String()
+	}
+
+	value := FormatValue(p.Value, p.Type)
+	if float := p.Float64(); p.Type == TypeFloat64 && (math.IsNaN(float) || math.IsInf(float, 0)) {
+		value = strconv.Quote(value)
+	}
+	jp.Value = json.RawMessage(value)
+	return json.Marshal(jp)
+}
+
+// Parses a point in json. If the type is not specified, it is inferred
+// from the value: numbers with a fractional part or exponent are float64,
+// negative numbers int64, and any other number uint64.
+func (p *Point) UnmarshalJSON(data []byte) error {
+	jp := jsonPoint{}
+	err := json.Unmarshal(data, &jp)
+	if err != nil {
+		return err
+	}
+
+	value := string(bytes.TrimSpace(jp.Value))
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		value = unquoted
+	}
+
+	vt := TypeUint64
+	if jp.Type != "" {
+		vt, err = ParseValueType(jp.Type)
+		if err != nil {
+			return err
+		}
+	} else if bytes.ContainsAny([]byte(value), ".eEnNiI") {
+		vt = TypeFloat64
+	} else if len(value) > 0 && value[0] == '-' {
+		vt = TypeInt64
+	}
+
+	parsed, err := ParseValue(value, vt)
+	if err != nil {
+		return fmt.Errorf("invalid value %s: %s", value, err)
+	}
+	*p = Point{jp.Time, parsed, jp.Label, vt}
+	return nil
+}
@@ -0,0 +1,125 @@
+package tsdb
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvertValue(t *testing.T) {
+	minus := int64(-5)
+
+	value, err := ConvertValue(42, TypeUint64, TypeFloat64)
+	assert.Nil(t, err)
+	assert.Equal(t, 42.0, math.Float64frombits(value))
+	value, err = ConvertValue(uint64(minus), TypeInt64, TypeFloat64)
+	assert.Nil(t, err)
+	assert.Equal(t, -5.0, math.Float64frombits(value))
+	value, err = ConvertValue(math.Float64bits(-5), TypeFloat64, TypeInt64)
+	assert.Nil(t, err)
+	assert.Equal(t, minus, int64(value))
+	value, err = ConvertValue(42, TypeInt64, TypeUint64)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(42), value)
+
+	_, err = ConvertValue(uint64(minus), TypeInt64, TypeUint64)
+	assert.NotNil(t, err)
+	_, err = ConvertValue(math.MaxUint64, TypeUint64, TypeInt64)
+	assert.NotNil(t, err)
+	_, err = ConvertValue(math.Float64bits(1.5), TypeFloat64, TypeUint64)
+	assert.NotNil(t, err)
+	_, err = ConvertValue(math.Float64bits(math.NaN()), TypeFloat64, TypeInt64)
+	assert.NotNil(t, err)
+	_, err = ConvertValue(math.Float64bits(-1), TypeFloat64, TypeUint64)
+	assert.NotNil(t, err)
+	_, err = ConvertValue(1, TypeUint64, ValueType(42))
+	assert.NotNil(t, err)
+}
+
+func TestPointJson(t *testing.T) {
+	points := []Point{
+		{1, 18446744073709551615, []string{"a"}, TypeUint64},
+		{2, uint64(18446744073709551611), nil, TypeInt64},
+		{3, math.Float64bits(0.1), nil, TypeFloat64},
+		{4, math.Float64bits(math.Inf(-1)), nil, TypeFloat64},
+		{5, math.Float64bits(3), nil, TypeFloat64},
+	}
+	encoded, err := json.Marshal(points)
+	assert.Nil(t, err)
+	assert.Equal(t, `[{"time":1,"value":18446744073709551615,"label":["a"]},`+
+		`{"time":2,"value":-5,"type":"int64"},`+
+		`{"time":3,"value":0.1,"type":"float64"},`+
+		`{"time":4,"value":"-Inf","type":"float64"},`+
+		`{"time":5,"value":3,"type":"float64"}]`, string(encoded))
+
+	decoded := []Point{}
+	err = json.Unmarshal(encoded, &decoded)
+	assert.Nil(t, err)
+	assert.Equal(t, points, decoded)
+
+	// Types are inferred when missing.
+	err = json.Unmarshal([]byte(`[{"time":1,"value":12},{"time":2,"value":-12},{"time":3,"value":1.5e3},{"time":4,"value":"NaN"}]`), &decoded)
+	assert.Nil(t, err)
+	assert.Equal(t, TypeUint64, decoded[0].Type)
+	assert.Equal(t, int64(-12), decoded[1].Int64())
+	assert.Equal(t, 1500.0, decoded[2].Float64())
+	assert.True(t, math.IsNaN(decoded[3].Float64()))
+
+	err = json.Unmarshal([]byte(`[{"time":1,"value":1.5,"type":"int64"}]`), &decoded)
+	assert.NotNil(t, err)
+	err = json.Unmarshal([]byte(`[{"time":1,"value":1,"type":"complex"}]`), &decoded)
+	assert.NotNil(t, err)
+}
+
+func TestTypedSerie(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.ValueType = TypeFloat64
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		err := s.AppendFloat64(uint64(i), float64(i)/4-10, nil)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, s.AppendInt64(500, -3, nil))
+	assert.Nil(t, s.AppendPoint(Point{501, 7, nil, TypeUint64}))
+	s.Close()
+
+	// Reopening with a different type starts a new shard.
+	s.ValueType = TypeInt64
+	err = s.Open()
+	assert.Nil(t, err)
+	assert.NotNil(t, s.AppendFloat64(502, 1.5, nil))
+	assert.Nil(t, s.AppendInt64(502, -1, nil))
+	s.Close()
+
+	r := NewSerieReader(filepath.Join(tempdir, "test"))
+	err = r.Open()
+	assert.Nil(t, err)
+	data, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 503, len(data))
+	for i, point := range data[:500] {
+		assert.Equal(t, TypeFloat64, point.Type)
+		assert.Equal(t, float64(i)/4-10, point.Float64())
+	}
+	assert.Equal(t, -3.0, data[500].Float64())
+	assert.Equal(t, 7.0, data[501].Float64())
+	assert.Equal(t, TypeInt64, data[502].Type)
+	assert.Equal(t, int64(-1), data[502].Int64())
+
+	// Aggregates work across types.
+	summarizer, err := NewSummarizer("min", 1000)
+	assert.Nil(t, err)
+	data, err = r.GetData(r.FirstLocation(), r.LastLocation(), summarizer)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(data))
+	assert.Equal(t, -10.0, data[0].Float64())
+}
@@ -0,0 +1,397 @@
+package tsdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+	"unsafe"
+)
+
+// A Problem found while checking the files of a serie.
+type Problem struct {
+	// Full path of the file with the problem.
+	File string
+	// Index of the first entry affected, -1 if the problem is not with an entry.
+	Entry   int
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Entry < 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%s: entry %d: %s", p.File, p.Entry, p.Message)
+}
+
+// Result of checking a single shard of a serie.
+type ShardCheck struct {
+	Id uint32
+	// Number of entries in the shard, according to its header.
+	Entries int
+	// Number of consistent entries, from the beginning of the shard.
+	// All entries from Valid onward are dropped by a repair.
+	Valid int
+	// True if the shard ends with a valid seal marker.
+	Sealed bool
+	// True if the shard is in FormatCompressed.
+	Compressed bool
+	// True if the shard was modified by RepairSerie.
+	Repaired bool
+
+	Problems []Problem
+	// Anomalies that do not make entries unreadable, and are not repaired.
+	// For example, times going backward, as written with OutOfOrderAllow.
+	Warnings []Problem
+
+	// Actions needed to repair the shard.
+	truncate      bool
+	tooshort      bool
+	missinglabels bool
+	// Offset in the .labels file of the first corrupted label, -1 if none.
+	badlabels int
+}
+
+// Result of checking all the shards of a serie.
+type SerieCheck struct {
+	Path  string
+	Shard []ShardCheck
+}
+
+// Returns all the problems found, in all shards.
+func (sc *SerieCheck) Problems() []Problem {
+	problems := []Problem{}
+	for _, shard := range sc.Shard {
+		problems = append(problems, shard.Problems...)
+	}
+	return problems
+}
+
+// Returns all the warnings found, in all shards.
+func (sc *SerieCheck) Warnings() []Problem {
+	warnings := []Problem{}
+	for _, shard := range sc.Shard {
+		warnings = append(warnings, shard.Warnings...)
+	}
+	return warnings
+}
+
+// True if no problem was found, warnings are ignored.
+func (sc *SerieCheck) Ok() bool {
+	return len(sc.Problems()) <= 0
+}
+
+func (check *ShardCheck) addProblem(file string, entry int, format string, args ...interface{}) {
+	check.Problems = append(check.Problems, Problem{file, entry, fmt.Sprintf(format, args...)})
+}
+
+func (check *ShardCheck) addWarning(file string, entry int, format string, args ...interface{}) {
+	check.Warnings = append(check.Warnings, Problem{file, entry, fmt.Sprintf(format, args...)})
+}
+
+// Walks the labels in a .labels file, returns the offset of the end of the
+// valid labels, and the error that stopped the walk, if any.
+func checkLabels(raw []byte) (int, error) {
+	ls := &LabelStore{"", raw, nil, GetHeaderSize(), 0, DurabilityNone, false, false, false}
+	offset := GetHeaderSize()
+	for offset < len(raw) {
+		name, err := ls.LoadString(offsetLabel(offset))
+		if err != nil {
+			return offset, err
+		}
+		if name == "" {
+			break
+		}
+		offset += (4 + len(name) + 7) / 8 * 8
+	}
+	return offset, nil
+}
+
+func checkShard(dbbasepath string, id uint32) (ShardCheck, error) {
+	check := ShardCheck{Id: id, badlabels: -1}
+	datafile := MakeDataStoreFileName(dbbasepath, id)
+	labelfile := MakeLabelStoreFileName(dbbasepath, id)
+
+	// Labels first, so entries can be checked against the valid ones.
+	labelsend := 0
+	raw, err := ioutil.ReadFile(labelfile)
+	if err == nil && !hasMagic(raw, labelsMagic) {
+		// Written without header, converted as readers do.
+		raw, err = upgradeLabelStore(labelfile, raw)
+	}
+	if os.IsNotExist(err) {
+		check.missinglabels = true
+		check.addProblem(labelfile, -1, "labels file is missing")
+	} else if err != nil {
+		return check, err
+	} else if swap, err := checkHeader(labelfile, raw, labelsMagic); err != nil {
+		check.addProblem(labelfile, -1, "invalid header: %s", err)
+	} else {
+		if swap {
+			raw = swapLabelStore(raw)
+		}
+		labelsend, err = checkLabels(raw)
+		if err != nil && swap {
+			check.addProblem(labelfile, -1, "label at offset %d is corrupted, cannot be repaired as written with a different byte order: %s", labelsend, err)
+		} else if err != nil {
+			check.badlabels = labelsend
+			check.addProblem(labelfile, -1, "label at offset %d is corrupted: %s", labelsend, err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(datafile)
+	if err != nil {
+		return check, err
+	}
+	if len(data) >= unversionedHeaderSize+GetEntrySize(0) && !hasMagic(data, dataMagic) {
+		data, err = upgradeDataStore(datafile, data)
+		if err != nil {
+			check.addProblem(datafile, -1, "invalid header: %s", err)
+			return check, nil
+		}
+	}
+	if len(data) < GetHeaderSize()+GetEntrySize(0) {
+		check.tooshort = true
+		check.addProblem(datafile, -1, "file is too short to be a data file, %d bytes", len(data))
+		return check, nil
+	}
+	swap, err := checkHeader(datafile, data, dataMagic)
+	if err != nil {
+		check.addProblem(datafile, -1, "invalid header: %s", err)
+		return check, nil
+	}
+	if swap {
+		data = swapDataStore(data)
+	}
+	if err := getValueType(data).Valid(); err != nil {
+		check.addProblem(datafile, -1, "invalid header: %s", err)
+		return check, nil
+	}
+
+	var ds *DataStore
+	switch format := getDataFormat(data); format {
+	case FormatRaw:
+		ds = CreateDataStore(datafile, data)
+		entrysize := uint64(GetEntrySize(ds.lpe))
+		if *ds.cursor%entrysize != 0 {
+			check.truncate = true
+			check.addProblem(datafile, -1, "cursor %d is not a multiple of the entry size %d", *ds.cursor, entrysize)
+		}
+		if *ds.cursor > uint64(len(ds.ring)) {
+			check.truncate = true
+			check.addProblem(datafile, -1, "cursor %d points past the end of the file", *ds.cursor)
+		}
+	case FormatCompressed:
+		check.Compressed = true
+		decoded, err := decompressDataStore(data)
+		if err != nil {
+			check.addProblem(datafile, -1, "cannot decompress: %s", err)
+			return check, nil
+		}
+		ds = CreateDataStore(datafile, decoded)
+	default:
+		check.addProblem(datafile, -1, "unknown format %d", format)
+		return check, nil
+	}
+	ds.mapped = false
+
+	check.Entries = ds.GetEntries()
+	previous := uint64(0)
+	for ; check.Valid < check.Entries; check.Valid++ {
+		i := check.Valid
+		offset := ds.GetOffset(i)
+		time, value := ds.GetTime(offset), ds.GetValue(offset)
+
+		if check.Sealed {
+			check.addProblem(datafile, i, "found after the seal marker")
+			break
+		}
+		if time == SealMarker {
+			if value != SealMarker {
+				check.addProblem(datafile, i, "invalid seal marker, value is %d", value)
+				break
+			}
+			check.Sealed = true
+			continue
+		}
+		// Readers return the entries as stored, a repair would only lose them.
+		if time < previous {
+			check.addWarning(datafile, i, "time %d is before the time %d of the previous entry", time, previous)
+		}
+
+		bad := LabelID(0)
+		for _, label := range ds.GetLabels(offset, nil) {
+			if labelOffset(label) >= labelsend || (label-1)%8 != 0 {
+				bad = label
+				break
+			}
+		}
+		if bad != 0 {
+			check.addProblem(datafile, i, "label id %d does not point to a valid label", bad)
+			break
+		}
+		previous = time
+	}
+	if check.Valid < check.Entries && !check.Compressed {
+		check.truncate = true
+	}
+	if check.Valid < check.Entries && check.Compressed {
+		check.addProblem(datafile, -1, "compressed shards cannot be repaired, %d of %d entries are valid", check.Valid, check.Entries)
+	}
+	if check.truncate && swap {
+		check.truncate = false
+		check.addProblem(datafile, -1, "shards written with a different byte order cannot be repaired, %d of %d entries are valid", check.Valid, check.Entries)
+	}
+	return check, nil
+}
+
+// Checks the consistency of all the shards of a serie.
+//
+// For each shard, verifies that the cursor in the header is aligned to an
+// entry, that the label ids point to valid labels in the .labels file, and
+// that nothing follows the seal marker. Timestamps that are not
+// monotonically increasing are reported as warnings.
+//
+// The serie is not locked, so a writer appending at the same time may
+// cause spurious problems in the last shard.
+func CheckSerie(dbbasepath string) (*SerieCheck, error) {
+	result := &SerieCheck{dbbasepath, []ShardCheck{}}
+	for _, filename := range GetDataFiles(dbbasepath) {
+		id := ParseFileName(dbbasepath, filename)
+		if id == 0 {
+			continue
+		}
+		check, err := checkShard(dbbasepath, id)
+		if err != nil {
+			return nil, err
+		}
+		result.Shard = append(result.Shard, check)
+	}
+	return result, nil
+}
+
+// Writes zeros in a file from offset until size.
+func zeroFile(file *os.File, offset, size int) error {
+	if offset >= size {
+		return nil
+	}
+	_, err := file.WriteAt(make([]byte, size-offset), int64(offset))
+	return err
+}
+
+// Sets the cursor of a FormatRaw .data file to the specified number of
+// entries, and clears all the entries after it.
+func truncateDataStore(datafile string, entries int) error {
+	file, err := os.OpenFile(datafile, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header := make([]byte, GetHeaderSize())
+	_, err = file.ReadAt(header, 0)
+	if err != nil {
+		return err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	lpe := int(*(*uint8)(unsafe.Pointer(&header[16])))
+	cursor := GetHeaderSize() + entries*GetEntrySize(lpe)
+	*(*uint64)(unsafe.Pointer(&header[8])) = uint64(entries * GetEntrySize(lpe))
+
+	// Readers use the cursor to know how many entries are valid, update it first.
+	_, err = file.WriteAt(header[8:16], 8)
+	if err != nil {
+		return err
+	}
+	// Append does not write unused labels, stale ids must be cleared.
+	err = zeroFile(file, cursor, int(st.Size()))
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func repairShard(dbbasepath string, check *ShardCheck) error {
+	datafile := MakeDataStoreFileName(dbbasepath, check.Id)
+	labelfile := MakeLabelStoreFileName(dbbasepath, check.Id)
+
+	if check.tooshort {
+		check.Repaired = true
+		return RemoveShard(dbbasepath, check.Id)
+	}
+
+	if check.missinglabels {
+		ls, err := OpenLabelsForWriting(labelfile, DefaultLabelOptions())
+		if err != nil {
+			return err
+		}
+		ls.Close()
+		check.Repaired = true
+	}
+
+	if check.badlabels >= 0 {
+		file, err := os.OpenFile(labelfile, os.O_RDWR, 0666)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		st, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		err = zeroFile(file, check.badlabels, int(st.Size()))
+		if err != nil {
+			return err
+		}
+		check.Repaired = true
+	}
+
+	if check.truncate {
+		err := truncateDataStore(datafile, check.Valid)
+		if err != nil {
+			return err
+		}
+		check.Repaired = true
+	}
+	return nil
+}
+
+// Checks the serie as CheckSerie does, and repairs the shards with
+// problems by dropping all the entries after the last consistent one.
+//
+// Corrupted labels are dropped together with the entries using them,
+// missing .labels files are recreated empty, and .data files too short
+// to contain any entry are removed. Compressed shards cannot be repaired.
+//
+// The serie is locked while repairing, timeout is how long to wait for
+// a writer to release it, as in LockSerie.
+//
+// Returns the result of the check performed before the repair.
+func RepairSerie(dbbasepath string, timeout time.Duration) (*SerieCheck, error) {
+	lock, err := LockSerie(dbbasepath, DefaultDataStoreOptions().Mode, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	// Offsets of the repairs are those of files with a header.
+	_, err = upgradeSerie(dbbasepath)
+	if err != nil {
+		return nil, err
+	}
+	result, err := CheckSerie(dbbasepath)
+	if err != nil {
+		return nil, err
+	}
+	for i := range result.Shard {
+		err := repairShard(dbbasepath, &result.Shard[i])
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,142 @@
+package tsdb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+func writeUint64(t *testing.T, filename string, offset int, value uint64) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	assert.Nil(t, err)
+	defer file.Close()
+
+	buffer := make([]byte, 8)
+	*(*uint64)(unsafe.Pointer(&buffer[0])) = value
+	_, err = file.WriteAt(buffer, int64(offset))
+	assert.Nil(t, err)
+}
+
+func TestCheckAndRepairSerie(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	path := filepath.Join(tempdir, "test")
+
+	s := NewSerieWriter(path)
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.CompactOnSeal = false
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := uint64(1); i <= 300; i++ {
+		err := s.Append(i, i, []string{"foo", "bar"})
+		assert.Nil(t, err)
+	}
+	s.Close()
+
+	result, err := CheckSerie(path)
+	assert.Nil(t, err)
+	assert.True(t, result.Ok(), "%v", result.Problems())
+	assert.Equal(t, 3, len(result.Shard))
+	assert.False(t, result.Shard[2].Sealed)
+	entries := GetEntrySize(s.LabelsPerEntry)
+	header := GetHeaderSize()
+
+	// A timestamp going backward in the first shard, only a warning.
+	writeUint64(t, MakeDataStoreFileName(path, 1), header+10*entries, 2)
+	// A label pointing outside of the labels in the second.
+	writeUint64(t, MakeDataStoreFileName(path, 2), header+20*entries+16, 4096)
+	// A cursor in the middle of an entry in the last.
+	last := result.Shard[2].Entries
+	writeUint64(t, MakeDataStoreFileName(path, 3), 8, uint64((last-1)*entries+8))
+
+	result, err = CheckSerie(path)
+	assert.Nil(t, err)
+	problems := result.Problems()
+	assert.Equal(t, 2, len(problems))
+	assert.Equal(t, 20, problems[0].Entry)
+	assert.Equal(t, -1, problems[1].Entry)
+	warnings := result.Warnings()
+	assert.Equal(t, 1, len(warnings))
+	assert.Equal(t, 10, warnings[0].Entry)
+	assert.Equal(t, result.Shard[0].Entries, result.Shard[0].Valid)
+	assert.Equal(t, 20, result.Shard[1].Valid)
+	assert.Equal(t, last-1, result.Shard[2].Valid)
+
+	// The lock is honored.
+	lock, err := LockSerie(path, 0666, 0)
+	assert.Nil(t, err)
+	_, err = RepairSerie(path, 0)
+	assert.IsType(t, &LockedError{}, err)
+	lock.Unlock()
+
+	result, err = RepairSerie(path, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(result.Problems()))
+	assert.False(t, result.Shard[0].Repaired)
+	assert.True(t, result.Shard[1].Repaired)
+	assert.True(t, result.Shard[2].Repaired)
+
+	result, err = CheckSerie(path)
+	assert.Nil(t, err)
+	assert.True(t, result.Ok(), "%v", result.Problems())
+
+	r := NewSerieReader(path)
+	err = r.Open()
+	assert.Nil(t, err)
+	data, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, result.Shard[0].Entries+20+last-1, len(data))
+	assert.Equal(t, []string{"foo", "bar"}, data[len(data)-1].Label)
+
+	// The serie can be written again.
+	s = NewSerieWriter(path)
+	err = s.Open()
+	assert.Nil(t, err)
+	assert.Nil(t, s.Append(1000, 1000, []string{"baz"}))
+	s.Close()
+}
+
+func TestRepairLabels(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+	path := filepath.Join(tempdir, "test")
+
+	s := NewSerieWriter(path)
+	s.LabelBlock = 128
+	err = s.Open()
+	assert.Nil(t, err)
+	for i := uint64(1); i <= 10; i++ {
+		err := s.Append(i, i, []string{"foo", fmt.Sprintf("label-%d", i)})
+		assert.Nil(t, err)
+	}
+	s.Close()
+
+	// Corrupt the size of the label used by the 6th entry ("foo" is first).
+	labels := MakeLabelStoreFileName(path, 1)
+	writeUint64(t, labels, GetHeaderSize()+8+5*16, 0xffffff)
+
+	result, err := RepairSerie(path, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(result.Problems()))
+	assert.Equal(t, 5, result.Shard[0].Valid)
+
+	result, err = CheckSerie(path)
+	assert.Nil(t, err)
+	assert.True(t, result.Ok(), "%v", result.Problems())
+
+	// Missing labels are recreated, dropping all entries with labels.
+	os.Remove(labels)
+	result, err = RepairSerie(path, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(result.Problems()))
+	assert.Equal(t, 0, result.Shard[0].Valid)
+
+	result, err = CheckSerie(path)
+	assert.Nil(t, err)
+	assert.True(t, result.Ok(), "%v", result.Problems())
+}
@@ -1,9 +1,10 @@
 package tsdb
 
 import (
-	//"time"
+	"fmt"
+	"math"
 	"os"
-	//"os"
+	"time"
 	//"syscall"
 )
 
@@ -13,13 +14,28 @@ type SerieWriter struct {
 
 	DataStoreOptions
 	LabelOptions
+	RetentionOptions
 
-	dw *DataStore
-	ls *LabelStore
+	// How long Open waits for a writer in another process to release the
+	// serie. 0 to fail immediately, negative to wait forever.
+	LockTimeout time.Duration
+	// What to do with points older than the last one appended.
+	OutOfOrder OutOfOrderPolicy
+	// Metadata written to the .meta file of the serie by Open, if the
+	// serie has none yet. nil to not create the file.
+	InitialMeta *SerieMeta
+
+	lock *SerieLock
+	dw   *DataStore
+	ls   *LabelStore
+	// Time of the last point appended to the serie.
+	last uint64
+	// Writer of the overlay for OutOfOrderBackfill, opened when first needed.
+	backfill *SerieWriter
 }
 
 func NewSerieWriter(dbbasepath string) *SerieWriter {
-	return &SerieWriter{dbbasepath, 0, DefaultDataStoreOptions(), DefaultLabelOptions(), nil, nil}
+	return &SerieWriter{dbbasepath, 0, DefaultDataStoreOptions(), DefaultLabelOptions(), DefaultRetentionOptions(), 0, OutOfOrderAllow, &SerieMeta{}, nil, nil, nil, 0, nil}
 }
 
 func (serie *SerieWriter) SetMode(mode os.FileMode) {
@@ -27,7 +43,74 @@ func (serie *SerieWriter) SetMode(mode os.FileMode) {
 	serie.LabelOptions.Mode = mode
 }
 
+// Sets the durability of both data and labels. syncevery is only used
+// with DurabilityPeriodic, as the number of appends between syncs.
+func (serie *SerieWriter) SetDurability(durability Durability, syncevery int) {
+	serie.DataStoreOptions.Durability = durability
+	serie.DataStoreOptions.SyncEvery = syncevery
+	serie.LabelOptions.Durability = durability
+}
+
+// Opens the serie for writing, creating it if necessary. Only one writer
+// at a time can own a serie, Open fails with a *LockedError if another
+// process has it open, and LockTimeout expires.
 func (serie *SerieWriter) Open() error {
+	var err error
+	if serie.lock == nil {
+		serie.lock, err = LockSerie(serie.Path, serie.DataStoreOptions.Mode, serie.LockTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Shards written by a version without headers are upgraded in place,
+	// and compactions interrupted by a crash completed or discarded.
+	_, err = upgradeSerie(serie.Path)
+	if err == nil {
+		err = recoverCompaction(serie.Path)
+	}
+	if err == nil {
+		err = serie.createMeta()
+	}
+	if err == nil {
+		err = serie.openShard()
+	}
+	if err == nil {
+		serie.last, err = serie.lastTime()
+		if err != nil {
+			serie.dw.Close()
+			serie.ls.Close()
+		}
+	}
+	if err != nil {
+		serie.lock.Unlock()
+		serie.lock = nil
+	}
+	return err
+}
+
+// Writes InitialMeta to the .meta file, if the serie does not have one.
+func (serie *SerieWriter) createMeta() error {
+	if serie.InitialMeta == nil {
+		return nil
+	}
+	_, err := os.Stat(MakeMetaFileName(serie.Path))
+	if !os.IsNotExist(err) {
+		return err
+	}
+	return WriteSerieMeta(serie.Path, *serie.InitialMeta, serie.DataStoreOptions.Mode)
+}
+
+// Returns the time of the last point of the serie, 0 if it has none.
+func (serie *SerieWriter) lastTime() (uint64, error) {
+	reader := NewSerieReader(serie.Path)
+	reader.Backfill = false
+	defer reader.Close()
+	stats, err := reader.Stats()
+	return stats.Last, err
+}
+
+func (serie *SerieWriter) openShard() error {
 	if serie.Id == 0 {
 		serie.Id = GetFileId(serie.Path)
 	}
@@ -35,11 +118,16 @@ func (serie *SerieWriter) Open() error {
 	var err error
 	for {
 		serie.dw, err = OpenDataStoreForWriting(MakeDataStoreFileName(serie.Path, serie.Id), serie.DataStoreOptions)
+		// Shards copied from a host with a different byte order are left alone.
+		if err == ErrSealed || err == ErrByteOrder {
+			serie.Id += 1
+			continue
+		}
 		if err != nil {
 			return err
 		}
 
-		if serie.dw.lpe == serie.LabelsPerEntry {
+		if serie.dw.lpe == serie.LabelsPerEntry && serie.dw.valuetype == serie.ValueType {
 			break
 		}
 
@@ -50,14 +138,29 @@ func (serie *SerieWriter) Open() error {
 	serie.ls, err = OpenLabelsForWriting(MakeLabelStoreFileName(serie.Path, serie.Id), serie.LabelOptions)
 	if err != nil {
 		serie.dw.Close()
+		serie.dw = nil
 		return err
 	}
 
 	return nil
 }
 
+// Appends a point to the serie. If time is before the last point appended,
+// the point is handled according to OutOfOrder.
 func (s *SerieWriter) Append(time, value uint64, labels []string) error {
-	for {
+	if time < s.last {
+		switch s.OutOfOrder {
+		case OutOfOrderReject:
+			return &OutOfOrderError{time, s.last}
+		case OutOfOrderBackfill:
+			return s.appendBackfill([]Point{{time, value, labels, s.ValueType}})
+		}
+	}
+	if err := s.reopenShard(); err != nil {
+		return err
+	}
+
+	for rotated := false; ; rotated = true {
 		labelids := []LabelID{}
 		// This tries to avoid creating labels associated to this store if the store is full.
 		if len(labels) > 0 {
@@ -71,11 +174,18 @@ func (s *SerieWriter) Append(time, value uint64, labels []string) error {
 					}
 					labelids[i] = id
 				}
+				s.ls.SyncCreated()
 			}
 		}
 
 		ok, _ := s.dw.Append(time, value, labelids)
 		if ok {
+			if time > s.last {
+				s.last = time
+			}
+			if rotated {
+				return s.Expire()
+			}
 			return nil
 		}
 
@@ -84,20 +194,181 @@ func (s *SerieWriter) Append(time, value uint64, labels []string) error {
 
 		s.Id += 1
 
-		err := s.Open()
+		err := s.openShard()
 		if err != nil {
 			return err
 		}
 	}
 }
 
+// Appends a point, converting its value to the ValueType of the serie.
+// Returns an error if the value cannot be represented in that type.
+func (s *SerieWriter) AppendPoint(point Point) error {
+	value, err := ConvertValue(point.Value, point.Type, s.ValueType)
+	if err != nil {
+		return err
+	}
+	return s.Append(point.Time, value, point.Label)
+}
+
+// Appends many points at once, converting their values to the ValueType
+// of the serie. Points are published to readers one shard at a time, and
+// each distinct label is resolved only once.
+//
+// If any value cannot be converted, or a point is out of order with
+// OutOfOrderReject, an error is returned and no point is appended. With
+// OutOfOrderBackfill, the points out of order are appended to the overlay.
+func (s *SerieWriter) AppendBatch(points []Point) error {
+	_, err := s.appendBatch(points)
+	return err
+}
+
+// As AppendBatch, but also returns the points that were not appended, in
+// case of error: all of them if the error was detected before writing, or
+// the points in order that did not fit before the error otherwise.
+func (s *SerieWriter) appendBatch(points []Point) ([]Point, error) {
+	entries := make([]Entry, len(points))
+	for i, point := range points {
+		value, err := ConvertValue(point.Value, point.Type, s.ValueType)
+		if err != nil {
+			return points, fmt.Errorf("point %d: %s", i, err)
+		}
+		entries[i] = Entry{point.Time, value, nil}
+	}
+
+	if s.OutOfOrder != OutOfOrderAllow {
+		ordered, late := make([]Point, 0, len(points)), []Point{}
+		last := s.last
+		for _, point := range points {
+			if point.Time >= last {
+				last = point.Time
+				ordered = append(ordered, point)
+				continue
+			}
+			if s.OutOfOrder == OutOfOrderReject {
+				return points, &OutOfOrderError{point.Time, last}
+			}
+			late = append(late, point)
+		}
+
+		if len(late) > 0 {
+			err := s.appendBackfill(late)
+			if err != nil {
+				return points, err
+			}
+			points, entries = ordered, entries[:0]
+			for _, point := range points {
+				value, _ := ConvertValue(point.Value, point.Type, s.ValueType)
+				entries = append(entries, Entry{point.Time, value, nil})
+			}
+		}
+	}
+	if len(entries) <= 0 {
+		return nil, nil
+	}
+	if err := s.reopenShard(); err != nil {
+		return points, err
+	}
+
+	rotated := false
+	for len(entries) > 0 {
+		free := s.dw.Free()
+		if free > len(entries) {
+			free = len(entries)
+		}
+
+		// Labels are only created for the entries that fit in this shard.
+		labelids := make(map[string]LabelID)
+		for i := 0; i < free; i++ {
+			labels := points[len(points)-len(entries)+i].Label
+			if len(labels) <= 0 {
+				continue
+			}
+			entries[i].Labels = make([]LabelID, len(labels))
+			for j, label := range labels {
+				id, ok := labelids[label]
+				if !ok {
+					var err error
+					id, err = s.ls.CreateLabel(label)
+					if err != nil {
+						return points[len(points)-len(entries):], err
+					}
+					labelids[label] = id
+				}
+				entries[i].Labels[j] = id
+			}
+		}
+
+		s.ls.SyncCreated()
+		appended, _ := s.dw.AppendBatch(entries[:free])
+		// Only the points appended move last, so the others can be retried.
+		for _, point := range points[len(points)-len(entries) : len(points)-len(entries)+appended] {
+			if point.Time > s.last {
+				s.last = point.Time
+			}
+		}
+		entries = entries[appended:]
+		if len(entries) <= 0 {
+			break
+		}
+
+		s.dw.Seal()
+		s.ls.Seal()
+		s.Id += 1
+		rotated = true
+
+		err := s.openShard()
+		if err != nil {
+			return points[len(points)-len(entries):], err
+		}
+	}
+
+	if rotated {
+		return nil, s.Expire()
+	}
+	return nil, nil
+}
+
+func (s *SerieWriter) AppendFloat64(time uint64, value float64, labels []string) error {
+	return s.AppendPoint(Point{time, math.Float64bits(value), labels, TypeFloat64})
+}
+
+func (s *SerieWriter) AppendInt64(time uint64, value int64, labels []string) error {
+	return s.AppendPoint(Point{time, uint64(value), labels, TypeInt64})
+}
+
+// Opens a shard to write to again, if opening the next shard failed when
+// the last one was full, as with the disk full or out of inodes.
+func (s *SerieWriter) reopenShard() error {
+	if s.dw != nil {
+		return nil
+	}
+	return s.openShard()
+}
+
 func (s *SerieWriter) Sync() {
-	s.dw.Sync()
-	s.ls.Sync()
+	if s.dw != nil {
+		s.dw.Sync()
+		s.ls.Sync()
+	}
+	if s.backfill != nil {
+		s.backfill.Sync()
+	}
 }
 
 func (s *SerieWriter) Close() {
-	s.dw.Close()
-	s.ls.Close()
+	if s.dw != nil {
+		s.dw.Close()
+		s.ls.Close()
+	}
 	s.Id = 0
+	if s.backfill != nil {
+		s.backfill.Close()
+		s.backfill = nil
+	}
+
+	if s.lock != nil {
+		s.lock.Unlock()
+		s.lock = nil
+	}
 }
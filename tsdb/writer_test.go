@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"syscall"
 	"testing"
+	"time"
 	// "fmt"
 )
 
@@ -52,7 +54,7 @@ func TestSerieWriterBasics(t *testing.T) {
 		assert.Nil(t, err)
 	}
 	s.Close()
-	files1, err := filepath.Glob(filepath.Join(tempdir, "test") + "*")
+	files1, err := filepath.Glob(filepath.Join(tempdir, "test") + "-*")
 	assert.Nil(t, err)
 
 	basepath := filepath.Join(tempdir, "test")
@@ -80,7 +82,94 @@ func TestSerieWriterBasics(t *testing.T) {
 	}
 	s.Close()
 
-	files2, err := filepath.Glob(filepath.Join(tempdir, "test") + "*")
+	files2, err := filepath.Glob(filepath.Join(tempdir, "test") + "-*")
 	assert.Equal(t, 2*len(files1), len(files2))
 	assert.Nil(t, err)
 }
+
+func TestSerieWriterLocking(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+
+	s1 := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s1.MaxEntries = 32
+	s1.LabelBlock = 128
+	err = s1.Open()
+	assert.Nil(t, err)
+
+	// The lock is per open file, so it works within the same process too.
+	s2 := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s2.MaxEntries = 32
+	s2.LabelBlock = 128
+	err = s2.Open()
+	assert.NotNil(t, err)
+	locked, ok := err.(*LockedError)
+	assert.True(t, ok)
+	assert.Equal(t, os.Getpid(), locked.Pid)
+	assert.Equal(t, fmt.Sprintf("serie %s is locked by pid %d", s2.Path, os.Getpid()), err.Error())
+
+	// Times out if the lock is not released.
+	s2.LockTimeout = 50 * time.Millisecond
+	start := time.Now()
+	err = s2.Open()
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// Succeeds as soon as the lock is released.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.Nil(t, s1.Append(1, 1, nil))
+		s1.Close()
+	}()
+	s2.LockTimeout = -1
+	err = s2.Open()
+	assert.Nil(t, err)
+	assert.Nil(t, s2.Append(2, 2, nil))
+	s2.Close()
+
+	r := NewSerieReader(filepath.Join(tempdir, "test"))
+	assert.Nil(t, r.Open())
+	data, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(data))
+}
+
+func TestSerieWriterAppendBatch(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "serie-")
+	assert.Nil(t, err)
+
+	s := NewSerieWriter(filepath.Join(tempdir, "test"))
+	s.MaxEntries = 32
+	s.LabelBlock = 128
+	s.MaxShards = 3
+	err = s.Open()
+	assert.Nil(t, err)
+
+	points := []Point{}
+	for i := uint64(0); i < 1000; i++ {
+		points = append(points, Point{i, i, []string{"foo", fmt.Sprintf("bar=%d", i%3)}, TypeUint64})
+	}
+	err = s.AppendBatch(points[:10])
+	assert.Nil(t, err)
+	err = s.AppendBatch(points[10:])
+	assert.Nil(t, err)
+
+	// Nothing is written if a value cannot be converted.
+	err = s.AppendBatch([]Point{{1000, 1, nil, TypeUint64}, {1001, math.Float64bits(0.5), nil, TypeFloat64}})
+	assert.NotNil(t, err)
+	s.Close()
+
+	// Retention was applied after rotating shards.
+	assert.Equal(t, 3, len(GetDataFiles(filepath.Join(tempdir, "test"))))
+
+	r := NewSerieReader(filepath.Join(tempdir, "test"))
+	err = r.Open()
+	assert.Nil(t, err)
+	data, err := r.GetData(r.FirstLocation(), r.LastLocation(), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000-5*127, len(data))
+	for _, point := range data {
+		assert.Equal(t, []string{"foo", fmt.Sprintf("bar=%d", point.Time%3)}, point.Label)
+	}
+	assert.Equal(t, uint64(999), data[len(data)-1].Time)
+}